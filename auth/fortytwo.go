@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/oauth2"
+	"whistleblower/intra"
+)
+
+// FortyTwo logs users in with their 42 intra account. Its tokens are kept on
+// the session, since student search and project lookups call the intra as
+// the user.
+type FortyTwo struct {
+	ProviderConfig
+	oauth2 *oauth2.Config
+	intra  *intra.Client
+}
+
+// FortyTwoFromEnv configures the 42 provider from OAUTH_42_CLIENT_ID,
+// OAUTH_42_CLIENT_SECRET and OAUTH_42_REDIRECT_URL, with optional
+// OAUTH_42_ROLE_MAPPING and OAUTH_42_CAMPUS_IDS.
+func FortyTwoFromEnv(client *intra.Client) (*FortyTwo, error) {
+	cfg, err := providerConfigFromEnv("OAUTH_42")
+	if err != nil {
+		return nil, err
+	}
+
+	return &FortyTwo{
+		ProviderConfig: cfg,
+		intra:          client,
+		oauth2: &oauth2.Config{
+			ClientID:     os.Getenv("OAUTH_42_CLIENT_ID"),
+			ClientSecret: os.Getenv("OAUTH_42_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OAUTH_42_REDIRECT_URL"),
+			Scopes:       []string{"public"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  client.BaseURL() + "/oauth/authorize",
+				TokenURL: client.BaseURL() + "/oauth/token",
+			},
+		},
+	}, nil
+}
+
+func (p *FortyTwo) Name() string { return "42" }
+
+func (p *FortyTwo) Label() string { return "42 Intra" }
+
+func (p *FortyTwo) LinksByLogin() bool { return true }
+
+func (p *FortyTwo) AuthURL(ctx context.Context, state string) (string, error) {
+	return p.oauth2.AuthCodeURL(state), nil
+}
+
+// Exchange trades the code for a token and reads the user from /v2/me.
+func (p *FortyTwo) Exchange(ctx context.Context, code string) (*Identity, *oauth2.Token, error) {
+	ctx = p.httpContext(ctx)
+
+	token, err := p.oauth2.Exchange(ctx, code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to exchange code for token: %w", err)
+	}
+
+	user, err := p.intra.Me(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get user info: %w", err)
+	}
+
+	campusID := 0
+	for _, cu := range user.CampusUsers {
+		if cu.IsPrimary || campusID == 0 {
+			campusID = cu.CampusID
+		}
+	}
+
+	return &Identity{
+		Provider:    p.Name(),
+		Subject:     strconv.Itoa(user.ID),
+		Login:       user.Login,
+		Email:       user.Email,
+		DisplayName: user.DisplayName,
+		IntraID:     user.ID,
+		CampusID:    campusID,
+		Claims: map[string]interface{}{
+			"login":     user.Login,
+			"email":     user.Email,
+			"staff?":    user.Staff,
+			"campus_id": campusID,
+		},
+	}, token, nil
+}
+
+// httpContext runs OAuth calls through the intra client's HTTP client so
+// they get the same timeout as every other intra call.
+func (p *FortyTwo) httpContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, p.intra.HTTPClient())
+}
+
+// tokenSource refreshes token when it expires.
+func (p *FortyTwo) tokenSource(ctx context.Context, token *oauth2.Token) oauth2.TokenSource {
+	return p.oauth2.TokenSource(p.httpContext(ctx), token)
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// oidcTimeout bounds each call to the OIDC provider.
+const oidcTimeout = 10 * time.Second
+
+// OIDC logs users in with a generic OpenID Connect provider, such as a
+// school's Keycloak or Google Workspace. The user is read from the userinfo
+// endpoint, so ID tokens need not be verified; the token is not kept.
+type OIDC struct {
+	ProviderConfig
+	name        string
+	label       string
+	issuer      string
+	loginClaim  string
+	campusClaim string
+	client      *http.Client
+	oauth2      oauth2.Config
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	discoveryAt time.Time
+}
+
+// oidcDiscoveryTTL is how long the provider's discovery document is cached.
+const oidcDiscoveryTTL = time.Hour
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// OIDCFromEnv configures an OIDC provider from OIDC_ISSUER, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL. It returns nil when OIDC_ISSUER
+// is not set.
+func OIDCFromEnv() (*OIDC, error) {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	cfg, err := providerConfigFromEnv("OIDC")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &OIDC{
+		ProviderConfig: cfg,
+		name:           envOr("OIDC_NAME", "oidc"),
+		label:          envOr("OIDC_DISPLAY_NAME", "Single sign-on"),
+		issuer:         issuer,
+		loginClaim:     envOr("OIDC_LOGIN_CLAIM", "preferred_username"),
+		campusClaim:    os.Getenv("OIDC_CAMPUS_CLAIM"),
+		client:         &http.Client{Timeout: oidcTimeout},
+		oauth2: oauth2.Config{
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Scopes:       strings.Fields(envOr("OIDC_SCOPES", "openid profile email")),
+		},
+	}
+	if p.oauth2.ClientID == "" || p.oauth2.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if strings.ContainsAny(p.name, ":/") {
+		return nil, fmt.Errorf("OIDC_NAME must not contain ':' or '/'")
+	}
+	if len(p.CampusIDs) > 0 && p.campusClaim == "" {
+		return nil, fmt.Errorf("OIDC_CAMPUS_IDS needs OIDC_CAMPUS_CLAIM")
+	}
+	return p, nil
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (p *OIDC) Name() string { return p.name }
+
+func (p *OIDC) Label() string { return p.label }
+
+// LinksByLogin is false: an OIDC login that happens to match a 42 login is
+// not the same person. Users link an OIDC account from their dashboard.
+func (p *OIDC) LinksByLogin() bool { return false }
+
+func (p *OIDC) AuthURL(ctx context.Context, state string) (string, error) {
+	config, _, err := p.config(ctx)
+	if err != nil {
+		return "", err
+	}
+	return config.AuthCodeURL(state), nil
+}
+
+// Exchange trades the code for a token and reads the user's claims from the
+// userinfo endpoint.
+func (p *OIDC) Exchange(ctx context.Context, code string) (*Identity, *oauth2.Token, error) {
+	config, discovery, err := p.config(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to exchange code for token: %w", err)
+	}
+
+	var claims map[string]interface{}
+	if err := p.getJSON(ctx, discovery.UserinfoEndpoint, token, &claims); err != nil {
+		return nil, nil, fmt.Errorf("failed to get user info: %w", err)
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, nil, fmt.Errorf("user info has no sub claim")
+	}
+	username, _ := claims[p.loginClaim].(string)
+	if username == "" {
+		return nil, nil, fmt.Errorf("user info has no %s claim", p.loginClaim)
+	}
+
+	identity := &Identity{
+		Provider: p.name,
+		Subject:  subject,
+		// Prefixed so provider usernames never collide with 42 logins.
+		Login:  p.name + ":" + strings.ToLower(username),
+		Claims: claims,
+	}
+	identity.Email, _ = claims["email"].(string)
+	identity.DisplayName, _ = claims["name"].(string)
+	if identity.DisplayName == "" {
+		identity.DisplayName = username
+	}
+	if p.campusClaim != "" {
+		identity.CampusID, _ = strconv.Atoi(fmt.Sprint(claims[p.campusClaim]))
+	}
+	return identity, nil, nil
+}
+
+// config returns the OAuth configuration with the endpoints from the
+// provider's discovery document, and the document itself.
+func (p *OIDC) config(ctx context.Context) (*oauth2.Config, *oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery == nil || time.Since(p.discoveryAt) > oidcDiscoveryTTL {
+		var discovery oidcDiscovery
+		err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", nil, &discovery)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+			return nil, nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", discovery.Issuer, p.issuer)
+		}
+		if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserinfoEndpoint == "" {
+			return nil, nil, fmt.Errorf("OIDC discovery document lacks an authorization, token or userinfo endpoint")
+		}
+		p.discovery, p.discoveryAt = &discovery, time.Now()
+	}
+
+	config := p.oauth2
+	config.Endpoint = oauth2.Endpoint{
+		AuthURL:  p.discovery.AuthorizationEndpoint,
+		TokenURL: p.discovery.TokenEndpoint,
+	}
+	return &config, p.discovery, nil
+}
+
+func (p *OIDC) getJSON(ctx context.Context, url string, token *oauth2.Token, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != nil {
+		token.SetAuthHeader(req)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
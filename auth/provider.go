@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"whistleblower/intra"
+	"whistleblower/models"
+)
+
+// ErrCampusNotAllowed is returned by CheckCampus for users from a campus the
+// provider is not configured to let in.
+var ErrCampusNotAllowed = errors.New("campus not allowed")
+
+// Identity is who a provider says the user is after a successful login.
+type Identity struct {
+	Provider string
+	// Subject identifies the account at the provider and never changes,
+	// unlike the login.
+	Subject     string
+	Login       string
+	Email       string
+	DisplayName string
+	// IntraID is only set by the 42 provider.
+	IntraID  int
+	CampusID int
+	// Claims holds the provider's raw user attributes, which role mappings
+	// match against.
+	Claims map[string]interface{}
+}
+
+// Provider is an identity provider users log in with.
+type Provider interface {
+	// Name identifies the provider in URLs and in user_identities.
+	Name() string
+	// Label is shown on the login button.
+	Label() string
+	AuthURL(ctx context.Context, state string) (string, error)
+	// Exchange trades an authorization code for the user's identity. The
+	// token is only returned by providers whose token the app calls APIs
+	// with, and is nil otherwise.
+	Exchange(ctx context.Context, code string) (*Identity, *oauth2.Token, error)
+	// LinksByLogin reports whether a first login may attach to an existing
+	// user with the same login. Only providers that own the login namespace,
+	// like the 42 intra, may.
+	LinksByLogin() bool
+	// Role is the role the identity's claims map to, or "" for none.
+	Role(identity *Identity) string
+	// CheckCampus returns ErrCampusNotAllowed when the identity's campus is
+	// not one the provider lets in.
+	CheckCampus(identity *Identity) error
+}
+
+// RoleRule grants Role to identities whose Claim has Value.
+type RoleRule struct {
+	Claim string
+	Value string
+	Role  string
+}
+
+// ProviderConfig holds the settings every provider shares. Providers embed
+// it for their Role and CheckCampus methods.
+type ProviderConfig struct {
+	RoleMapping []RoleRule
+	// CampusIDs restricts logins to these campuses; empty lets everyone in.
+	CampusIDs []int
+}
+
+// Role returns the highest role any rule grants the identity.
+func (p ProviderConfig) Role(identity *Identity) string {
+	role := ""
+	for _, rule := range p.RoleMapping {
+		if claimMatches(identity.Claims[rule.Claim], rule.Value) && models.RoleRank(rule.Role) >= models.RoleRank(role) {
+			role = rule.Role
+		}
+	}
+	return role
+}
+
+func (p ProviderConfig) CheckCampus(identity *Identity) error {
+	if len(p.CampusIDs) == 0 || slices.Contains(p.CampusIDs, identity.CampusID) {
+		return nil
+	}
+	return ErrCampusNotAllowed
+}
+
+// claimMatches reports whether a claim equals value, or contains it when the
+// claim is a list, such as a groups claim.
+func claimMatches(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if claimMatches(item, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(claim) == value
+}
+
+// ParseRoleMapping reads comma separated claim=value:role rules, for example
+// "groups=whistleblower-admins:admin,staff?=true:staff".
+func ParseRoleMapping(spec string) ([]RoleRule, error) {
+	var rules []RoleRule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, ":")
+		claim, value, found := strings.Cut(entry[:max(i, 0)], "=")
+		if i < 0 || !found || claim == "" {
+			return nil, fmt.Errorf("role mapping %q: expected claim=value:role", entry)
+		}
+		role := entry[i+1:]
+		if role != models.RoleStudent && role != models.RoleStaff && role != models.RoleAdmin {
+			return nil, fmt.Errorf("role mapping %q: unknown role %q", entry, role)
+		}
+		rules = append(rules, RoleRule{Claim: claim, Value: value, Role: role})
+	}
+	return rules, nil
+}
+
+// parseCampusIDs reads a comma separated list of campus IDs.
+func parseCampusIDs(spec string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid campus ID %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// providerConfigFromEnv reads <prefix>_ROLE_MAPPING and <prefix>_CAMPUS_IDS.
+func providerConfigFromEnv(prefix string) (ProviderConfig, error) {
+	var cfg ProviderConfig
+	var err error
+	if cfg.RoleMapping, err = ParseRoleMapping(os.Getenv(prefix + "_ROLE_MAPPING")); err != nil {
+		return cfg, fmt.Errorf("%s_ROLE_MAPPING: %w", prefix, err)
+	}
+	if cfg.CampusIDs, err = parseCampusIDs(os.Getenv(prefix + "_CAMPUS_IDS")); err != nil {
+		return cfg, fmt.Errorf("%s_CAMPUS_IDS: %w", prefix, err)
+	}
+	return cfg, nil
+}
+
+// Providers holds the configured identity providers, in the order their
+// login buttons are shown. The 42 provider always comes first.
+type Providers struct {
+	fortyTwo *FortyTwo
+	list     []Provider
+}
+
+// ProvidersFromEnv sets up the 42 provider, and the OIDC provider when
+// OIDC_ISSUER is set.
+func ProvidersFromEnv(intraClient *intra.Client) (*Providers, error) {
+	fortyTwo, err := FortyTwoFromEnv(intraClient)
+	if err != nil {
+		return nil, err
+	}
+	providers := &Providers{fortyTwo: fortyTwo, list: []Provider{fortyTwo}}
+
+	oidc, err := OIDCFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if oidc != nil {
+		if oidc.Name() == fortyTwo.Name() {
+			return nil, fmt.Errorf("OIDC_NAME must not be %q", fortyTwo.Name())
+		}
+		providers.list = append(providers.list, oidc)
+		log.Printf("OIDC login enabled as %q with %s", oidc.Name(), oidc.issuer)
+	}
+	return providers, nil
+}
+
+// Get returns the provider called name, or nil.
+func (p *Providers) Get(name string) Provider {
+	for _, provider := range p.list {
+		if provider.Name() == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+func (p *Providers) List() []Provider {
+	return p.list
+}
+
+// FortyTwo returns the 42 provider, whose tokens the app calls the intra
+// API with.
+func (p *Providers) FortyTwo() *FortyTwo {
+	return p.fortyTwo
+}
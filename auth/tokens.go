@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"whistleblower/database"
+	"whistleblower/encryption"
+	"whistleblower/models"
+)
+
+// HashSessionToken returns the value stored in sessions.token_hash for a
+// cookie token, so a leaked database does not hand out live sessions.
+func HashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HashAPIKey returns the value stored in api_keys.key_hash for an API key.
+// Keys are random, so a plain hash is enough to keep them from being
+// recovered.
+func HashAPIKey(key string) string {
+	return HashSessionToken(key)
+}
+
+// TokenStore keeps users' intra OAuth tokens encrypted against their
+// session and hands them out as refreshing token sources.
+type TokenStore struct {
+	db       *database.DB
+	cipher   *encryption.Cipher
+	fortyTwo *FortyTwo
+}
+
+func NewTokenStore(db *database.DB, cipher *encryption.Cipher, fortyTwo *FortyTwo) *TokenStore {
+	return &TokenStore{db: db, cipher: cipher, fortyTwo: fortyTwo}
+}
+
+// Seal encrypts token for storage in sessions.oauth_token.
+func (s *TokenStore) Seal(token *oauth2.Token) (string, error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return s.cipher.Encrypt(data)
+}
+
+func (s *TokenStore) open(value string) (*oauth2.Token, error) {
+	data, err := s.cipher.Decrypt(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// TokenSource returns a token source acting as the session's user at the
+// intra, for sessions that logged in with 42. Expired access tokens are
+// refreshed with the stored refresh token and the new token is written back
+// to the session.
+func (s *TokenStore) TokenSource(ctx context.Context, session *models.Session) (oauth2.TokenSource, error) {
+	if session.OAuthToken == "" {
+		return nil, fmt.Errorf("session %d has no intra token", session.ID)
+	}
+
+	token, err := s.open(session.OAuthToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session token: %w", err)
+	}
+
+	return &persistingTokenSource{
+		store:     s,
+		sessionID: session.ID,
+		last:      token.AccessToken,
+		src:       oauth2.ReuseTokenSource(token, s.fortyTwo.tokenSource(ctx, token)),
+	}, nil
+}
+
+type persistingTokenSource struct {
+	store     *TokenStore
+	sessionID int
+	src       oauth2.TokenSource
+
+	mu   sync.Mutex
+	last string
+}
+
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := p.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if token.AccessToken != p.last {
+		sealed, err := p.store.Seal(token)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.store.db.UpdateSessionOAuthToken(p.sessionID, sealed); err != nil {
+			return nil, fmt.Errorf("failed to store refreshed token: %w", err)
+		}
+		p.last = token.AccessToken
+	}
+
+	return token, nil
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFCVectors(t *testing.T) {
+	// The RFC lists 8-digit codes; these are their last 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(rfcSecret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	// now is the first second of step; last is the last second of it.
+	const step = int64(50000000)
+	now := time.Unix(step*totpPeriod, 0)
+	last := now.Add(totpPeriod*time.Second - time.Second)
+
+	code := func(offset int64) string {
+		c, err := TOTPCode(rfcSecret, step+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name      string
+		code      string
+		now       time.Time
+		afterStep int64
+		wantStep  int64
+		wantOK    bool
+	}{
+		{"current step", code(0), now, 0, step, true},
+		{"current step, last second", code(0), last, 0, step, true},
+		{"previous step", code(-1), now, 0, step - 1, true},
+		{"previous step, last second", code(-1), last, 0, step - 1, true},
+		{"next step", code(1), now, 0, step + 1, true},
+		{"two steps old", code(-2), now, 0, 0, false},
+		{"two steps old, one second earlier", code(-2), now.Add(-time.Second), 0, step - 2, true},
+		{"two steps ahead", code(2), last, 0, 0, false},
+		{"two steps ahead, one second later", code(2), last.Add(time.Second), 0, step + 2, true},
+		{"spaces", code(0)[:3] + " " + code(0)[3:] + " ", now, 0, step, true},
+		{"replayed", code(0), now, step, 0, false},
+		{"older than the last used", code(-1), now, step - 1, 0, false},
+		{"newer than the last used", code(1), now, step, step + 1, true},
+		{"too short", code(0)[:5], now, 0, 0, false},
+		{"too long", code(0) + "0", now, 0, 0, false},
+		{"not digits", "abcdef", now, 0, 0, false},
+		{"empty", "", now, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := ValidateTOTP(rfcSecret, tt.code, tt.now, tt.afterStep)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("ValidateTOTP(%q) = %d, %v, want %d, %v", tt.code, gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPInvalidSecret(t *testing.T) {
+	if _, ok := ValidateTOTP("not base32!", "123456", time.Now(), 0); ok {
+		t.Error("ValidateTOTP accepted a code for an invalid secret")
+	}
+}
@@ -0,0 +1,218 @@
+// Package campussync mirrors a campus's intra users into the local users
+// table.
+package campussync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"whistleblower/database"
+	"whistleblower/intra"
+	"whistleblower/models"
+)
+
+const (
+	// PerPage is the intra page size used by syncs.
+	PerPage = 100
+
+	// incrementalOverlap re-fetches a little before the last sync so users
+	// updated while that sync was running are not missed.
+	incrementalOverlap = 10 * time.Minute
+
+	pageRetryDelay = 5 * time.Second
+)
+
+// Checkpoint is everything needed to continue an interrupted sync from the
+// first page that was not saved yet.
+type Checkpoint struct {
+	NextPage     int                `json:"next_page"`
+	StartedAt    time.Time          `json:"started_at"`
+	UpdatedSince time.Time          `json:"updated_since,omitempty"`
+	Summary      models.SyncSummary `json:"summary"`
+
+	// Incremental syncs page by keyset rather than by offset: each page
+	// starts after the last user saved, by updated_at then ID, so users
+	// updated during the sync cannot shift unread ones onto fetched pages.
+	// KeysetPage only goes past 1 while a full page of users shares the
+	// second the page starts at.
+	AfterUpdatedAt time.Time `json:"after_updated_at,omitempty"`
+	AfterID        int       `json:"after_id,omitempty"`
+	KeysetPage     int       `json:"keyset_page,omitempty"`
+}
+
+// incremental reports whether the sync only fetches updated users.
+func (cp *Checkpoint) incremental() bool {
+	return !cp.UpdatedSince.IsZero()
+}
+
+// lowerBound is where the next incremental page starts, to the second.
+func (cp *Checkpoint) lowerBound() time.Time {
+	if cp.AfterUpdatedAt.IsZero() {
+		return cp.UpdatedSince.Truncate(time.Second)
+	}
+	return cp.AfterUpdatedAt.Truncate(time.Second)
+}
+
+// advance drops the users of an incremental page that were saved already
+// and moves the keyset past the others. It returns the users left and how
+// many were dropped.
+func (cp *Checkpoint) advance(users []models.Auth42User) ([]models.Auth42User, int) {
+	bound := cp.lowerBound()
+	var fresh []models.Auth42User
+	for _, u := range users {
+		if u.UpdatedAt.After(cp.AfterUpdatedAt) || u.UpdatedAt.Equal(cp.AfterUpdatedAt) && u.ID > cp.AfterID {
+			fresh = append(fresh, u)
+		}
+	}
+
+	if users[len(users)-1].UpdatedAt.Truncate(time.Second).Equal(bound) {
+		cp.KeysetPage = max(cp.KeysetPage, 1) + 1
+	} else {
+		cp.KeysetPage = 1
+	}
+	if len(fresh) > 0 {
+		last := fresh[len(fresh)-1]
+		cp.AfterUpdatedAt, cp.AfterID = last.UpdatedAt, last.ID
+	}
+	return fresh, len(users) - len(fresh)
+}
+
+type Options struct {
+	// Full walks every user of the campus and deactivates missing ones.
+	Full bool
+	// Resume continues a previous run of the same sync instead of starting
+	// over.
+	Resume *Checkpoint
+	// PageRetries is how often a failing page is retried, on top of the
+	// intra client's own retries, before the sync gives up.
+	PageRetries int
+	// OnPage, if set, is called after each page has been saved with the
+	// checkpoint to resume from and intra's total user count (-1 if
+	// unknown).
+	OnPage func(cp Checkpoint, totalUsers int)
+	// OnPageError, if set, is called for every failed page attempt.
+	OnPageError func(page int, err error)
+}
+
+type Syncer struct {
+	db    *database.DB
+	intra *intra.Client
+}
+
+func New(db *database.DB, intraClient *intra.Client) *Syncer {
+	return &Syncer{db: db, intra: intraClient}
+}
+
+// SyncCampus brings the campus's users up to date. The first sync of a
+// campus, or any sync with opts.Full set, walks every user and deactivates the
+// ones intra no longer lists. Other syncs only fetch users intra reports as
+// updated since the previous run.
+func (s *Syncer) SyncCampus(ctx context.Context, campusID int, opts Options) (*models.SyncSummary, error) {
+	state, err := s.db.GetCampusSyncState(campusID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sync state: %w", err)
+	}
+
+	cp := Checkpoint{NextPage: 1, StartedAt: time.Now().UTC()}
+	cp.Summary = models.SyncSummary{CampusID: campusID, Mode: "full", StartedAt: cp.StartedAt}
+	if !opts.Full && state.LastSyncedAt != nil {
+		cp.Summary.Mode = "incremental"
+		cp.UpdatedSince = state.LastSyncedAt.Add(-incrementalOverlap)
+	}
+	if opts.Resume != nil && opts.Resume.NextPage > 0 {
+		cp = *opts.Resume
+	}
+
+	for {
+		users, total, err := s.fetchPage(ctx, campusID, cp, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			break
+		}
+		lastPage := len(users) < PerPage
+
+		if cp.incremental() {
+			// X-Total only counts users from the page's lower bound on,
+			// including the ones saved already.
+			skipped := (max(cp.KeysetPage, 1) - 1) * PerPage
+			var dropped int
+			users, dropped = cp.advance(users)
+			if total >= 0 {
+				total += cp.Summary.Fetched - skipped - dropped
+			}
+		}
+
+		if len(users) > 0 {
+			pageSummary, err := s.db.UpsertCampusUsers(campusID, users, cp.StartedAt)
+			if err != nil {
+				return nil, fmt.Errorf("failed to save campus users page %d: %w", cp.NextPage, err)
+			}
+			cp.Summary.Fetched += len(users)
+			cp.Summary.Created += pageSummary.Created
+			cp.Summary.Updated += pageSummary.Updated
+			cp.Summary.Unchanged += pageSummary.Unchanged
+			cp.Summary.Skipped += pageSummary.Skipped
+			cp.Summary.Deactivated += pageSummary.Deactivated
+		}
+		cp.NextPage++
+
+		if opts.OnPage != nil {
+			opts.OnPage(cp, total)
+		}
+
+		if lastPage {
+			break
+		}
+	}
+
+	summary := cp.Summary
+	if summary.Mode == "full" {
+		deactivated, err := s.db.DeactivateUnseenCampusUsers(campusID, cp.StartedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deactivate missing users: %w", err)
+		}
+		summary.Deactivated += deactivated
+		state.LastFullSyncAt = &cp.StartedAt
+	}
+
+	state.LastSyncedAt = &cp.StartedAt
+	if err := s.db.SaveCampusSyncState(state); err != nil {
+		return nil, fmt.Errorf("failed to save sync state: %w", err)
+	}
+
+	summary.FinishedAt = time.Now().UTC()
+	return &summary, nil
+}
+
+func (s *Syncer) fetchPage(ctx context.Context, campusID int, cp Checkpoint, opts Options) ([]models.Auth42User, int, error) {
+	tokens := s.intra.AppTokenSource()
+
+	// Incremental pages are bounded above by the sync's start, so users
+	// updated while it runs wait for the next sync.
+	page, updatedFrom := cp.NextPage, time.Time{}
+	if cp.incremental() {
+		page, updatedFrom = max(cp.KeysetPage, 1), cp.lowerBound()
+	}
+
+	for attempt := 0; ; attempt++ {
+		users, total, err := s.intra.GetCampusUsers(ctx, campusID, tokens, page, PerPage, updatedFrom, cp.StartedAt)
+		if err == nil {
+			return users, total, nil
+		}
+		if opts.OnPageError != nil {
+			opts.OnPageError(cp.NextPage, err)
+		}
+		if attempt >= opts.PageRetries || ctx.Err() != nil {
+			return nil, 0, fmt.Errorf("failed to fetch campus users page %d: %w", cp.NextPage, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(pageRetryDelay * time.Duration(attempt+1)):
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package campussync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"whistleblower/models"
+)
+
+// DefaultDirectoryFile is the campus list shipped with the repository, used
+// to seed the directory until it is refreshed from intra.
+const DefaultDirectoryFile = "all_campuses.json"
+
+// SeedDirectory loads the campus directory from path when the directory is
+// still empty. A missing file is not an error; the directory then stays
+// empty until the first refresh from intra.
+func (s *Syncer) SeedDirectory(path string) (int, error) {
+	count, err := s.db.GetCampusCount()
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var campuses []models.Campus
+	if err := json.Unmarshal(data, &campuses); err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := s.db.UpsertCampuses(campuses); err != nil {
+		return 0, err
+	}
+
+	return len(campuses), nil
+}
+
+// RefreshDirectory replaces the campus directory's details with intra's
+// current campus list and returns the number of campuses seen.
+func (s *Syncer) RefreshDirectory(ctx context.Context) (int, error) {
+	tokens := s.intra.AppTokenSource()
+
+	seen := 0
+	for page := 1; ; page++ {
+		campuses, _, err := s.intra.GetCampuses(ctx, tokens, page, PerPage)
+		if err != nil {
+			return seen, fmt.Errorf("failed to fetch campus page %d: %w", page, err)
+		}
+		if len(campuses) == 0 {
+			break
+		}
+
+		if err := s.db.UpsertCampuses(campuses); err != nil {
+			return seen, fmt.Errorf("failed to save campus page %d: %w", page, err)
+		}
+		seen += len(campuses)
+
+		if len(campuses) < PerPage {
+			break
+		}
+	}
+
+	return seen, nil
+}
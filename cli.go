@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"whistleblower/database"
+	"whistleblower/encryption"
+	"whistleblower/jobs"
+	"whistleblower/models"
+)
+
+const usage = `Usage: whistleblower [command]
+
+Without a command the web server starts. Commands:
+
+  audit list [-actor login] [-action name] [-target-type type] [-target-id id] [-limit n] [-json]
+        print audit log entries, newest first
+  audit verify
+        check the audit log's hash chain; exits with status 1 when it is broken
+  set-role <login> <student|staff|admin> [reason]
+        change a user's role, recorded in the audit log as done from the CLI
+  keys status
+        list the field encryption keys and how many report fields each one sealed
+  keys rotate [-reencrypt]
+        encrypt new report fields with a fresh data key; -reencrypt also
+        re-encrypts existing fields with it
+  keys reencrypt
+        re-encrypt report fields still sealed with an older data key
+  retention report
+        show what the next retention purge would remove (RETENTION_POLICIES)
+  retention purge
+        run the retention purge now
+
+To rotate the master key, set the new key as ENCRYPTION_KEY, move the old one
+to ENCRYPTION_KEY_PREVIOUS and start once: the data keys are rewrapped.
+`
+
+// runCommand runs a maintenance command against the database instead of
+// starting the server, and returns the process exit status.
+func runCommand(args []string) int {
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Print(usage)
+		return 0
+	}
+
+	db, err := database.NewDatabase(databasePath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	cipher, err := encryption.FromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load encryption key:", err)
+		return 1
+	}
+	if err := db.EnableFieldEncryption(cipher); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to enable field encryption:", err)
+		return 1
+	}
+
+	switch {
+	case args[0] == "audit" && len(args) > 1 && args[1] == "list":
+		err = auditListCommand(db, args[2:])
+	case args[0] == "audit" && len(args) > 1 && args[1] == "verify":
+		return auditVerifyCommand(db)
+	case args[0] == "set-role" && len(args) >= 3:
+		err = setRoleCommand(db, args[1], args[2], strings.Join(args[3:], " "))
+	case args[0] == "keys" && len(args) > 1 && args[1] == "status":
+		err = keysStatusCommand(db)
+	case args[0] == "keys" && len(args) > 1 && args[1] == "rotate":
+		err = keysRotateCommand(db, args[2:])
+	case args[0] == "keys" && len(args) > 1 && args[1] == "reencrypt":
+		err = keysReencryptCommand(db)
+	case args[0] == "retention" && len(args) > 1 && (args[1] == "report" || args[1] == "purge"):
+		err = retentionCommand(db, args[1] == "report")
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func auditListCommand(db *database.DB, args []string) error {
+	flags := flag.NewFlagSet("audit list", flag.ContinueOnError)
+	var filter models.AuditFilter
+	flags.StringVar(&filter.ActorLogin, "actor", "", "only entries by this login")
+	flags.StringVar(&filter.Action, "action", "", "only entries with this action")
+	flags.StringVar(&filter.TargetType, "target-type", "", "only entries on this target type")
+	flags.StringVar(&filter.TargetID, "target-id", "", "only entries on this target ID")
+	limit := flags.Int("limit", 50, "number of entries to print")
+	asJSON := flags.Bool("json", false, "print entries as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	entries, _, err := db.ListAuditEntries(filter, models.PageRequest{Limit: *limit})
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tACTOR\tACTION\tTARGET\tDETAILS")
+	for _, entry := range entries {
+		target := entry.TargetType
+		if entry.TargetID != "" {
+			target += ":" + entry.TargetID
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", entry.ID, entry.CreatedAt.Format(time.RFC3339),
+			entry.ActorLogin, entry.Action, target, entry.Details)
+	}
+	return w.Flush()
+}
+
+func auditVerifyCommand(db *database.DB) int {
+	result, err := db.VerifyAuditChain()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to verify audit log:", err)
+		return 1
+	}
+
+	if !result.Valid {
+		fmt.Printf("Audit log is BROKEN: %s\n", result.Problem)
+		return 1
+	}
+
+	fmt.Printf("Audit log intact: %d entries checked\n", result.Checked)
+	if result.LastHash != "" {
+		fmt.Printf("Last hash: %s\n", result.LastHash)
+	}
+	return 0
+}
+
+func setRoleCommand(db *database.DB, login, role, reason string) error {
+	switch role {
+	case models.RoleStudent, models.RoleStaff, models.RoleAdmin:
+	default:
+		return fmt.Errorf("unknown role %q: expected student, staff or admin", role)
+	}
+
+	previous, sessionsEnded, err := db.SetUserRole(login, role)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user %s not found; they need to log in once first", login)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to change role: %w", err)
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"from": previous, "to": role, "reason": reason, "sessions_revoked": sessionsEnded,
+	})
+	entry := &models.AuditEntry{
+		ActorLogin: "cli",
+		Action:     models.AuditRoleChange,
+		TargetType: "user",
+		TargetID:   login,
+		Details:    details,
+	}
+	if err := db.AppendAuditEntry(entry); err != nil {
+		return fmt.Errorf("role changed but the audit entry failed: %w", err)
+	}
+
+	fmt.Printf("%s: %s -> %s\n", login, previous, role)
+	if sessionsEnded > 0 {
+		fmt.Printf("ended %d sessions\n", sessionsEnded)
+	}
+	return nil
+}
+
+func keysStatusCommand(db *database.DB) error {
+	keys, err := db.LoadDataKeys()
+	if err != nil {
+		return fmt.Errorf("failed to read data keys: %w", err)
+	}
+	if len(keys) == 0 {
+		fmt.Println("Field encryption is off: ENCRYPTION_KEY is not set")
+		return nil
+	}
+
+	counts, err := db.FieldKeyUsage()
+	if err != nil {
+		return fmt.Errorf("failed to count encrypted fields: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPURPOSE\tACTIVE\tMASTER KEY\tCREATED\tFIELDS")
+	for _, k := range keys {
+		fields := "-"
+		if k.Purpose == encryption.PurposeData {
+			fields = fmt.Sprint(counts[k.ID])
+		}
+		fmt.Fprintf(w, "%d\t%s\t%t\t%s\t%s\t%s\n", k.ID, k.Purpose, k.Active, k.MasterKeyID,
+			k.CreatedAt.Format(time.RFC3339), fields)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if counts[0] > 0 {
+		fmt.Printf("%d fields are stored in plaintext\n", counts[0])
+	}
+	return nil
+}
+
+func keysRotateCommand(db *database.DB, args []string) error {
+	flags := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	reencrypt := flags.Bool("reencrypt", false, "re-encrypt existing fields with the new key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := db.RotateDataKey()
+	if err != nil {
+		return fmt.Errorf("failed to rotate data key: %w", err)
+	}
+	fmt.Printf("Data key %d is now active\n", id)
+
+	if *reencrypt {
+		return keysReencryptCommand(db)
+	}
+	return nil
+}
+
+func keysReencryptCommand(db *database.DB) error {
+	count, err := db.ReencryptFields()
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt fields after %d reports: %w", count, err)
+	}
+	fmt.Printf("Re-encrypted %d reports\n", count)
+	return nil
+}
+
+func retentionCommand(db *database.DB, dryRun bool) error {
+	cfg := jobs.ConfigFromEnv()
+	result, err := jobs.RetentionPurge(context.Background(), db, cfg.JobRetention, cfg.RetentionPolicies, dryRun)
+	if result != nil {
+		if !dryRun {
+			fmt.Printf("Removed %d expired sessions and %d finished jobs\n", result.ExpiredSessions, result.FinishedJobs)
+		}
+		if len(cfg.RetentionPolicies) == 0 {
+			fmt.Println("No retention policies configured (RETENTION_POLICIES)")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "POLICY\tCUTOFF\tMATCHED\tHELD\tAPPLIED\tIDS")
+		for _, o := range result.Policies {
+			ids := make([]string, len(o.IDs))
+			for i, id := range o.IDs {
+				ids[i] = fmt.Sprint(id)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", o.Policy, o.Cutoff.Format("2006-01-02"),
+				o.Matched, o.Held, o.Applied, strings.Join(ids, ","))
+		}
+		w.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("retention purge failed: %w", err)
+	}
+	return nil
+}
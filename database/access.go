@@ -0,0 +1,267 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"whistleblower/models"
+)
+
+// GetReport returns a single report.
+func (db *DB) GetReport(id int) (*models.Report, error) {
+	return db.scanReport(db.QueryRow(`SELECT `+reportColumns+` FROM reports r WHERE r.id = ?`, id))
+}
+
+// RecordReportAccess notes that userID read each of reportIDs.
+func (db *DB) RecordReportAccess(userID int, reportIDs []int, accessType, ip string) error {
+	if len(reportIDs) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO report_access_log (report_id, user_id, access_type, ip, accessed_at)
+		VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	for _, id := range reportIDs {
+		if _, err := stmt.Exec(id, userID, accessType, ip, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListReportAccess returns one page of a report's access log, newest first,
+// with the cursor of the next page.
+func (db *DB) ListReportAccess(reportID int, page models.PageRequest) ([]models.ReportAccess, string, error) {
+	query := `SELECT a.id, a.report_id, a.user_id, COALESCE(u.login, ''), a.access_type, a.ip, a.accessed_at
+		FROM report_access_log a LEFT JOIN users u ON u.id = a.user_id
+		WHERE a.report_id = ?`
+	args := []interface{}{reportID}
+
+	if page.Cursor != "" {
+		var lastID int
+		if err := decodeCursor(page.Cursor, "-id", &lastID); err != nil {
+			return nil, "", err
+		}
+		query += ` AND a.id < ?`
+		args = append(args, lastID)
+	}
+	query += ` ORDER BY a.id DESC LIMIT ?`
+
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	accesses := []models.ReportAccess{}
+	for rows.Next() {
+		var a models.ReportAccess
+		if err := rows.Scan(&a.ID, &a.ReportID, &a.UserID, &a.Login, &a.AccessType, &a.IP, &a.AccessedAt); err != nil {
+			return nil, "", err
+		}
+		accesses = append(accesses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	accesses, next := pageResult(accesses, page.Limit, "-id", func(last models.ReportAccess) []interface{} {
+		return []interface{}{last.ID}
+	})
+	return accesses, next, nil
+}
+
+// GetReportViewers sums up a report's access log per staff member, most
+// recent reader first.
+func (db *DB) GetReportViewers(reportID int) ([]models.ReportViewer, error) {
+	query := `SELECT a.user_id, COALESCE(u.login, ''), COALESCE(u.display_name, ''), COUNT(*),
+			GROUP_CONCAT(DISTINCT a.access_type), MIN(a.accessed_at), MAX(a.accessed_at)
+		FROM report_access_log a LEFT JOIN users u ON u.id = a.user_id
+		WHERE a.report_id = ?
+		GROUP BY a.user_id
+		ORDER BY MAX(a.id) DESC`
+
+	rows, err := db.Query(query, reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	viewers := []models.ReportViewer{}
+	for rows.Next() {
+		var v models.ReportViewer
+		var types, first, last string
+		if err := rows.Scan(&v.UserID, &v.Login, &v.DisplayName, &v.AccessCount, &types, &first, &last); err != nil {
+			return nil, err
+		}
+		// MIN and MAX hand back the stored text rather than a time.
+		v.FirstAccessed = parseStoredTime(first)
+		v.LastAccessed = parseStoredTime(last)
+		v.AccessTypes = strings.Split(types, ",")
+		viewers = append(viewers, v)
+	}
+
+	return viewers, rows.Err()
+}
+
+// parseStoredTime parses a time.Time the sqlite3 driver wrote as text.
+func parseStoredTime(value string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04:05.999999999-07:00", value)
+	if err != nil {
+		t, _ = time.Parse(time.RFC3339Nano, value)
+	}
+	return t
+}
+
+// CountReportsAccessedSince counts the distinct reports userID read after
+// since.
+func (db *DB) CountReportsAccessedSince(userID int, since time.Time) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(DISTINCT report_id) FROM report_access_log
+		WHERE user_id = ? AND accessed_at >= ?`, userID, since.UTC()).Scan(&count)
+	return count, err
+}
+
+const accessAlertColumns = `a.id, a.user_id, COALESCE(u.login, ''), a.report_count, a.window_start,
+	a.created_at, a.resolved_at, a.resolved_by`
+
+func scanAccessAlert(row scanner) (*models.AccessAlert, error) {
+	var alert models.AccessAlert
+	var resolvedAt sql.NullTime
+	var resolvedBy sql.NullInt64
+
+	err := row.Scan(&alert.ID, &alert.UserID, &alert.Login, &alert.ReportCount,
+		&alert.WindowStart, &alert.CreatedAt, &resolvedAt, &resolvedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if resolvedAt.Valid {
+		alert.ResolvedAt = &resolvedAt.Time
+	}
+	if resolvedBy.Valid {
+		id := int(resolvedBy.Int64)
+		alert.ResolvedBy = &id
+	}
+	return &alert, nil
+}
+
+// RaiseAccessAlert records an alert for userID unless one was already raised
+// for it inside the same window, and reports whether a new alert was created.
+func (db *DB) RaiseAccessAlert(userID, reportCount int, windowStart time.Time) (*models.AccessAlert, bool, error) {
+	now := time.Now().UTC()
+	result, err := db.Exec(`INSERT INTO access_alerts (user_id, report_count, window_start, created_at)
+		SELECT ?, ?, ?, ? WHERE NOT EXISTS (
+			SELECT 1 FROM access_alerts WHERE user_id = ? AND created_at >= ?)`,
+		userID, reportCount, windowStart.UTC(), now, userID, windowStart.UTC())
+	if err != nil {
+		return nil, false, err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, false, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, false, err
+	}
+
+	alert, err := scanAccessAlert(db.QueryRow(`SELECT `+accessAlertColumns+`
+		FROM access_alerts a LEFT JOIN users u ON u.id = a.user_id WHERE a.id = ?`, id))
+	if err != nil {
+		return nil, false, err
+	}
+	return alert, true, nil
+}
+
+// ListAccessAlerts returns one page of access alerts, newest first, only
+// unresolved ones unless all is set.
+func (db *DB) ListAccessAlerts(all bool, page models.PageRequest) ([]models.AccessAlert, string, error) {
+	query := `SELECT ` + accessAlertColumns + `
+		FROM access_alerts a LEFT JOIN users u ON u.id = a.user_id
+		WHERE (? OR a.resolved_at IS NULL)`
+	args := []interface{}{all}
+
+	if page.Cursor != "" {
+		var lastID int
+		if err := decodeCursor(page.Cursor, "-id", &lastID); err != nil {
+			return nil, "", err
+		}
+		query += ` AND a.id < ?`
+		args = append(args, lastID)
+	}
+	query += ` ORDER BY a.id DESC LIMIT ?`
+
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	alerts := []models.AccessAlert{}
+	for rows.Next() {
+		alert, err := scanAccessAlert(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		alerts = append(alerts, *alert)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	alerts, next := pageResult(alerts, page.Limit, "-id", func(last models.AccessAlert) []interface{} {
+		return []interface{}{last.ID}
+	})
+	return alerts, next, nil
+}
+
+// GetUnresolvedAccessAlertsSince returns unresolved access alerts raised
+// after since, newest first.
+func (db *DB) GetUnresolvedAccessAlertsSince(since time.Time) ([]models.AccessAlert, error) {
+	rows, err := db.Query(`SELECT `+accessAlertColumns+`
+		FROM access_alerts a LEFT JOIN users u ON u.id = a.user_id
+		WHERE a.resolved_at IS NULL AND a.created_at >= ?
+		ORDER BY a.id DESC`, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []models.AccessAlert
+	for rows.Next() {
+		alert, err := scanAccessAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, *alert)
+	}
+
+	return alerts, rows.Err()
+}
+
+// ResolveAccessAlert marks an unresolved alert as handled by userID.
+func (db *DB) ResolveAccessAlert(id, userID int) (bool, error) {
+	result, err := db.Exec(`UPDATE access_alerts SET resolved_at = ?, resolved_by = ?
+		WHERE id = ? AND resolved_at IS NULL`, time.Now().UTC(), userID, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
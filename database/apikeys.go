@@ -0,0 +1,121 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"whistleblower/models"
+)
+
+const apiKeyColumns = `k.id, k.name, k.key_prefix, k.key_hash, k.user_id, COALESCE(u.login, ''), k.scopes,
+	k.rate_limit, k.created_by, k.created_at, k.expires_at, k.last_used_at, k.last_used_ip, k.revoked_at`
+
+const apiKeyFrom = ` FROM api_keys k LEFT JOIN users u ON u.id = k.user_id`
+
+func scanAPIKey(row scanner) (*models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	var lastUsed, revoked sql.NullTime
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.KeyHash, &key.UserID, &key.Login, &scopes,
+		&key.RateLimit, &key.CreatedBy, &key.CreatedAt, &key.ExpiresAt, &lastUsed, &key.LastUsedIP, &revoked)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+	return &key, nil
+}
+
+func (db *DB) CreateAPIKey(key *models.APIKey) error {
+	key.CreatedAt = time.Now().UTC()
+	result, err := db.Exec(`INSERT INTO api_keys (name, key_prefix, key_hash, user_id, scopes, rate_limit,
+		created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.Name, key.Prefix, key.KeyHash, key.UserID, strings.Join(key.Scopes, ","), key.RateLimit,
+		key.CreatedBy, key.CreatedAt, key.ExpiresAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	key.ID = int(id)
+	return nil
+}
+
+// GetAPIKeyByHash returns the key with the given hash, or sql.ErrNoRows if
+// there is none or it was revoked or has expired.
+func (db *DB) GetAPIKeyByHash(keyHash string) (*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + apiKeyFrom + `
+		WHERE k.key_hash = ? AND k.revoked_at IS NULL AND k.expires_at > ?`
+	return scanAPIKey(db.QueryRow(query, keyHash, time.Now().UTC()))
+}
+
+// ListAPIKeys returns one page of usable API keys, or of all of them with
+// all set, newest first.
+func (db *DB) ListAPIKeys(all bool, page models.PageRequest) ([]models.APIKey, string, error) {
+	query := `SELECT ` + apiKeyColumns + apiKeyFrom + `
+		WHERE (? OR (k.revoked_at IS NULL AND k.expires_at > ?))`
+	args := []interface{}{all, time.Now().UTC()}
+
+	if page.Cursor != "" {
+		var lastID int
+		if err := decodeCursor(page.Cursor, "-id", &lastID); err != nil {
+			return nil, "", err
+		}
+		query += ` AND k.id < ?`
+		args = append(args, lastID)
+	}
+	query += ` ORDER BY k.id DESC LIMIT ?`
+
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	keys, next := pageResult(keys, page.Limit, "-id", func(last models.APIKey) []interface{} {
+		return []interface{}{last.ID}
+	})
+	return keys, next, nil
+}
+
+// RevokeAPIKey revokes a key. It reports false when there is no unrevoked
+// key with that ID.
+func (db *DB) RevokeAPIKey(id int) (bool, error) {
+	result, err := db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := rowsAffected(result)
+	return n > 0, err
+}
+
+// TouchAPIKey records that a key was used just now, from ip.
+func (db *DB) TouchAPIKey(id int, ip string) error {
+	_, err := db.Exec(`UPDATE api_keys SET last_used_at = ?, last_used_ip = ? WHERE id = ?`,
+		time.Now().UTC(), ip, id)
+	return err
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"whistleblower/models"
+)
+
+// auditGenesisHash is the prev_hash of the first audit entry.
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+const auditColumns = `id, created_at, actor_id, actor_login, action, target_type, target_id, details, ip, prev_hash, hash`
+
+func scanAuditEntry(row scanner) (*models.AuditEntry, string, error) {
+	var entry models.AuditEntry
+	var createdAt string
+	var actorID sql.NullInt64
+	var details sql.NullString
+
+	err := row.Scan(&entry.ID, &createdAt, &actorID, &entry.ActorLogin, &entry.Action,
+		&entry.TargetType, &entry.TargetID, &details, &entry.IP, &entry.PrevHash, &entry.Hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	entry.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+	if actorID.Valid {
+		id := int(actorID.Int64)
+		entry.ActorID = &id
+	}
+	if details.Valid {
+		entry.Details = json.RawMessage(details.String)
+	}
+
+	return &entry, createdAt, nil
+}
+
+// auditHash hashes an entry together with the hash of the entry before it.
+// created_at is passed as stored so verification never depends on how the
+// timestamp round-trips through time.Time.
+func auditHash(entry *models.AuditEntry, createdAt string) string {
+	var actorID interface{}
+	if entry.ActorID != nil {
+		actorID = *entry.ActorID
+	}
+
+	// Field order is fixed by the array, so the encoding is canonical.
+	payload, _ := json.Marshal([]interface{}{
+		entry.ID, createdAt, actorID, entry.ActorLogin, entry.Action,
+		entry.TargetType, entry.TargetID, string(entry.Details), entry.IP,
+	})
+
+	sum := sha256.Sum256(append([]byte(entry.PrevHash+"\n"), payload...))
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendAuditEntry adds entry to the end of the audit log, filling in its ID,
+// timestamp and hashes.
+func (db *DB) AppendAuditEntry(entry *models.AuditEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The transaction takes the write lock up front (_txlock=immediate), so
+	// no other entry can be appended between reading the tail and inserting.
+	var lastID int
+	prevHash := auditGenesisHash
+	err = tx.QueryRow(`SELECT id, hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&lastID, &prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	entry.ID = lastID + 1
+	entry.CreatedAt = time.Now().UTC()
+	entry.PrevHash = prevHash
+	createdAt := entry.CreatedAt.Format(time.RFC3339Nano)
+	entry.Hash = auditHash(entry, createdAt)
+
+	var actorID, details interface{}
+	if entry.ActorID != nil {
+		actorID = *entry.ActorID
+	}
+	if len(entry.Details) > 0 {
+		details = string(entry.Details)
+	}
+
+	_, err = tx.Exec(`INSERT INTO audit_log (`+auditColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.ID, createdAt, actorID, entry.ActorLogin, entry.Action, entry.TargetType,
+		entry.TargetID, details, entry.IP, entry.PrevHash, entry.Hash)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ListAuditEntries returns one page of audit entries, newest first, with
+// the cursor of the next page.
+func (db *DB) ListAuditEntries(filter models.AuditFilter, page models.PageRequest) ([]models.AuditEntry, string, error) {
+	query := `SELECT ` + auditColumns + ` FROM audit_log
+		WHERE (? = '' OR actor_login = ?) AND (? = '' OR action = ?)
+		AND (? = '' OR target_type = ?) AND (? = '' OR target_id = ?)`
+	args := []interface{}{
+		filter.ActorLogin, filter.ActorLogin, filter.Action, filter.Action,
+		filter.TargetType, filter.TargetType, filter.TargetID, filter.TargetID,
+	}
+
+	if page.Cursor != "" {
+		var lastID int
+		if err := decodeCursor(page.Cursor, "-id", &lastID); err != nil {
+			return nil, "", err
+		}
+		query += ` AND id < ?`
+		args = append(args, lastID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		entry, _, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, *entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	entries, next := pageResult(entries, page.Limit, "-id", func(last models.AuditEntry) []interface{} {
+		return []interface{}{last.ID}
+	})
+	return entries, next, nil
+}
+
+// VerifyAuditChain walks the whole audit log in order and checks that every
+// entry links to the one before it and still matches its hash. Truncating
+// the tail of the log cannot be detected from the log alone, so the result
+// carries the last hash for comparison with an earlier run.
+func (db *DB) VerifyAuditChain() (*models.AuditVerification, error) {
+	rows, err := db.Query(`SELECT ` + auditColumns + ` FROM audit_log ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &models.AuditVerification{Valid: true}
+	prevHash := auditGenesisHash
+	for rows.Next() {
+		entry, createdAt, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		result.Checked++
+
+		switch {
+		case entry.PrevHash != prevHash:
+			result.Problem = fmt.Sprintf("entry %d does not link to the entry before it", entry.ID)
+		case auditHash(entry, createdAt) != entry.Hash:
+			result.Problem = fmt.Sprintf("entry %d does not match its hash", entry.ID)
+		}
+		if result.Problem != "" {
+			result.Valid = false
+			result.BrokenAt = entry.ID
+			return result, nil
+		}
+
+		prevHash = entry.Hash
+		result.LastHash = entry.Hash
+	}
+
+	return result, rows.Err()
+}
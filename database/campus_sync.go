@@ -0,0 +1,158 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"whistleblower/models"
+)
+
+// GetCampusSyncState returns the sync bookkeeping for a campus. A campus
+// that was never synced gets an empty state.
+func (db *DB) GetCampusSyncState(campusID int) (*models.CampusSyncState, error) {
+	query := `SELECT campus_id, last_full_sync_at, last_synced_at FROM campus_syncs WHERE campus_id = ?`
+
+	state := &models.CampusSyncState{CampusID: campusID}
+	var lastFull, lastSynced sql.NullTime
+	err := db.QueryRow(query, campusID).Scan(&state.CampusID, &lastFull, &lastSynced)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if lastFull.Valid {
+		state.LastFullSyncAt = &lastFull.Time
+	}
+	if lastSynced.Valid {
+		state.LastSyncedAt = &lastSynced.Time
+	}
+	return state, nil
+}
+
+func (db *DB) SaveCampusSyncState(state *models.CampusSyncState) error {
+	query := `INSERT INTO campus_syncs (campus_id, last_full_sync_at, last_synced_at) VALUES (?, ?, ?)
+		ON CONFLICT(campus_id) DO UPDATE SET
+			last_full_sync_at = excluded.last_full_sync_at,
+			last_synced_at = excluded.last_synced_at`
+
+	_, err := db.Exec(query, state.CampusID, nullTime(state.LastFullSyncAt), nullTime(state.LastSyncedAt))
+	return err
+}
+
+// UpsertCampusUsers applies one page of intra users to the users table. Rows
+// are matched on intra ID, then login, and only rewritten when a synced field
+// differs, so IDs and local roles such as is_staff survive every sync. All
+// users in the page are stamped with seenAt for later deactivation. Erased
+// users are skipped.
+func (db *DB) UpsertCampusUsers(campusID int, users []models.Auth42User, seenAt time.Time) (*models.SyncSummary, error) {
+	summary := &models.SyncSummary{CampusID: campusID}
+	seenAt = seenAt.UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, u := range users {
+		erased, err := db.isErased(tx, u.Login)
+		if err != nil {
+			return nil, err
+		}
+		if erased {
+			summary.Skipped++
+			continue
+		}
+
+		active := u.Active == nil || *u.Active
+
+		var (
+			id          int
+			intraID     sql.NullInt64
+			login       string
+			email       string
+			displayName string
+			userCampus  sql.NullInt64
+			isActive    sql.NullBool
+		)
+		err = tx.QueryRow(`SELECT id, intra_id, login, email, display_name, campus_id, is_active
+			FROM users WHERE intra_id = ? OR login = ? ORDER BY intra_id = ? DESC LIMIT 1`,
+			u.ID, u.Login, u.ID).Scan(&id, &intraID, &login, &email, &displayName, &userCampus, &isActive)
+
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec(`INSERT INTO users (login, email, display_name, is_staff, intra_id, campus_id, is_active, updated_at, last_seen_at)
+				VALUES (?, ?, ?, FALSE, ?, ?, ?, ?, ?)`,
+				u.Login, u.Email, u.DisplayName, u.ID, campusID, active, seenAt, seenAt)
+			if err != nil {
+				return nil, err
+			}
+			summary.Created++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		wasActive := !isActive.Valid || isActive.Bool
+		changed := int(intraID.Int64) != u.ID ||
+			login != u.Login ||
+			email != u.Email ||
+			displayName != u.DisplayName ||
+			int(userCampus.Int64) != campusID ||
+			wasActive != active
+
+		if !changed {
+			if _, err := tx.Exec(`UPDATE users SET last_seen_at = ? WHERE id = ?`, seenAt, id); err != nil {
+				return nil, err
+			}
+			summary.Unchanged++
+			continue
+		}
+
+		_, err = tx.Exec(`UPDATE users SET intra_id = ?, login = ?, email = ?, display_name = ?, campus_id = ?,
+			is_active = ?, updated_at = ?, last_seen_at = ? WHERE id = ?`,
+			u.ID, u.Login, u.Email, u.DisplayName, campusID, active, seenAt, seenAt, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if wasActive && !active {
+			summary.Deactivated++
+		} else {
+			summary.Updated++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// DeactivateUnseenCampusUsers marks active users of a campus inactive when a
+// full sync that started at syncStartedAt did not see them.
+func (db *DB) DeactivateUnseenCampusUsers(campusID int, syncStartedAt time.Time) (int, error) {
+	query := `UPDATE users SET is_active = FALSE, updated_at = ?
+		WHERE campus_id = ? AND is_active = TRUE
+		AND (last_seen_at IS NULL OR last_seen_at < ?)`
+
+	result, err := db.Exec(query, time.Now().UTC(), campusID, syncStartedAt.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
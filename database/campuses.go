@@ -0,0 +1,133 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"whistleblower/models"
+)
+
+// UpsertCampuses writes campuses into the directory, replacing the stored
+// details of campuses that already exist.
+func (db *DB) UpsertCampuses(campuses []models.Campus) error {
+	query := `INSERT INTO campuses (id, name, city, country, time_zone, active, public, users_count, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			name = excluded.name,
+			city = excluded.city,
+			country = excluded.country,
+			time_zone = excluded.time_zone,
+			active = excluded.active,
+			public = excluded.public,
+			users_count = excluded.users_count,
+			updated_at = excluded.updated_at`
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	for _, c := range campuses {
+		_, err := stmt.Exec(c.ID, c.Name, c.City, c.Country, c.TimeZone, c.Active, c.Public, c.UsersCount, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) GetCampusCount() (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM campuses`).Scan(&count)
+	return count, err
+}
+
+// SearchCampuses returns one page of directory entries whose name, city or
+// country contains query, ordered by name, with the cursor of the next page
+// and the total number of matches. Each campus carries the time of its last
+// user sync, if any.
+func (db *DB) SearchCampuses(query string, activeOnly bool, page models.PageRequest) ([]models.Campus, string, int, error) {
+	where := ` WHERE (? = '' OR c.name LIKE ? OR c.city LIKE ? OR c.country LIKE ?)
+		AND (? = FALSE OR c.active = TRUE)`
+	pattern := "%" + query + "%"
+	args := []interface{}{query, pattern, pattern, pattern, activeOnly}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM campuses c`+where, args...).Scan(&total); err != nil {
+		return nil, "", 0, err
+	}
+
+	if page.Cursor != "" {
+		var name string
+		var lastID int
+		if err := decodeCursor(page.Cursor, "name", &name, &lastID); err != nil {
+			return nil, "", 0, err
+		}
+		where += ` AND (c.name > ? OR (c.name = ? AND c.id > ?))`
+		args = append(args, name, name, lastID)
+	}
+
+	sqlQuery := `SELECT c.id, c.name, c.city, c.country, c.time_zone, c.active, c.public, c.users_count, s.last_synced_at
+		FROM campuses c
+		LEFT JOIN campus_syncs s ON s.campus_id = c.id` + where + `
+		ORDER BY c.name, c.id LIMIT ?`
+
+	rows, err := db.Query(sqlQuery, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer rows.Close()
+
+	campuses := []models.Campus{}
+	for rows.Next() {
+		var c models.Campus
+		var lastSynced sql.NullTime
+		err := rows.Scan(&c.ID, &c.Name, &c.City, &c.Country, &c.TimeZone, &c.Active, &c.Public,
+			&c.UsersCount, &lastSynced)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		if lastSynced.Valid {
+			c.LastSyncedAt = &lastSynced.Time
+		}
+		campuses = append(campuses, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", 0, err
+	}
+
+	campuses, next := pageResult(campuses, page.Limit, "name", func(last models.Campus) []interface{} {
+		return []interface{}{last.Name, last.ID}
+	})
+	return campuses, next, total, nil
+}
+
+// GetActiveCampusIDs returns the IDs of every active campus in the
+// directory.
+func (db *DB) GetActiveCampusIDs() ([]int, error) {
+	rows, err := db.Query(`SELECT id FROM campuses WHERE active = TRUE ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
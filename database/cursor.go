@@ -0,0 +1,63 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrInvalidCursor is returned for a cursor that does not decode or was
+// produced for a different sort. Cursors are not signed, so their keys are
+// not checked: a forged cursor only moves where a page starts, within the
+// same filtered query.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursor is the keyset position after the last row of a page: the values of
+// the sort columns of that row. Clients only ever see it base64 encoded and
+// hand it back unchanged. Sort names the listing and order the keys belong
+// to, so a cursor can't be replayed against a different order.
+type cursor struct {
+	Sort string            `json:"s"`
+	Keys []json.RawMessage `json:"k"`
+}
+
+func encodeCursor(sort string, keys ...interface{}) string {
+	c := cursor{Sort: sort}
+	for _, key := range keys {
+		data, _ := json.Marshal(key)
+		c.Keys = append(c.Keys, data)
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a cursor produced by encodeCursor for the same sort
+// into keys, which must be pointers matching the encoded values.
+func decodeCursor(encoded, sort string, keys ...interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Sort != sort || len(c.Keys) != len(keys) {
+		return ErrInvalidCursor
+	}
+	for i, key := range keys {
+		if err := json.Unmarshal(c.Keys[i], key); err != nil {
+			return ErrInvalidCursor
+		}
+	}
+
+	return nil
+}
+
+// pageResult trims the extra row fetched to detect a following page and
+// returns the cursor for that page, or "" if this is the last one.
+func pageResult[T any](items []T, limit int, sort string, keys func(last T) []interface{}) ([]T, string) {
+	if len(items) <= limit {
+		return items, ""
+	}
+	items = items[:limit]
+	return items, encodeCursor(sort, keys(items[len(items)-1])...)
+}
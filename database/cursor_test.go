@@ -0,0 +1,45 @@
+package database
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	valid := encodeCursor("-created_at", "2024-05-01T10:00:00Z", 42)
+
+	tests := []struct {
+		name    string
+		cursor  string
+		sort    string
+		wantErr bool
+	}{
+		{"valid", valid, "-created_at", false},
+		{"other sort", valid, "created_at", true},
+		{"not base64", "not a cursor!", "-created_at", true},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("{")), "-created_at", true},
+		{"too few keys", encodeCursor("-created_at", "2024-05-01T10:00:00Z"), "-created_at", true},
+		{"too many keys", encodeCursor("-created_at", "2024-05-01T10:00:00Z", 42, 7), "-created_at", true},
+		{"wrong key type", encodeCursor("-created_at", "2024-05-01T10:00:00Z", "42"), "-created_at", true},
+		{"empty", "", "-created_at", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var createdAt string
+			var id int
+			err := decodeCursor(tt.cursor, tt.sort, &createdAt, &id)
+			if tt.wantErr {
+				if err != ErrInvalidCursor {
+					t.Fatalf("decodeCursor(%q) = %v, want ErrInvalidCursor", tt.cursor, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeCursor(%q) = %v", tt.cursor, err)
+			}
+			if createdAt != "2024-05-01T10:00:00Z" || id != 42 {
+				t.Errorf("decodeCursor(%q) keys = %q, %d", tt.cursor, createdAt, id)
+			}
+		})
+	}
+}
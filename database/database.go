@@ -6,17 +6,37 @@ import (
 	"io/ioutil"
 	"log"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
+	"whistleblower/encryption"
 	"whistleblower/models"
 )
 
 type DB struct {
 	*sql.DB
+
+	// fts is set when the SQLite build supports FTS5 and the search
+	// indexes are maintained.
+	fts bool
+
+	// fields encrypts sensitive report fields; nil keeps them in
+	// plaintext. See EnableFieldEncryption.
+	fields *encryption.Keyring
 }
 
 func NewDatabase(dbPath string) (*DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// Background jobs write while requests are served, so wait for locks
+	// instead of failing with "database is locked". Transactions take the
+	// write lock up front: a deferred transaction that reads first cannot
+	// wait for the lock when it later writes and fails right away.
+	dsn := dbPath
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_busy_timeout=5000&_txlock=immediate"
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -25,7 +45,7 @@ func NewDatabase(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	database := &DB{db}
+	database := &DB{DB: db}
 	
 	if err := database.InitSchema(); err != nil {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
@@ -45,50 +65,75 @@ func (db *DB) InitSchema() error {
 		return fmt.Errorf("failed to execute schema: %w", err)
 	}
 
+	if err := db.migrate(); err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
+	if err := db.initSearch(); err != nil {
+		return fmt.Errorf("failed to set up search: %w", err)
+	}
+
 	log.Println("Database schema initialized successfully")
 	return nil
 }
 
+// CreateUser inserts the user or, when the login already exists, updates it
+// in place so its ID and foreign keys pointing at it stay valid.
 func (db *DB) CreateUser(user *models.User) error {
-	query := `INSERT OR REPLACE INTO users (login, email, display_name, is_staff) 
-			  VALUES (?, ?, ?, ?)`
-	
-	result, err := db.Exec(query, user.Login, user.Email, user.DisplayName, user.IsStaff)
+	query := `INSERT INTO users (login, email, display_name, is_staff, intra_id, is_active, updated_at)
+			  VALUES (?, ?, ?, ?, ?, TRUE, CURRENT_TIMESTAMP)
+			  ON CONFLICT(login) DO UPDATE SET
+			  	email = excluded.email,
+			  	display_name = excluded.display_name,
+			  	is_staff = excluded.is_staff,
+			  	intra_id = COALESCE(excluded.intra_id, users.intra_id),
+			  	is_active = TRUE,
+			  	updated_at = CURRENT_TIMESTAMP`
+
+	_, err := db.Exec(query, user.Login, user.Email, user.DisplayName, user.IsStaff, nullInt(user.IntraID))
 	if err != nil {
 		return err
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
+	// LastInsertId is not reliable when the upsert took the UPDATE path
+	if err := db.QueryRow(`SELECT id FROM users WHERE login = ?`, user.Login).Scan(&user.ID); err != nil {
 		return err
 	}
 
-	user.ID = int(id)
-	return nil
+	// Signing in again after an erasure makes the user a user again, kept
+	// up to date by campus syncs.
+	return db.ClearErased(user.Login)
 }
 
 func (db *DB) GetUserByLogin(login string) (*models.User, error) {
-	query := `SELECT id, login, email, display_name, is_staff, created_at FROM users WHERE login = ?`
-	
-	var user models.User
-	err := db.QueryRow(query, login).Scan(
-		&user.ID, &user.Login, &user.Email, 
-		&user.DisplayName, &user.IsStaff, &user.CreatedAt,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE login = ?`
 	
-	if err != nil {
-		return nil, err
-	}
-	
-	return &user, nil
+	return scanUser(db.QueryRow(query, login))
 }
 
+// CreateReport stores a report, encrypting the explanation and the link to
+// the reporter.
 func (db *DB) CreateReport(report *models.Report) error {
-	query := `INSERT INTO reports (reporter_id, reported_student_login, project_name, reason, explanation) 
-			  VALUES (?, ?, ?, ?, ?)`
-	
-	result, err := db.Exec(query, report.ReporterID, report.ReportedStudentLogin, 
-		report.ProjectName, report.Reason, report.Explanation)
+	explanation, err := db.sealField(fieldExplanation, report.Explanation)
+	if err != nil {
+		return err
+	}
+	reporter, err := db.sealField(fieldReporter, strconv.Itoa(report.ReporterID))
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO reports (reporter_ref, reporter_index, reported_student_login, project_name, reason, explanation)
+			  VALUES (?, ?, ?, ?, ?, ?)`
+
+	result, err := tx.Exec(query, reporter, db.reporterIndex(report.ReporterID), report.ReportedStudentLogin,
+		report.ProjectName, report.Reason, explanation)
 	if err != nil {
 		return err
 	}
@@ -98,6 +143,13 @@ func (db *DB) CreateReport(report *models.Report) error {
 		return err
 	}
 
+	if err := db.writeSearchTerms(tx, int(id), report.Explanation); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
 	report.ID = int(id)
 	return nil
 }
@@ -110,43 +162,32 @@ func (db *DB) GetReportCountForProject(studentLogin, projectName string) (int, e
 	return count, err
 }
 
-func (db *DB) GetPendingReports() ([]models.Report, error) {
-	query := `SELECT id, reporter_id, reported_student_login, project_name, reason, explanation, status, created_at 
-			  FROM reports WHERE status = 'pending' ORDER BY created_at DESC`
-	
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var reports []models.Report
-	for rows.Next() {
-		var report models.Report
-		err := rows.Scan(&report.ID, &report.ReporterID, &report.ReportedStudentLogin,
-			&report.ProjectName, &report.Reason, &report.Explanation, 
-			&report.Status, &report.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		reports = append(reports, report)
-	}
-
-	return reports, nil
-}
-
 func (db *DB) UpdateReportStatus(reportID int, status string, reviewerID int) error {
 	query := `UPDATE reports SET status = ?, reviewed_by = ?, reviewed_at = CURRENT_TIMESTAMP WHERE id = ?`
 	_, err := db.Exec(query, status, reviewerID, reportID)
 	return err
 }
 
-func (db *DB) GetReportReasons() ([]models.ReportReason, error) {
-	query := `SELECT id, reason, description FROM report_reasons ORDER BY reason`
-	
-	rows, err := db.Query(query)
+// GetReportReasons returns one page of report reasons in alphabetical
+// order, the cursor of the next page and the total number of reasons.
+func (db *DB) GetReportReasons(page models.PageRequest) ([]models.ReportReason, string, int, error) {
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM report_reasons`).Scan(&total); err != nil {
+		return nil, "", 0, err
+	}
+
+	query := `SELECT id, reason, description FROM report_reasons WHERE reason > ? ORDER BY reason LIMIT ?`
+
+	var after string
+	if page.Cursor != "" {
+		if err := decodeCursor(page.Cursor, "reason", &after); err != nil {
+			return nil, "", 0, err
+		}
+	}
+
+	rows, err := db.Query(query, after, page.Limit+1)
 	if err != nil {
-		return nil, err
+		return nil, "", 0, err
 	}
 	defer rows.Close()
 
@@ -155,12 +196,18 @@ func (db *DB) GetReportReasons() ([]models.ReportReason, error) {
 		var reason models.ReportReason
 		err := rows.Scan(&reason.ID, &reason.Reason, &reason.Description)
 		if err != nil {
-			return nil, err
+			return nil, "", 0, err
 		}
 		reasons = append(reasons, reason)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, "", 0, err
+	}
 
-	return reasons, nil
+	reasons, next := pageResult(reasons, page.Limit, "reason", func(last models.ReportReason) []interface{} {
+		return []interface{}{last.Reason}
+	})
+	return reasons, next, total, nil
 }
 
 func (db *DB) CreateStaffNotification(notification *models.StaffNotification) error {
@@ -195,9 +242,9 @@ func (db *DB) UpdateUserReportStats(userID int) error {
 		COUNT(*) as total,
 		COUNT(CASE WHEN status = 'approved' THEN 1 END) as approved,
 		COUNT(CASE WHEN status = 'rejected' THEN 1 END) as rejected
-		FROM reports WHERE reporter_id = ? AND status != 'pending'`
+		FROM reports WHERE reporter_index = ? AND status != 'pending'`
 	
-	err = tx.QueryRow(query, userID).Scan(&totalReports, &approvedReports, &rejectedReports)
+	err = tx.QueryRow(query, db.reporterIndex(userID)).Scan(&totalReports, &approvedReports, &rejectedReports)
 	if err != nil {
 		return err
 	}
@@ -219,98 +266,119 @@ func (db *DB) UpdateUserReportStats(userID int) error {
 	return tx.Commit()
 }
 
-func (db *DB) BulkCreateUsers(users []models.User) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO users (login, email, display_name, is_staff) VALUES (?, ?, ?, ?)`)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	for _, user := range users {
-		_, err := stmt.Exec(user.Login, user.Email, user.DisplayName, user.IsStaff)
-		if err != nil {
-			return err
-		}
-	}
-
-	return tx.Commit()
-}
-
 func (db *DB) GetUserCount() (int, error) {
 	var count int
 	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
 	return count, err
 }
 
-func (db *DB) GetAllUsers() ([]models.User, error) {
-	query := `SELECT id, login, email, display_name, is_staff, created_at FROM users ORDER BY login`
-	
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
+// ListUsers returns one page of users matching filter, ordered by login,
+// with the cursor of the next page and the total number of matches.
+func (db *DB) ListUsers(filter models.UserFilter, page models.PageRequest) ([]models.User, string, int, error) {
+	where := ` WHERE 1 = 1`
+	var args []interface{}
+
+	if filter.CampusID > 0 {
+		where += ` AND campus_id = ?`
+		args = append(args, filter.CampusID)
+	}
+	if filter.Active != nil {
+		where += ` AND COALESCE(is_active, TRUE) = ?`
+		args = append(args, *filter.Active)
+	}
+	if filter.Staff != nil {
+		where += ` AND COALESCE(is_staff, FALSE) = ?`
+		args = append(args, *filter.Staff)
 	}
-	defer rows.Close()
 
-	var users []models.User
-	for rows.Next() {
-		var user models.User
-		err := rows.Scan(&user.ID, &user.Login, &user.Email, &user.DisplayName, &user.IsStaff, &user.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, user)
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		return nil, "", 0, err
 	}
 
-	return users, nil
-}
+	if page.Cursor != "" {
+		var after string
+		if err := decodeCursor(page.Cursor, "login", &after); err != nil {
+			return nil, "", 0, err
+		}
+		where += ` AND login > ?`
+		args = append(args, after)
+	}
 
-func (db *DB) SearchUsers(query string) ([]models.StudentSearchResult, error) {
-	sqlQuery := `SELECT login, email, display_name FROM users 
-		WHERE login LIKE ? OR display_name LIKE ? OR email LIKE ? 
-		ORDER BY login LIMIT 20`
-	
-	searchPattern := "%" + query + "%"
-	rows, err := db.Query(sqlQuery, searchPattern, searchPattern, searchPattern)
+	query := `SELECT ` + userColumns + ` FROM users` + where + ` ORDER BY login LIMIT ?`
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
 	if err != nil {
-		return nil, err
+		return nil, "", 0, err
 	}
 	defer rows.Close()
 
-	var results []models.StudentSearchResult
+	var users []models.User
 	for rows.Next() {
-		var result models.StudentSearchResult
-		err := rows.Scan(&result.Login, &result.Email, &result.DisplayName)
+		user, err := scanUser(rows)
 		if err != nil {
-			return nil, err
+			return nil, "", 0, err
 		}
-		results = append(results, result)
+		users = append(users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", 0, err
 	}
 
-	return results, nil
+	users, next := pageResult(users, page.Limit, "login", func(last models.User) []interface{} {
+		return []interface{}{last.Login}
+	})
+	return users, next, total, nil
 }
 
-func (db *DB) GetMostReportedProjects() ([]models.ProjectStats, error) {
-	query := `SELECT 
+// GetMostReportedProjects returns one page of per-student project report
+// counts, most reported first, with the cursor of the next page and the
+// total number of matching student/project pairs.
+func (db *DB) GetMostReportedProjects(filter models.ProjectStatsFilter, page models.PageRequest) ([]models.ProjectStats, string, int, error) {
+	where := ` WHERE 1 = 1`
+	var args []interface{}
+
+	if filter.ProjectName != "" {
+		where += ` AND project_name = ? COLLATE NOCASE`
+		args = append(args, filter.ProjectName)
+	}
+	if filter.ReportedLogin != "" {
+		where += ` AND reported_student_login = ?`
+		args = append(args, filter.ReportedLogin)
+	}
+
+	stats := `SELECT 
 		project_name,
 		reported_student_login,
 		COUNT(*) as report_count,
 		COUNT(CASE WHEN status = 'approved' THEN 1 END) as approved_count,
 		COUNT(CASE WHEN status = 'rejected' THEN 1 END) as rejected_count,
 		COUNT(CASE WHEN status = 'pending' THEN 1 END) as pending_count
-		FROM reports 
+		FROM reports` + where + `
 		GROUP BY project_name, reported_student_login
-		ORDER BY COUNT(*) DESC, project_name ASC
-		LIMIT 50`
-	
-	rows, err := db.Query(query)
+		HAVING COUNT(*) >= ?`
+	args = append(args, filter.MinReports)
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM (`+stats+`)`, args...).Scan(&total); err != nil {
+		return nil, "", 0, err
+	}
+
+	query := `SELECT * FROM (` + stats + `)`
+	if page.Cursor != "" {
+		var count int
+		var project, login string
+		if err := decodeCursor(page.Cursor, "report_count", &count, &project, &login); err != nil {
+			return nil, "", 0, err
+		}
+		query += ` WHERE report_count < ? OR (report_count = ? AND (project_name > ?
+			OR (project_name = ? AND reported_student_login > ?)))`
+		args = append(args, count, count, project, project, login)
+	}
+	query += ` ORDER BY report_count DESC, project_name ASC, reported_student_login ASC LIMIT ?`
+
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
 	if err != nil {
-		return nil, err
+		return nil, "", 0, err
 	}
 	defer rows.Close()
 
@@ -320,12 +388,18 @@ func (db *DB) GetMostReportedProjects() ([]models.ProjectStats, error) {
 		err := rows.Scan(&result.ProjectName, &result.StudentLogin, &result.ReportCount, 
 			&result.ApprovedCount, &result.RejectedCount, &result.PendingCount)
 		if err != nil {
-			return nil, err
+			return nil, "", 0, err
 		}
 		results = append(results, result)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, "", 0, err
+	}
 
-	return results, nil
+	results, next := pageResult(results, page.Limit, "report_count", func(last models.ProjectStats) []interface{} {
+		return []interface{}{last.ReportCount, last.ProjectName, last.StudentLogin}
+	})
+	return results, next, total, nil
 }
 
 func (db *DB) BulkUpdateProjectReports(studentLogin, projectName, status string, reviewerID int) (int, error) {
@@ -0,0 +1,355 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"whistleblower/encryption"
+)
+
+// Encrypted report fields. The names are bound to the ciphertext, so a value
+// only decrypts in the column it was written to.
+const (
+	fieldExplanation = "reports.explanation"
+	fieldReporter    = "reports.reporter_ref"
+	fieldSearchTerm  = "reports.explanation.term"
+)
+
+// maxPrefixRunes bounds the prefixes indexed per word; longer words are
+// still found by their full text.
+const maxPrefixRunes = 24
+
+// EnableFieldEncryption encrypts report explanations and reporter links
+// with data keys wrapped by master, and encrypts values that are still
+// stored in plaintext. Callers of the database keep reading and writing
+// plaintext.
+//
+// With an ephemeral master key fields stay in plaintext, since nothing
+// encrypted would be readable after a restart.
+func (db *DB) EnableFieldEncryption(master *encryption.Cipher) error {
+	if master.Ephemeral() {
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM data_keys`).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("the database holds encrypted fields, set ENCRYPTION_KEY or ENCRYPTION_KEY_FILE to read them")
+		}
+		log.Println("Warning: ENCRYPTION_KEY not set, report explanations and reporters are stored in plaintext")
+		return db.indexReports()
+	}
+
+	keyring, created, err := encryption.OpenKeyring(master, db)
+	if err != nil {
+		return err
+	}
+	db.fields = keyring
+
+	// Blind indexes computed before there was an index key have to be
+	// recomputed with it.
+	if created {
+		if _, err := db.Exec(`UPDATE reports SET reporter_index = ''`); err != nil {
+			return err
+		}
+	}
+
+	count, err := db.encryptFields(func(value string) bool {
+		_, sealed := encryption.SealedKeyID(value)
+		return !sealed
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt plaintext fields: %w", err)
+	}
+	if count > 0 {
+		log.Printf("Encrypted %d reports stored in plaintext", count)
+	}
+
+	return db.indexReports()
+}
+
+// RotateDataKey starts encrypting fields with a new data key and returns its
+// ID. Existing values keep their key until ReencryptFields is run.
+func (db *DB) RotateDataKey() (int, error) {
+	if db.fields == nil {
+		return 0, errors.New("field encryption is not enabled")
+	}
+	return db.fields.RotateDataKey()
+}
+
+// ReencryptFields re-encrypts every report field not sealed with the active
+// data key and returns the number of reports rewritten.
+func (db *DB) ReencryptFields() (int, error) {
+	if db.fields == nil {
+		return 0, errors.New("field encryption is not enabled")
+	}
+
+	active := db.fields.ActiveKeyID()
+	return db.encryptFields(func(value string) bool {
+		id, _ := encryption.SealedKeyID(value)
+		return id != active
+	})
+}
+
+// FieldKeyUsage counts encrypted report fields per data key ID. Key 0 counts
+// fields stored in plaintext.
+func (db *DB) FieldKeyUsage() (map[int]int, error) {
+	rows, err := db.Query(`SELECT explanation, reporter_ref FROM reports`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := map[int]int{}
+	for rows.Next() {
+		var explanation, reporter string
+		if err := rows.Scan(&explanation, &reporter); err != nil {
+			return nil, err
+		}
+		for _, value := range []string{explanation, reporter} {
+			id, _ := encryption.SealedKeyID(value)
+			usage[id]++
+		}
+	}
+
+	return usage, rows.Err()
+}
+
+// encryptFields rewrites, batch by batch, the reports whose explanation or
+// reporter link needs re-encrypting.
+func (db *DB) encryptFields(needs func(value string) bool) (int, error) {
+	count, lastID := 0, 0
+	for {
+		n, last, err := db.encryptFieldsBatch(lastID, needs)
+		if err != nil {
+			return count, err
+		}
+		if last == 0 {
+			return count, nil
+		}
+		count += n
+		lastID = last
+	}
+}
+
+func (db *DB) encryptFieldsBatch(afterID int, needs func(value string) bool) (int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, explanation, reporter_ref FROM reports WHERE id > ? ORDER BY id LIMIT 500`, afterID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type row struct {
+		id                    int
+		explanation, reporter string
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.explanation, &r.reporter); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+
+	count := 0
+	for _, r := range batch {
+		if !needs(r.explanation) && !needs(r.reporter) {
+			continue
+		}
+
+		explanation, err := db.reseal(fieldExplanation, r.explanation)
+		if err != nil {
+			return 0, 0, fmt.Errorf("report %d: %w", r.id, err)
+		}
+		reporter, err := db.reseal(fieldReporter, r.reporter)
+		if err != nil {
+			return 0, 0, fmt.Errorf("report %d: %w", r.id, err)
+		}
+
+		if _, err := tx.Exec(`UPDATE reports SET explanation = ?, reporter_ref = ? WHERE id = ?`,
+			explanation, reporter, r.id); err != nil {
+			return 0, 0, err
+		}
+		count++
+	}
+
+	return count, batch[len(batch)-1].id, tx.Commit()
+}
+
+// reseal decrypts value, if it is encrypted, and encrypts it again with the
+// active data key.
+func (db *DB) reseal(field, value string) (string, error) {
+	plaintext, err := db.openField(field, value)
+	if err != nil {
+		return "", err
+	}
+	return db.sealField(field, plaintext)
+}
+
+// indexReports computes the reporter blind index and the search terms of
+// reports that have none yet.
+func (db *DB) indexReports() error {
+	total := 0
+	for {
+		n, err := db.indexReportsBatch()
+		if err != nil {
+			return fmt.Errorf("failed to index reports: %w", err)
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+
+	if total > 0 {
+		log.Printf("Indexed %d reports for search", total)
+	}
+	return nil
+}
+
+func (db *DB) indexReportsBatch() (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, explanation, reporter_ref FROM reports WHERE reporter_index = '' LIMIT 500`)
+	if err != nil {
+		return 0, err
+	}
+
+	type row struct {
+		id                    int
+		explanation, reporter string
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.explanation, &r.reporter); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, r := range batch {
+		explanation, err := db.openField(fieldExplanation, r.explanation)
+		if err != nil {
+			return 0, fmt.Errorf("report %d: %w", r.id, err)
+		}
+		reporter, err := db.openField(fieldReporter, r.reporter)
+		if err != nil {
+			return 0, fmt.Errorf("report %d: %w", r.id, err)
+		}
+
+		if _, err := tx.Exec(`UPDATE reports SET reporter_index = ? WHERE id = ?`,
+			db.blindIndex(fieldReporter, reporter), r.id); err != nil {
+			return 0, err
+		}
+		if err := db.writeSearchTerms(tx, r.id, explanation); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(batch), tx.Commit()
+}
+
+// writeSearchTerms replaces the search terms of a report. Terms are blind
+// indexes of every word of the explanation and of the word's prefixes, so
+// explanations can be searched by word prefix without storing any of their
+// text in the clear.
+func (db *DB) writeSearchTerms(tx *sql.Tx, reportID int, explanation string) error {
+	if _, err := tx.Exec(`DELETE FROM report_search_terms WHERE report_id = ?`, reportID); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO report_search_terms (term, report_id) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	seen := map[string]bool{}
+	for _, word := range searchWords(explanation) {
+		runes := []rune(word)
+		for n := 1; n <= len(runes); n++ {
+			if n > maxPrefixRunes && n < len(runes) {
+				continue
+			}
+			prefix := string(runes[:n])
+			if seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+
+			if _, err := stmt.Exec(db.blindIndex(fieldSearchTerm, prefix), reportID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// searchWords splits text into lowercase words for the report search index.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// sealField encrypts value for field, or leaves it as is when field
+// encryption is off.
+func (db *DB) sealField(field, value string) (string, error) {
+	if db.fields == nil {
+		return value, nil
+	}
+	return db.fields.Encrypt(field, value)
+}
+
+// openField decrypts a value sealField wrote. Values stored before field
+// encryption was enabled are returned as they are.
+func (db *DB) openField(field, value string) (string, error) {
+	if _, sealed := encryption.SealedKeyID(value); !sealed {
+		return value, nil
+	}
+	if db.fields == nil {
+		return "", fmt.Errorf("%s is encrypted but field encryption is not enabled", field)
+	}
+	return db.fields.Decrypt(field, value)
+}
+
+// blindIndex hashes value for equality lookups on an encrypted field.
+func (db *DB) blindIndex(field, value string) string {
+	if db.fields == nil {
+		return encryption.BlindIndex(nil, field, value)
+	}
+	return db.fields.BlindIndex(field, value)
+}
+
+// reporterIndex is the blind index of a reporter's user ID.
+func (db *DB) reporterIndex(userID int) string {
+	return db.blindIndex(fieldReporter, strconv.Itoa(userID))
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"whistleblower/models"
+)
+
+// ErrIdentityConflict is returned when linking an account that belongs to
+// another user, or a second account at the same provider.
+var ErrIdentityConflict = errors.New("identity is linked to another user")
+
+// ErrLastIdentity is returned when unlinking would leave a user with no way
+// to log in.
+var ErrLastIdentity = errors.New("cannot unlink the only identity")
+
+const identityColumns = `id, user_id, provider, subject, email, created_at, last_login_at`
+
+func scanIdentity(row scanner) (*models.UserIdentity, error) {
+	var identity models.UserIdentity
+	var lastLogin sql.NullTime
+	err := row.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject,
+		&identity.Email, &identity.CreatedAt, &lastLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastLogin.Valid {
+		identity.LastLoginAt = &lastLogin.Time
+	}
+	return &identity, nil
+}
+
+// GetUserByIdentity returns the user linked to the account subject at
+// provider, or sql.ErrNoRows.
+func (db *DB) GetUserByIdentity(provider, subject string) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?)`
+	return scanUser(db.QueryRow(query, provider, subject))
+}
+
+// LinkIdentity records that the account subject at provider logs in as
+// userID, and that it just did. It returns ErrIdentityConflict when the
+// account is linked to another user, or the user already has another
+// account at provider.
+func (db *DB) LinkIdentity(userID int, provider, subject, email string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var linkedUser int
+	var linkedSubject string
+	err = tx.QueryRow(`SELECT user_id, subject FROM user_identities
+		WHERE provider = ? AND (subject = ? OR user_id = ?)`, provider, subject, userID).Scan(&linkedUser, &linkedSubject)
+	now := time.Now().UTC()
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`INSERT INTO user_identities (user_id, provider, subject, email, created_at, last_login_at)
+			VALUES (?, ?, ?, ?, ?, ?)`, userID, provider, subject, email, now, now)
+	case err != nil:
+		return err
+	case linkedUser != userID || linkedSubject != subject:
+		return ErrIdentityConflict
+	default:
+		_, err = tx.Exec(`UPDATE user_identities SET email = ?, last_login_at = ? WHERE provider = ? AND subject = ?`,
+			email, now, provider, subject)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListUserIdentities returns the identities a user can log in with, oldest
+// first.
+func (db *DB) ListUserIdentities(userID int) ([]models.UserIdentity, error) {
+	rows, err := db.Query(`SELECT `+identityColumns+` FROM user_identities WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []models.UserIdentity{}
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, *identity)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteIdentity unlinks one of userID's identities and returns it. It
+// returns sql.ErrNoRows if the user has no such identity, and
+// ErrLastIdentity if it is their only one.
+func (db *DB) DeleteIdentity(id, userID int) (*models.UserIdentity, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	identity, err := scanIdentity(tx.QueryRow(`SELECT `+identityColumns+` FROM user_identities
+		WHERE id = ? AND user_id = ?`, id, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM user_identities WHERE user_id = ?`, userID).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count <= 1 {
+		return nil, ErrLastIdentity
+	}
+
+	if _, err := tx.Exec(`DELETE FROM user_identities WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return identity, tx.Commit()
+}
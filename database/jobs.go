@@ -0,0 +1,341 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"whistleblower/models"
+)
+
+// ErrJobLocked is returned when a job cannot be queued because another job
+// with the same lock key is queued or running.
+var ErrJobLocked = errors.New("another job with the same lock key is queued or running")
+
+const jobColumns = `id, kind, params, lock_key, status, progress, result, error,
+	requested_by, cancel_requested, created_at, started_at, finished_at`
+
+func scanJob(row scanner) (*models.Job, error) {
+	var job models.Job
+	var params string
+	var progress, result, errMsg sql.NullString
+	var startedAt, finishedAt sql.NullTime
+
+	err := row.Scan(&job.ID, &job.Kind, &params, &job.LockKey, &job.Status,
+		&progress, &result, &errMsg, &job.RequestedBy, &job.CancelRequested,
+		&job.CreatedAt, &startedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Params = []byte(params)
+	if progress.Valid {
+		job.Progress = []byte(progress.String)
+	}
+	if result.Valid {
+		job.Result = []byte(result.String)
+	}
+	job.Error = errMsg.String
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+
+	return &job, nil
+}
+
+func (db *DB) CreateJob(job *models.Job) error {
+	query := `INSERT INTO jobs (kind, params, lock_key, status, requested_by, created_at) VALUES (?, ?, ?, 'queued', ?, ?)`
+
+	job.CreatedAt = time.Now().UTC()
+	result, err := db.Exec(query, job.Kind, string(job.Params), job.LockKey, job.RequestedBy, job.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	job.ID = int(id)
+	job.Status = "queued"
+	return nil
+}
+
+// CreateUniqueJob inserts job unless a queued or running job holds its lock
+// key, in which case that job is returned with created set to false. The
+// check and the insert are one statement, so concurrent callers cannot both
+// queue the job.
+func (db *DB) CreateUniqueJob(job *models.Job) (stored *models.Job, created bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	createdAt := time.Now().UTC()
+	var id int
+	err = tx.QueryRow(`INSERT INTO jobs (kind, params, lock_key, status, requested_by, created_at)
+		SELECT ?, ?, ?, 'queued', ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM jobs WHERE lock_key = ? AND status IN ('queued', 'running'))
+		RETURNING id`,
+		job.Kind, string(job.Params), job.LockKey, job.RequestedBy, createdAt, job.LockKey).Scan(&id)
+	if err == sql.ErrNoRows {
+		active, err := scanJob(tx.QueryRow(`SELECT `+jobColumns+` FROM jobs
+			WHERE lock_key = ? AND status IN ('queued', 'running') ORDER BY id LIMIT 1`, job.LockKey))
+		if err != nil {
+			return nil, false, err
+		}
+		return active, false, tx.Commit()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	job.ID = id
+	job.Status = "queued"
+	job.CreatedAt = createdAt
+	return job, true, nil
+}
+
+func (db *DB) GetJob(id int) (*models.Job, error) {
+	return scanJob(db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+}
+
+// ListJobs returns one page of jobs, newest first, optionally filtered by
+// status and kind, with the cursor of the next page.
+func (db *DB) ListJobs(status, kind string, page models.PageRequest) ([]models.Job, string, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs
+		WHERE (? = '' OR status = ?) AND (? = '' OR kind = ?)`
+	args := []interface{}{status, status, kind, kind}
+
+	if page.Cursor != "" {
+		var lastID int
+		if err := decodeCursor(page.Cursor, "-id", &lastID); err != nil {
+			return nil, "", err
+		}
+		query += ` AND id < ?`
+		args = append(args, lastID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	jobs := []models.Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		jobs = append(jobs, *job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	jobs, next := pageResult(jobs, page.Limit, "-id", func(last models.Job) []interface{} {
+		return []interface{}{last.ID}
+	})
+	return jobs, next, nil
+}
+
+// RequeueJob puts a failed or cancelled job back in the queue. Its progress
+// is kept so jobs that checkpoint can carry on where they stopped. It returns
+// sql.ErrNoRows when the job does not exist or is not in a retryable state,
+// and ErrJobLocked when another job with its lock key is queued or running.
+func (db *DB) RequeueJob(id int) (*models.Job, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM jobs a
+		WHERE a.lock_key = j.lock_key AND a.id != j.id AND a.status IN ('queued', 'running'))
+		FROM jobs j WHERE j.id = ? AND j.status IN ('failed', 'cancelled')`, id).Scan(&locked)
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		return nil, ErrJobLocked
+	}
+
+	job, err := scanJob(tx.QueryRow(`UPDATE jobs SET status = 'queued', error = NULL, result = NULL, finished_at = NULL,
+		cancel_requested = FALSE, owner = NULL
+		WHERE id = ?
+		RETURNING `+jobColumns, id))
+	if err != nil {
+		return nil, err
+	}
+	return job, tx.Commit()
+}
+
+// ClaimNextJob marks the oldest queued job as running for owner and returns
+// it, or sql.ErrNoRows when nothing can run. A job is skipped while another
+// job with the same lock key is running, which keeps e.g. two syncs of the
+// same campus from overlapping even across instances sharing the database.
+// Jobs of skipKinds are left for later.
+func (db *DB) ClaimNextJob(owner string, skipKinds []string) (*models.Job, error) {
+	now := time.Now().UTC()
+	args := []interface{}{owner, now, now}
+
+	skip := ""
+	if len(skipKinds) > 0 {
+		skip = "AND j.kind NOT IN (?" + strings.Repeat(", ?", len(skipKinds)-1) + ")"
+		for _, kind := range skipKinds {
+			args = append(args, kind)
+		}
+	}
+
+	query := `UPDATE jobs SET status = 'running', owner = ?, started_at = ?, heartbeat_at = ?
+		WHERE id = (
+			SELECT j.id FROM jobs j
+			WHERE j.status = 'queued' ` + skip + `
+			AND NOT EXISTS (SELECT 1 FROM jobs r WHERE r.status = 'running' AND r.lock_key = j.lock_key)
+			ORDER BY j.id LIMIT 1
+		)
+		RETURNING ` + jobColumns
+
+	return scanJob(db.QueryRow(query, args...))
+}
+
+// HeartbeatJob records that the job is still alive and reports whether a
+// cancel has been requested for it.
+func (db *DB) HeartbeatJob(id int) (bool, error) {
+	var cancelRequested bool
+	err := db.QueryRow(`UPDATE jobs SET heartbeat_at = ? WHERE id = ? RETURNING cancel_requested`,
+		time.Now().UTC(), id).Scan(&cancelRequested)
+	return cancelRequested, err
+}
+
+func (db *DB) UpdateJobProgress(id int, progress []byte) error {
+	_, err := db.Exec(`UPDATE jobs SET progress = ? WHERE id = ?`, string(progress), id)
+	return err
+}
+
+func (db *DB) FinishJob(id int, status string, result []byte, errMsg string) error {
+	query := `UPDATE jobs SET status = ?, result = ?, error = ?, finished_at = ?, owner = NULL WHERE id = ?`
+
+	var resultValue sql.NullString
+	if result != nil {
+		resultValue = sql.NullString{String: string(result), Valid: true}
+	}
+
+	_, err := db.Exec(query, status, resultValue, nullString(errMsg), time.Now().UTC(), id)
+	return err
+}
+
+// RequestJobCancel cancels a queued job outright and flags a running one so
+// its runner stops it at the next heartbeat. Finished jobs are left alone.
+func (db *DB) RequestJobCancel(id int) (*models.Job, error) {
+	_, err := db.Exec(`UPDATE jobs SET status = 'cancelled', finished_at = ? WHERE id = ? AND status = 'queued'`,
+		time.Now().UTC(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`UPDATE jobs SET cancel_requested = TRUE WHERE id = ? AND status = 'running'`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.GetJob(id)
+}
+
+// RequeueStaleJobs puts running jobs whose runner stopped heartbeating, for
+// example because the process crashed, back in the queue.
+func (db *DB) RequeueStaleJobs(heartbeatBefore time.Time) (int, error) {
+	result, err := db.Exec(`UPDATE jobs SET status = 'queued', owner = NULL
+		WHERE status = 'running' AND heartbeat_at < ?`, heartbeatBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return int(rowsAffected), err
+}
+
+// ClaimScheduleRun records that the schedule slot dueAt is being enqueued.
+// It returns false when another instance already claimed the slot.
+func (db *DB) ClaimScheduleRun(scheduleName string, dueAt time.Time) (bool, error) {
+	result, err := db.Exec(`INSERT OR IGNORE INTO job_schedule_runs (schedule_name, due_at) VALUES (?, ?)`,
+		scheduleName, dueAt.UTC())
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func (db *DB) SetScheduleRunJob(scheduleName string, dueAt time.Time, jobID int) error {
+	_, err := db.Exec(`UPDATE job_schedule_runs SET job_id = ? WHERE schedule_name = ? AND due_at = ?`,
+		jobID, scheduleName, dueAt.UTC())
+	return err
+}
+
+// DeleteFinishedJobsBefore removes finished jobs and schedule bookkeeping
+// older than before.
+func (db *DB) DeleteFinishedJobsBefore(before time.Time) (int, error) {
+	result, err := db.Exec(`DELETE FROM jobs WHERE status IN ('succeeded', 'failed', 'cancelled') AND finished_at < ?`,
+		before.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := db.Exec(`DELETE FROM job_schedule_runs WHERE due_at < ?`, before.UTC()); err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return int(rowsAffected), err
+}
+
+func (db *DB) DeleteExpiredSessions() (int, error) {
+	result, err := db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return int(rowsAffected), err
+}
+
+// GetUnresolvedNotificationsSince returns unresolved staff notifications
+// raised after since, newest first.
+func (db *DB) GetUnresolvedNotificationsSince(since time.Time) ([]models.StaffNotification, error) {
+	query := `SELECT id, reported_student_login, project_name, report_count, notification_sent_at, resolved
+		FROM staff_notifications WHERE resolved = FALSE AND notification_sent_at >= ?
+		ORDER BY notification_sent_at DESC`
+
+	rows, err := db.Query(query, since.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []models.StaffNotification
+	for rows.Next() {
+		var n models.StaffNotification
+		err := rows.Scan(&n.ID, &n.ReportedStudentLogin, &n.ProjectName, &n.ReportCount,
+			&n.NotificationSentAt, &n.Resolved)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"whistleblower/encryption"
+)
+
+// LoadDataKeys, AddDataKey and UpdateWrappedKeys make the database the
+// encryption.KeyStore of its own field encryption keyring.
+
+func (db *DB) LoadDataKeys() ([]encryption.WrappedKey, error) {
+	rows, err := db.Query(`SELECT id, purpose, wrapped_key, master_key_id, active, created_at
+		FROM data_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []encryption.WrappedKey
+	for rows.Next() {
+		var k encryption.WrappedKey
+		if err := rows.Scan(&k.ID, &k.Purpose, &k.Wrapped, &k.MasterKeyID, &k.Active, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (db *DB) AddDataKey(key *encryption.WrappedKey) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if key.Active {
+		if _, err := tx.Exec(`UPDATE data_keys SET active = FALSE WHERE purpose = ?`, key.Purpose); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec(`INSERT INTO data_keys (purpose, wrapped_key, master_key_id, active, created_at)
+		VALUES (?, ?, ?, ?, ?)`, key.Purpose, key.Wrapped, key.MasterKeyID, key.Active, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	key.ID = int(id)
+
+	return tx.Commit()
+}
+
+func (db *DB) UpdateWrappedKeys(keys []encryption.WrappedKey) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, k := range keys {
+		_, err := tx.Exec(`UPDATE data_keys SET wrapped_key = ?, master_key_id = ? WHERE id = ?`,
+			k.Wrapped, k.MasterKeyID, k.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
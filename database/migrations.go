@@ -0,0 +1,159 @@
+package database
+
+import (
+	"fmt"
+	"log"
+)
+
+// columnMigrations add columns introduced after the first release. schema.sql
+// only creates missing tables, so databases created before a column existed
+// get it here. Keep these in sync with the CREATE TABLE statements.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"users", "intra_id", "INTEGER NULL"},
+	{"users", "campus_id", "INTEGER NULL"},
+	{"users", "is_active", "BOOLEAN DEFAULT TRUE"},
+	{"users", "updated_at", "DATETIME NULL"},
+	{"users", "last_seen_at", "DATETIME NULL"},
+	{"users", "role", "TEXT NOT NULL DEFAULT 'student'"},
+	{"users", "erased_at", "DATETIME NULL"},
+	{"reports", "anonymized_at", "DATETIME NULL"},
+	{"sessions", "user_agent", "TEXT NOT NULL DEFAULT ''"},
+	{"sessions", "ip_address", "TEXT NOT NULL DEFAULT ''"},
+	{"sessions", "last_seen_at", "DATETIME NULL"},
+	{"sessions", "mfa_verified_at", "DATETIME NULL"},
+}
+
+// indexMigrations run after columnMigrations, since they may reference
+// columns that only exist once those have been applied.
+var indexMigrations = []string{
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_intra_id ON users(intra_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_users_campus_id ON users(campus_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_reports_reporter_index ON reports(reporter_index)`,
+	`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id)`,
+}
+
+// reportsTable is the reports table as created by schema.sql, under a
+// placeholder name. Keep it in sync with schema.sql.
+const reportsTable = `CREATE TABLE %s (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    reporter_ref TEXT NOT NULL,
+    reporter_index TEXT NOT NULL DEFAULT '',
+    reported_student_login TEXT NOT NULL,
+    project_name TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    explanation TEXT NOT NULL,
+    status TEXT DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    reviewed_at DATETIME NULL,
+    reviewed_by INTEGER NULL,
+    anonymized_at DATETIME NULL,
+    FOREIGN KEY (reviewed_by) REFERENCES users(id)
+)`
+
+func (db *DB) migrate() error {
+	if err := db.migrateReporterLink(); err != nil {
+		return fmt.Errorf("failed to migrate reports: %w", err)
+	}
+
+	for _, m := range columnMigrations {
+		exists, err := db.columnExists(m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", m.table, m.column, err)
+		}
+	}
+
+	for _, query := range indexMigrations {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+
+	// is_staff can still be flipped by hand (see set_admin.sh), so bring
+	// roles in line with it on every start.
+	_, err := db.Exec(`UPDATE users SET role = CASE WHEN is_staff THEN 'staff' ELSE 'student' END
+		WHERE (is_staff AND role = 'student') OR (NOT is_staff AND role != 'student')`)
+	if err != nil {
+		return fmt.Errorf("failed to align user roles: %w", err)
+	}
+
+	return nil
+}
+
+// migrateReporterLink moves the reporter's user ID out of the plaintext
+// reports.reporter_id column into reporter_ref, where EnableFieldEncryption
+// encrypts it. SQLite cannot drop a column that is part of a foreign key,
+// so the table is rebuilt.
+func (db *DB) migrateReporterLink() error {
+	exists, err := db.columnExists("reports", "reporter_id")
+	if err != nil || !exists {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		fmt.Sprintf(reportsTable, "reports_migrated"),
+		`INSERT INTO reports_migrated (id, reporter_ref, reporter_index, reported_student_login, project_name,
+			reason, explanation, status, created_at, reviewed_at, reviewed_by)
+		SELECT id, CAST(reporter_id AS TEXT), '', reported_student_login, project_name,
+			reason, explanation, status, created_at, reviewed_at, reviewed_by
+		FROM reports`,
+		`DROP TABLE reports`,
+		`ALTER TABLE reports_migrated RENAME TO reports`,
+	}
+	for _, query := range statements {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Println("Moved report reporter links to reports.reporter_ref")
+	return nil
+}
+
+func (db *DB) columnExists(table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue interface{}
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
@@ -0,0 +1,495 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"whistleblower/encryption"
+	"whistleblower/models"
+)
+
+// ErrLegalHold is returned when a user cannot be pseudonymized or erased
+// because a legal hold covers one of their cases.
+var ErrLegalHold = errors.New("user is under legal hold")
+
+// fieldErasedLogin names the blind index of erased logins.
+const fieldErasedLogin = "erased_subjects.login"
+
+// ExportDataSubject collects everything stored about user. The reporters of
+// reports about the user are left out.
+func (db *DB) ExportDataSubject(user *models.User) (*models.DataSubjectExport, error) {
+	export := &models.DataSubjectExport{ExportedAt: time.Now().UTC(), User: *user}
+
+	var err error
+	if export.ReportsFiled, err = db.queryReports(`SELECT `+reportColumns+` FROM reports r
+		WHERE r.reporter_index = ? ORDER BY r.id`, db.reporterIndex(user.ID)); err != nil {
+		return nil, fmt.Errorf("reports filed: %w", err)
+	}
+	if export.ReportsAbout, err = db.queryReports(`SELECT `+reportColumns+` FROM reports r
+		WHERE r.reported_student_login = ? ORDER BY r.id`, user.Login); err != nil {
+		return nil, fmt.Errorf("reports about: %w", err)
+	}
+	for i := range export.ReportsAbout {
+		export.ReportsAbout[i].ReporterID = 0
+		export.ReportsAbout[i].Reporter = ""
+	}
+
+	var stats models.UserReportStats
+	err = db.QueryRow(`SELECT id, user_id, total_reports, approved_reports, rejected_reports, false_report_ratio, warned
+		FROM user_report_stats WHERE user_id = ? ORDER BY id DESC LIMIT 1`, user.ID).Scan(
+		&stats.ID, &stats.UserID, &stats.TotalReports, &stats.ApprovedReports, &stats.RejectedReports,
+		&stats.FalseReportRatio, &stats.Warned)
+	switch {
+	case err == nil:
+		export.ReportStats = &stats
+	case err != sql.ErrNoRows:
+		return nil, fmt.Errorf("report stats: %w", err)
+	}
+
+	if export.Notifications, err = db.staffNotificationsAbout(user.Login); err != nil {
+		return nil, fmt.Errorf("notifications: %w", err)
+	}
+	if export.Sessions, err = db.userSessions(user.ID); err != nil {
+		return nil, fmt.Errorf("sessions: %w", err)
+	}
+	if export.FilterPresets, err = db.GetReportFilterPresets(user.ID); err != nil {
+		return nil, fmt.Errorf("filter presets: %w", err)
+	}
+	if export.LegalHolds, err = db.queryLegalHolds(`SELECT `+legalHoldColumns+` FROM legal_holds
+		WHERE login = ? ORDER BY id`, user.Login); err != nil {
+		return nil, fmt.Errorf("legal holds: %w", err)
+	}
+	if export.Identities, err = db.ListUserIdentities(user.ID); err != nil {
+		return nil, fmt.Errorf("identities: %w", err)
+	}
+
+	return export, nil
+}
+
+func (db *DB) queryReports(query string, args ...interface{}) ([]models.Report, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []models.Report{}
+	for rows.Next() {
+		report, err := db.scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, rows.Err()
+}
+
+func (db *DB) staffNotificationsAbout(login string) ([]models.StaffNotification, error) {
+	rows, err := db.Query(`SELECT id, reported_student_login, project_name, report_count, notification_sent_at, resolved
+		FROM staff_notifications WHERE reported_student_login = ? ORDER BY id`, login)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []models.StaffNotification{}
+	for rows.Next() {
+		var n models.StaffNotification
+		if err := rows.Scan(&n.ID, &n.ReportedStudentLogin, &n.ProjectName, &n.ReportCount,
+			&n.NotificationSentAt, &n.Resolved); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (db *DB) userSessions(userID int) ([]models.Session, error) {
+	rows, err := db.Query(`SELECT id, user_id, created_at, expires_at FROM sessions WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.CreatedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+const legalHoldColumns = `id, login, project_name, reason, created_by, created_at, released_by, released_at`
+
+func scanLegalHold(row scanner) (*models.LegalHold, error) {
+	var hold models.LegalHold
+	var releasedBy sql.NullInt64
+	var releasedAt sql.NullTime
+
+	err := row.Scan(&hold.ID, &hold.Login, &hold.ProjectName, &hold.Reason, &hold.CreatedBy,
+		&hold.CreatedAt, &releasedBy, &releasedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if releasedBy.Valid {
+		id := int(releasedBy.Int64)
+		hold.ReleasedBy = &id
+	}
+	if releasedAt.Valid {
+		hold.ReleasedAt = &releasedAt.Time
+	}
+	return &hold, nil
+}
+
+func (db *DB) queryLegalHolds(query string, args ...interface{}) ([]models.LegalHold, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []models.LegalHold{}
+	for rows.Next() {
+		hold, err := scanLegalHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, *hold)
+	}
+	return holds, rows.Err()
+}
+
+// CountOpenReports counts the pending reports about login, on projectName
+// when it is not empty.
+func (db *DB) CountOpenReports(login, projectName string) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM reports WHERE reported_student_login = ?
+		AND (? = '' OR project_name = ?) AND status = 'pending'`, login, projectName, projectName).Scan(&count)
+	return count, err
+}
+
+func (db *DB) CreateLegalHold(login, projectName, reason string, createdBy int) (*models.LegalHold, error) {
+	query := `INSERT INTO legal_holds (login, project_name, reason, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?) RETURNING ` + legalHoldColumns
+	return scanLegalHold(db.QueryRow(query, login, projectName, reason, createdBy, time.Now().UTC()))
+}
+
+// ListLegalHolds returns one page of active legal holds, or of all of them
+// with all set, newest first.
+func (db *DB) ListLegalHolds(all bool, page models.PageRequest) ([]models.LegalHold, string, error) {
+	query := `SELECT ` + legalHoldColumns + ` FROM legal_holds WHERE (? OR released_at IS NULL)`
+	args := []interface{}{all}
+
+	if page.Cursor != "" {
+		var lastID int
+		if err := decodeCursor(page.Cursor, "-id", &lastID); err != nil {
+			return nil, "", err
+		}
+		query += ` AND id < ?`
+		args = append(args, lastID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+
+	holds, err := db.queryLegalHolds(query, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	holds, next := pageResult(holds, page.Limit, "-id", func(last models.LegalHold) []interface{} {
+		return []interface{}{last.ID}
+	})
+	return holds, next, nil
+}
+
+// ReleaseLegalHold releases an active hold. It reports false when there is
+// no active hold with that ID.
+func (db *DB) ReleaseLegalHold(id, userID int) (bool, error) {
+	result, err := db.Exec(`UPDATE legal_holds SET released_by = ?, released_at = ?
+		WHERE id = ? AND released_at IS NULL`, userID, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// legalHoldsQuery selects the active holds covering a user: holds on the
+// user's own cases, and holds on cases the user filed a report in.
+const legalHoldsQuery = `SELECT ` + legalHoldColumns + ` FROM legal_holds h
+	WHERE h.released_at IS NULL AND (h.login = ? OR EXISTS (
+		SELECT 1 FROM reports r WHERE r.reporter_index = ? AND r.reported_student_login = h.login
+		AND (h.project_name = '' OR r.project_name = h.project_name)))
+	ORDER BY h.id`
+
+// LegalHoldsCovering returns the active legal holds that keep user from
+// being pseudonymized or erased.
+func (db *DB) LegalHoldsCovering(user *models.User) ([]models.LegalHold, error) {
+	return db.queryLegalHolds(legalHoldsQuery, user.Login, db.reporterIndex(user.ID))
+}
+
+// PseudonymizeUser replaces the identity of user with a random pseudonym:
+// in the user row, in the reports and notifications about them, and in
+// released legal holds. Sessions and filter presets are deleted. Reports the
+// user filed are kept, linked to the pseudonymous user.
+func (db *DB) PseudonymizeUser(user *models.User) (*models.ErasureResult, error) {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	pseudonym := "deleted-" + hex.EncodeToString(suffix)
+	result := &models.ErasureResult{Mode: models.ErasurePseudonymize, UserID: user.ID, Pseudonym: pseudonym}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := db.checkLegalHolds(tx, user); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`UPDATE users SET login = ?, email = '', display_name = ?, intra_id = NULL,
+		is_active = FALSE, updated_at = ?, erased_at = ? WHERE id = ?`, pseudonym, pseudonym, now, now, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	reports, err := tx.Exec(`UPDATE reports SET reported_student_login = ? WHERE reported_student_login = ?`,
+		pseudonym, user.Login)
+	if err != nil {
+		return nil, err
+	}
+	if result.ReportsPseudonymized, err = rowsAffected(reports); err != nil {
+		return nil, err
+	}
+
+	for _, query := range []string{
+		`UPDATE staff_notifications SET reported_student_login = ? WHERE reported_student_login = ?`,
+		`UPDATE legal_holds SET login = ? WHERE login = ?`,
+	} {
+		if _, err := tx.Exec(query, pseudonym, user.Login); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.SessionsDeleted, err = db.deleteUserData(tx, user.ID); err != nil {
+		return nil, err
+	}
+	if err := db.markErased(tx, user.Login); err != nil {
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+// EraseUser deletes user together with every report they filed, every
+// report about them and what hangs off those reports. The stats of the
+// other reporters whose reports were deleted are recomputed. The audit log
+// is append-only and keeps its entries.
+func (db *DB) EraseUser(user *models.User) (*models.ErasureResult, error) {
+	result := &models.ErasureResult{Mode: models.ErasureErase, UserID: user.ID}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := db.checkLegalHolds(tx, user); err != nil {
+		return nil, err
+	}
+
+	filed, _, err := db.reportRefs(tx, `SELECT id, reporter_ref FROM reports WHERE reporter_index = ?`,
+		db.reporterIndex(user.ID))
+	if err != nil {
+		return nil, err
+	}
+	about, reporters, err := db.reportRefs(tx, `SELECT id, reporter_ref FROM reports WHERE reported_student_login = ?`,
+		user.Login)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.ReportsFiledDeleted, err = deleteReports(tx, filed); err != nil {
+		return nil, err
+	}
+	if result.ReportsAboutDeleted, err = deleteReports(tx, about); err != nil {
+		return nil, err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM staff_notifications WHERE reported_student_login = ?`,
+		`UPDATE legal_holds SET login = '' WHERE login = ?`,
+	} {
+		if _, err := tx.Exec(query, user.Login); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM user_report_stats WHERE user_id = ?`, user.ID); err != nil {
+		return nil, err
+	}
+
+	if result.SessionsDeleted, err = db.deleteUserData(tx, user.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, user.ID); err != nil {
+		return nil, err
+	}
+	if err := db.markErased(tx, user.Login); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for reporterID := range reporters {
+		if reporterID == user.ID {
+			continue
+		}
+		if err := db.UpdateUserReportStats(reporterID); err != nil {
+			return result, fmt.Errorf("user erased, but failed to update the stats of user %d: %w", reporterID, err)
+		}
+	}
+	return result, nil
+}
+
+func (db *DB) checkLegalHolds(tx *sql.Tx, user *models.User) error {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM (`+legalHoldsQuery+`)`,
+		user.Login, db.reporterIndex(user.ID)).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrLegalHold
+	}
+	return nil
+}
+
+// reportRefs returns the IDs of the reports query selects, with the IDs of
+// their reporters.
+func (db *DB) reportRefs(tx *sql.Tx, query string, args ...interface{}) ([]int, map[int]bool, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	reporters := map[int]bool{}
+	for rows.Next() {
+		var id int
+		var ref string
+		if err := rows.Scan(&id, &ref); err != nil {
+			return nil, nil, err
+		}
+		ref, err := db.openField(fieldReporter, ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("report %d: %w", id, err)
+		}
+		reporterID, err := strconv.Atoi(ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("report %d: invalid reporter link", id)
+		}
+
+		ids = append(ids, id)
+		reporters[reporterID] = true
+	}
+	return ids, reporters, rows.Err()
+}
+
+// deleteReports deletes reports and the rows that refer to them. Reports
+// already deleted are not counted.
+func deleteReports(tx *sql.Tx, ids []int) (int, error) {
+	count := 0
+	for _, id := range ids {
+		for _, query := range []string{
+			`DELETE FROM report_search_terms WHERE report_id = ?`,
+			`DELETE FROM report_access_log WHERE report_id = ?`,
+			`DELETE FROM identity_reveals WHERE report_id = ?`,
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return count, err
+			}
+		}
+
+		result, err := tx.Exec(`DELETE FROM reports WHERE id = ?`, id)
+		if err != nil {
+			return count, err
+		}
+		n, err := rowsAffected(result)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// deleteUserData deletes the sessions, linked identities, authenticator and
+// filter presets of a user, revokes their API keys, and returns the number
+// of sessions deleted.
+func (db *DB) deleteUserData(tx *sql.Tx, userID int) (int, error) {
+	sessions, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM report_filter_presets WHERE user_id = ?`, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_identities WHERE user_id = ?`, userID); err != nil {
+		return 0, err
+	}
+	if _, err := deleteTOTP(tx, userID); err != nil {
+		return 0, err
+	}
+	// Keys acting as the user stop working; the rows stay for the audit
+	// trail of what the keys did.
+	if _, err := tx.Exec(`UPDATE api_keys SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), userID); err != nil {
+		return 0, err
+	}
+	return rowsAffected(sessions)
+}
+
+func rowsAffected(result sql.Result) (int, error) {
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// markErased remembers that login was erased, keyed by its blind index.
+func (db *DB) markErased(tx *sql.Tx, login string) error {
+	_, err := tx.Exec(`INSERT OR IGNORE INTO erased_subjects (login_hash, erased_at) VALUES (?, ?)`,
+		db.blindIndex(fieldErasedLogin, login), time.Now().UTC())
+	return err
+}
+
+// isErased reports whether login belongs to an erased user. Logins erased
+// before field encryption had an index key were hashed without a key, so
+// both hashes are checked.
+func (db *DB) isErased(tx *sql.Tx, login string) (bool, error) {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM erased_subjects WHERE login_hash IN (?, ?)`,
+		db.blindIndex(fieldErasedLogin, login), encryption.BlindIndex(nil, fieldErasedLogin, login)).Scan(&count)
+	return count > 0, err
+}
+
+// ClearErased forgets that login was erased, once its owner signs in again.
+func (db *DB) ClearErased(login string) error {
+	_, err := db.Exec(`DELETE FROM erased_subjects WHERE login_hash IN (?, ?)`,
+		db.blindIndex(fieldErasedLogin, login), encryption.BlindIndex(nil, fieldErasedLogin, login))
+	return err
+}
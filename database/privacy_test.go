@@ -0,0 +1,101 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"whistleblower/models"
+)
+
+// openTestDB opens a fresh database in a temporary directory. The schema is
+// read relative to the working directory, so the test runs from the
+// repository root.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func createTestUser(t *testing.T, db *DB, login string) *models.User {
+	t.Helper()
+	if err := db.CreateUser(&models.User{Login: login, Email: login + "@example.com", DisplayName: login}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.GetUserByLogin(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestErasureRefusedUnderLegalHold(t *testing.T) {
+	db := openTestDB(t)
+	staff := createTestUser(t, db, "staff")
+
+	tests := []struct {
+		name string
+		// holdOn returns the login the hold is placed on, given the
+		// user to be erased.
+		holdOn  func(user *models.User) string
+		project string
+	}{
+		{"own case", func(user *models.User) string { return user.Login }, ""},
+		{"own case, one project", func(user *models.User) string { return user.Login }, "libft"},
+		{"case reported by the user", func(user *models.User) string {
+			reported := createTestUser(t, db, user.Login+"-reported")
+			report := &models.Report{
+				ReporterID:           user.ID,
+				ReportedStudentLogin: reported.Login,
+				ProjectName:          "libft",
+				Reason:               "cheating",
+				Explanation:          "Copied the whole project.",
+			}
+			if err := db.CreateReport(report); err != nil {
+				t.Fatal(err)
+			}
+			return reported.Login
+		}, "libft"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := createTestUser(t, db, fmt.Sprintf("student%d", i))
+			hold, err := db.CreateLegalHold(tt.holdOn(user), tt.project, "ongoing case", staff.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := db.PseudonymizeUser(user); err != ErrLegalHold {
+				t.Errorf("PseudonymizeUser under hold: got %v, want ErrLegalHold", err)
+			}
+			if _, err := db.EraseUser(user); err != ErrLegalHold {
+				t.Errorf("EraseUser under hold: got %v, want ErrLegalHold", err)
+			}
+			if _, err := db.GetUserByLogin(user.Login); err != nil {
+				t.Errorf("user is gone after a refused erasure: %v", err)
+			}
+
+			released, err := db.ReleaseLegalHold(hold.ID, staff.ID)
+			if err != nil || !released {
+				t.Fatalf("ReleaseLegalHold = %v, %v", released, err)
+			}
+			if _, err := db.EraseUser(user); err != nil {
+				t.Errorf("EraseUser after release: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// unixSeconds is how rate limit buckets store times, so the token
+// arithmetic can be done in SQL.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// TakeRateLimitToken takes a token from the bucket key, which holds at most
+// capacity tokens and gains perSecond tokens a second, in one statement so
+// instances sharing the database cannot both take the last token. It
+// reports whether a token was taken and how many are left.
+func (db *DB) TakeRateLimitToken(key string, capacity, perSecond float64, now time.Time) (bool, float64, error) {
+	at := unixSeconds(now)
+	var tokens float64
+	err := db.QueryRow(`INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at, full_at)
+		VALUES (?1, ?2 - 1, ?3, ?3 + 1.0 / ?4)
+		ON CONFLICT(bucket_key) DO UPDATE SET
+			tokens = MIN(?2, tokens + MAX(0, ?3 - updated_at) * ?4) - 1,
+			updated_at = ?3,
+			full_at = ?3 + (?2 - MIN(?2, tokens + MAX(0, ?3 - updated_at) * ?4) + 1) / ?4
+		WHERE MIN(?2, tokens + MAX(0, ?3 - updated_at) * ?4) >= 1
+		RETURNING tokens`, key, capacity, at, perSecond).Scan(&tokens)
+	if err == nil {
+		return true, tokens, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, 0, err
+	}
+
+	// The bucket is empty: read how far it has refilled, for the caller's
+	// Retry-After.
+	err = db.QueryRow(`SELECT MIN(?2, tokens + MAX(0, ?3 - updated_at) * ?4) FROM rate_limit_buckets
+		WHERE bucket_key = ?1`, key, capacity, at, perSecond).Scan(&tokens)
+	if err == sql.ErrNoRows {
+		// Dropped as full in the meantime.
+		return false, capacity, nil
+	}
+	return false, tokens, err
+}
+
+// DeleteFullRateLimitBuckets drops buckets that have refilled by now, which
+// behave the same as missing ones.
+func (db *DB) DeleteFullRateLimitBuckets(now time.Time) (int, error) {
+	result, err := db.Exec(`DELETE FROM rate_limit_buckets WHERE full_at <= ?`, unixSeconds(now))
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected(result)
+}
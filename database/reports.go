@@ -0,0 +1,334 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"whistleblower/models"
+)
+
+// ErrInvalidFilter is returned for report filters that cannot be applied,
+// such as an unknown sort or a malformed date.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+const reportColumns = `r.id, r.reporter_ref, r.reported_student_login, r.project_name, r.reason,
+	r.explanation, r.status, r.created_at, r.reviewed_at, r.reviewed_by`
+
+// scanReport reads a row of reportColumns, decrypting the explanation and
+// the reporter link.
+func (db *DB) scanReport(row scanner) (*models.Report, error) {
+	var report models.Report
+	var reporter, explanation string
+	var reviewedAt sql.NullTime
+	var reviewedBy sql.NullInt64
+
+	err := row.Scan(&report.ID, &reporter, &report.ReportedStudentLogin,
+		&report.ProjectName, &report.Reason, &explanation, &report.Status,
+		&report.CreatedAt, &reviewedAt, &reviewedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Explanation, err = db.openField(fieldExplanation, explanation); err != nil {
+		return nil, fmt.Errorf("report %d: %w", report.ID, err)
+	}
+	if reporter, err = db.openField(fieldReporter, reporter); err != nil {
+		return nil, fmt.Errorf("report %d: %w", report.ID, err)
+	}
+	if report.ReporterID, err = strconv.Atoi(reporter); err != nil {
+		return nil, fmt.Errorf("report %d: invalid reporter link", report.ID)
+	}
+
+	if reviewedAt.Valid {
+		report.ReviewedAt = &reviewedAt.Time
+	}
+	if reviewedBy.Valid {
+		id := int(reviewedBy.Int64)
+		report.ReviewedBy = &id
+	}
+	return &report, nil
+}
+
+// reportSorts maps the sort names accepted by SearchReports to columns.
+// Reports are created in ID order, so the ID doubles as creation time.
+var reportSorts = map[string]string{
+	"created_at":     "",
+	"project":        "r.project_name",
+	"reported_login": "r.reported_student_login",
+	"reason":         "r.reason",
+	"status":         "r.status",
+}
+
+var reportStatuses = map[string]bool{"": true, "all": true, "pending": true, "approved": true, "rejected": true}
+
+// ValidateReportFilter checks the parts of filter that could make
+// SearchReports fail, so bad presets are rejected when they are saved.
+func ValidateReportFilter(filter models.ReportFilter) error {
+	if !reportStatuses[filter.Status] {
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidFilter, filter.Status)
+	}
+	if filter.Sort != "" {
+		if _, ok := reportSorts[strings.TrimPrefix(filter.Sort, "-")]; !ok {
+			return fmt.Errorf("%w: unknown sort %q", ErrInvalidFilter, filter.Sort)
+		}
+	}
+	for _, value := range []string{filter.From, filter.To} {
+		if value == "" {
+			continue
+		}
+		if _, _, err := parseFilterTime(value); err != nil {
+			return err
+		}
+	}
+	if filter.Query != "" && searchTerms(filter.Query) == "" {
+		return fmt.Errorf("%w: search has no words", ErrInvalidFilter)
+	}
+	return nil
+}
+
+// SearchReports returns one page of reports matching filter, the cursor of
+// the next page (empty on the last page) and the total number of matches.
+// Sort is one of the reportSorts keys, prefixed with "-" for descending
+// order; the default is newest first.
+func (db *DB) SearchReports(filter models.ReportFilter, page models.PageRequest) ([]models.Report, string, int, error) {
+	if err := ValidateReportFilter(filter); err != nil {
+		return nil, "", 0, err
+	}
+
+	sort := filter.Sort
+	if sort == "" {
+		sort = "-created_at"
+	}
+	desc := strings.HasPrefix(sort, "-")
+	column := reportSorts[strings.TrimPrefix(sort, "-")]
+
+	from, where, args, err := db.reportFilterSQL(filter)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) `+from+where, args...).Scan(&total); err != nil {
+		return nil, "", 0, err
+	}
+
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+
+	if page.Cursor != "" {
+		var value string
+		var lastID int
+		if column == "" {
+			err = decodeCursor(page.Cursor, sort, &lastID)
+		} else {
+			err = decodeCursor(page.Cursor, sort, &value, &lastID)
+		}
+		if err != nil {
+			return nil, "", 0, err
+		}
+
+		if column == "" {
+			where += fmt.Sprintf(" AND r.id %s ?", op)
+			args = append(args, lastID)
+		} else {
+			where += fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND r.id %s ?))", column, op, column, op)
+			args = append(args, value, value, lastID)
+		}
+	}
+
+	orderBy := fmt.Sprintf(" ORDER BY r.id %s", dir)
+	if column != "" {
+		orderBy = fmt.Sprintf(" ORDER BY %s %s, r.id %s", column, dir, dir)
+	}
+
+	// One extra row tells whether there is a next page.
+	query := `SELECT ` + reportColumns + ` ` + from + where + orderBy + ` LIMIT ?`
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer rows.Close()
+
+	reports := []models.Report{}
+	for rows.Next() {
+		report, err := db.scanReport(rows)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		reports = append(reports, *report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", 0, err
+	}
+
+	reports, next := pageResult(reports, page.Limit, sort, func(last models.Report) []interface{} {
+		switch column {
+		case "r.project_name":
+			return []interface{}{last.ProjectName, last.ID}
+		case "r.reported_student_login":
+			return []interface{}{last.ReportedStudentLogin, last.ID}
+		case "r.reason":
+			return []interface{}{last.Reason, last.ID}
+		case "r.status":
+			return []interface{}{last.Status, last.ID}
+		}
+		return []interface{}{last.ID}
+	})
+
+	return reports, next, total, nil
+}
+
+// reportFilterSQL builds the FROM and WHERE clauses for filter.
+func (db *DB) reportFilterSQL(filter models.ReportFilter) (string, string, []interface{}, error) {
+	from := `FROM reports r`
+	where := ` WHERE 1 = 1`
+	var args []interface{}
+
+	// Explanations are encrypted, so every word of the query is looked up
+	// as a prefix in the blind index of their words.
+	if q := strings.TrimSpace(filter.Query); q != "" {
+		words := searchWords(q)
+		if len(words) == 0 {
+			where += ` AND 0`
+		}
+		for _, word := range words {
+			if runes := []rune(word); len(runes) > maxPrefixRunes {
+				word = string(runes[:maxPrefixRunes])
+			}
+			where += ` AND r.id IN (SELECT report_id FROM report_search_terms WHERE term = ?)`
+			args = append(args, db.blindIndex(fieldSearchTerm, word))
+		}
+	}
+
+	if filter.Status != "" && filter.Status != "all" {
+		where += ` AND r.status = ?`
+		args = append(args, filter.Status)
+	}
+	if filter.Reason != "" {
+		where += ` AND r.reason = ?`
+		args = append(args, filter.Reason)
+	}
+	if filter.ProjectName != "" {
+		where += ` AND r.project_name = ? COLLATE NOCASE`
+		args = append(args, filter.ProjectName)
+	}
+	if filter.ReportedLogin != "" {
+		where += ` AND r.reported_student_login = ?`
+		args = append(args, filter.ReportedLogin)
+	}
+	if filter.CampusID > 0 {
+		where += ` AND r.reported_student_login IN (SELECT login FROM users WHERE campus_id = ?)`
+		args = append(args, filter.CampusID)
+	}
+
+	if filter.From != "" {
+		from, _, err := parseFilterTime(filter.From)
+		if err != nil {
+			return "", "", nil, err
+		}
+		where += ` AND r.created_at >= ?`
+		args = append(args, from.Format(sqliteTimeFormat))
+	}
+	if filter.To != "" {
+		to, dateOnly, err := parseFilterTime(filter.To)
+		if err != nil {
+			return "", "", nil, err
+		}
+		// A date includes the whole day.
+		if dateOnly {
+			where += ` AND r.created_at < ?`
+			args = append(args, to.AddDate(0, 0, 1).Format(sqliteTimeFormat))
+		} else {
+			where += ` AND r.created_at <= ?`
+			args = append(args, to.Format(sqliteTimeFormat))
+		}
+	}
+
+	return from, where, args, nil
+}
+
+// sqliteTimeFormat matches how CURRENT_TIMESTAMP stores times, so they
+// compare correctly as text.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+func parseFilterTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("%w: invalid date %q", ErrInvalidFilter, value)
+}
+
+func (db *DB) GetReportFilterPresets(userID int) ([]models.ReportFilterPreset, error) {
+	rows, err := db.Query(`SELECT id, name, filter, created_at, updated_at FROM report_filter_presets
+		WHERE user_id = ? ORDER BY name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	presets := []models.ReportFilterPreset{}
+	for rows.Next() {
+		preset, err := scanReportFilterPreset(rows)
+		if err != nil {
+			return nil, err
+		}
+		presets = append(presets, *preset)
+	}
+
+	return presets, rows.Err()
+}
+
+func (db *DB) GetReportFilterPreset(userID int, name string) (*models.ReportFilterPreset, error) {
+	return scanReportFilterPreset(db.QueryRow(`SELECT id, name, filter, created_at, updated_at
+		FROM report_filter_presets WHERE user_id = ? AND name = ?`, userID, name))
+}
+
+// SaveReportFilterPreset creates the user's preset or replaces the filter of
+// the preset with the same name.
+func (db *DB) SaveReportFilterPreset(userID int, name string, filter models.ReportFilter) (*models.ReportFilterPreset, error) {
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	query := `INSERT INTO report_filter_presets (user_id, name, filter, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, name) DO UPDATE SET filter = excluded.filter, updated_at = excluded.updated_at
+		RETURNING id, name, filter, created_at, updated_at`
+
+	return scanReportFilterPreset(db.QueryRow(query, userID, name, string(data), now, now))
+}
+
+func (db *DB) DeleteReportFilterPreset(userID int, name string) (bool, error) {
+	result, err := db.Exec(`DELETE FROM report_filter_presets WHERE user_id = ? AND name = ?`, userID, name)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+func scanReportFilterPreset(row scanner) (*models.ReportFilterPreset, error) {
+	var preset models.ReportFilterPreset
+	var filter string
+
+	if err := row.Scan(&preset.ID, &preset.Name, &filter, &preset.CreatedAt, &preset.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(filter), &preset.Filter); err != nil {
+		return nil, err
+	}
+	return &preset, nil
+}
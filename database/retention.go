@@ -0,0 +1,336 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"whistleblower/models"
+)
+
+// retentionEntities lists what retention policies apply to, with the
+// statuses and actions each entity accepts.
+var retentionEntities = map[string]struct {
+	statuses []string
+	actions  []string
+}{
+	"reports":       {[]string{"pending", "approved", "rejected", "*"}, []string{models.RetentionDelete, models.RetentionAnonymize}},
+	"notifications": {[]string{"resolved", "unresolved", "*"}, []string{models.RetentionDelete}},
+	"users":         {[]string{"inactive"}, []string{models.RetentionDelete, models.RetentionAnonymize}},
+	"access_log":    {[]string{"*"}, []string{models.RetentionDelete}},
+}
+
+// maxRetentionIDs caps the record IDs listed per policy outcome.
+const maxRetentionIDs = 100
+
+// ParseRetentionPolicies reads comma separated policies of the form
+// entity:status:action:after, for example
+// "reports:rejected:delete:12m,reports:approved:anonymize:5y". after is a
+// number of days (d), weeks (w), months (m) or years (y).
+func ParseRetentionPolicies(spec string) ([]models.RetentionPolicy, error) {
+	var policies []models.RetentionPolicy
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("retention policy %q: expected entity:status:action:after", entry)
+		}
+		p := models.RetentionPolicy{Entity: parts[0], Status: parts[1], Action: parts[2], After: parts[3]}
+		if err := validateRetentionPolicy(p); err != nil {
+			return nil, fmt.Errorf("retention policy %q: %w", entry, err)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+func validateRetentionPolicy(p models.RetentionPolicy) error {
+	if p.Entity == "audit_log" {
+		return fmt.Errorf("the audit log is append-only and is never purged")
+	}
+	entity, ok := retentionEntities[p.Entity]
+	if !ok {
+		return fmt.Errorf("unknown entity %q", p.Entity)
+	}
+	if !slices.Contains(entity.statuses, p.Status) {
+		return fmt.Errorf("%s status must be one of %s", p.Entity, strings.Join(entity.statuses, ", "))
+	}
+	if !slices.Contains(entity.actions, p.Action) {
+		return fmt.Errorf("%s action must be one of %s", p.Entity, strings.Join(entity.actions, ", "))
+	}
+	_, err := retentionCutoff(p.After, time.Now())
+	return err
+}
+
+// retentionCutoff is the time before which records fall under a policy
+// with the given after.
+func retentionCutoff(after string, now time.Time) (time.Time, error) {
+	if len(after) < 2 {
+		return time.Time{}, fmt.Errorf("invalid age %q", after)
+	}
+	n, err := strconv.Atoi(after[:len(after)-1])
+	if err != nil || n <= 0 {
+		return time.Time{}, fmt.Errorf("invalid age %q", after)
+	}
+
+	now = now.UTC()
+	switch after[len(after)-1] {
+	case 'd':
+		return now.AddDate(0, 0, -n), nil
+	case 'w':
+		return now.AddDate(0, 0, -7*n), nil
+	case 'm':
+		return now.AddDate(0, -n, 0), nil
+	case 'y':
+		return now.AddDate(-n, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid age %q: use d, w, m or y", after)
+}
+
+// RetentionPolicyName is the policy as written in RETENTION_POLICIES.
+func RetentionPolicyName(p models.RetentionPolicy) string {
+	return strings.Join([]string{p.Entity, p.Status, p.Action, p.After}, ":")
+}
+
+// ApplyRetentionPolicy deletes or anonymizes the records that policy p
+// covers at now. With dryRun set nothing changes, and the outcome shows what
+// would be removed. Records covered by an active legal hold are kept.
+func (db *DB) ApplyRetentionPolicy(p models.RetentionPolicy, now time.Time, dryRun bool) (*models.RetentionOutcome, error) {
+	if err := validateRetentionPolicy(p); err != nil {
+		return nil, err
+	}
+	cutoff, _ := retentionCutoff(p.After, now)
+	outcome := &models.RetentionOutcome{Policy: RetentionPolicyName(p), Cutoff: cutoff}
+
+	var err error
+	switch p.Entity {
+	case "reports":
+		err = db.applyReportRetention(p, cutoff, dryRun, outcome)
+	case "notifications":
+		where := `notification_sent_at < ?`
+		switch p.Status {
+		case "resolved":
+			where += ` AND resolved = TRUE`
+		case "unresolved":
+			where += ` AND resolved = FALSE`
+		}
+		err = db.applyRowRetention("staff_notifications", where, cutoff, dryRun, outcome)
+	case "access_log":
+		err = db.applyRowRetention("report_access_log", `accessed_at < ?`, cutoff, dryRun, outcome)
+	case "users":
+		err = db.applyUserRetention(p, cutoff, dryRun, outcome)
+	}
+	return outcome, err
+}
+
+// applyRowRetention deletes the rows of table matching where, which takes
+// the cutoff as its only argument.
+func (db *DB) applyRowRetention(table, where string, cutoff time.Time, dryRun bool, outcome *models.RetentionOutcome) error {
+	if err := db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE `+where, cutoff).Scan(&outcome.Matched); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT id FROM `+table+` WHERE `+where+` ORDER BY id LIMIT ?`, cutoff, maxRetentionIDs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		outcome.IDs = append(outcome.IDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if dryRun || outcome.Matched == 0 {
+		return nil
+	}
+	result, err := db.Exec(`DELETE FROM `+table+` WHERE `+where, cutoff)
+	if err != nil {
+		return err
+	}
+	outcome.Applied, err = rowsAffected(result)
+	return err
+}
+
+// applyReportRetention handles reports, which age from their review, or
+// their creation while pending.
+func (db *DB) applyReportRetention(p models.RetentionPolicy, cutoff time.Time, dryRun bool, outcome *models.RetentionOutcome) error {
+	query := `SELECT r.id, EXISTS (SELECT 1 FROM legal_holds h WHERE h.released_at IS NULL
+			AND h.login = r.reported_student_login AND (h.project_name = '' OR h.project_name = r.project_name))
+		FROM reports r WHERE COALESCE(r.reviewed_at, r.created_at) < ? AND (? = '*' OR r.status = ?)`
+	if p.Action == models.RetentionAnonymize {
+		query += ` AND r.anonymized_at IS NULL`
+	}
+
+	rows, err := db.Query(query+` ORDER BY r.id`, cutoff, p.Status, p.Status)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		var held bool
+		if err := rows.Scan(&id, &held); err != nil {
+			rows.Close()
+			return err
+		}
+		outcome.Matched++
+		if held {
+			outcome.Held++
+			continue
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	outcome.IDs = ids
+	if len(ids) > maxRetentionIDs {
+		outcome.IDs = ids[:maxRetentionIDs]
+	}
+	if dryRun {
+		return nil
+	}
+
+	for start := 0; start < len(ids); start += 500 {
+		batch := ids[start:min(start+500, len(ids))]
+		n, err := db.applyReportBatch(p.Action, batch)
+		if err != nil {
+			return err
+		}
+		outcome.Applied += n
+	}
+	return nil
+}
+
+func (db *DB) applyReportBatch(action string, ids []int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if action == models.RetentionAnonymize {
+		n, err = db.anonymizeReports(tx, ids)
+	} else {
+		n, err = deleteReports(tx, ids)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// anonymizeReports strips reports down to their reason, project, status and
+// dates: the reported student, the explanation and the reporter link are
+// removed, along with the search terms.
+func (db *DB) anonymizeReports(tx *sql.Tx, ids []int) (int, error) {
+	now := time.Now().UTC()
+	count := 0
+	for _, id := range ids {
+		explanation, err := db.sealField(fieldExplanation, "")
+		if err != nil {
+			return count, err
+		}
+		reporter, err := db.sealField(fieldReporter, "0")
+		if err != nil {
+			return count, err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM report_search_terms WHERE report_id = ?`, id); err != nil {
+			return count, err
+		}
+		// A reporter_index no blind index can equal keeps the report out of
+		// reporter lookups and out of indexReports.
+		result, err := tx.Exec(`UPDATE reports SET reported_student_login = 'anonymized', explanation = ?,
+			reporter_ref = ?, reporter_index = 'anonymized', anonymized_at = ?
+			WHERE id = ? AND anonymized_at IS NULL`, explanation, reporter, now, id)
+		if err != nil {
+			return count, err
+		}
+		n, err := rowsAffected(result)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// applyUserRetention erases or pseudonymizes inactive non-staff users who
+// have not been updated since cutoff.
+func (db *DB) applyUserRetention(p models.RetentionPolicy, cutoff time.Time, dryRun bool, outcome *models.RetentionOutcome) error {
+	rows, err := db.Query(`SELECT `+userColumns+` FROM users
+		WHERE is_active = FALSE AND is_staff = FALSE AND erased_at IS NULL
+		AND COALESCE(updated_at, last_seen_at, created_at) < ? ORDER BY id`, cutoff)
+	if err != nil {
+		return err
+	}
+	var users []*models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		outcome.Matched++
+
+		holds, err := db.LegalHoldsCovering(user)
+		if err != nil {
+			return err
+		}
+		if len(holds) > 0 {
+			outcome.Held++
+			continue
+		}
+		if len(outcome.IDs) < maxRetentionIDs {
+			outcome.IDs = append(outcome.IDs, user.ID)
+		}
+		if dryRun {
+			continue
+		}
+
+		var result *models.ErasureResult
+		if p.Action == models.RetentionAnonymize {
+			result, err = db.PseudonymizeUser(user)
+		} else {
+			result, err = db.EraseUser(user)
+		}
+		if err == ErrLegalHold {
+			outcome.Held++
+			continue
+		}
+		if result == nil {
+			return err
+		}
+		if err != nil {
+			log.Printf("Retention purge: %v", err)
+		}
+		outcome.Applied++
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"whistleblower/models"
+)
+
+const revealColumns = `v.id, v.report_id, v.requested_by, COALESCE(u.login, ''), v.justification,
+	v.status, v.decided_by, v.decision_note, v.created_at, v.decided_at`
+
+const revealFrom = ` FROM identity_reveals v LEFT JOIN users u ON u.id = v.requested_by`
+
+func scanRevealRequest(row scanner) (*models.RevealRequest, error) {
+	var req models.RevealRequest
+	var decidedBy sql.NullInt64
+	var decidedAt sql.NullTime
+
+	err := row.Scan(&req.ID, &req.ReportID, &req.RequestedBy, &req.RequesterName, &req.Justification,
+		&req.Status, &decidedBy, &req.DecisionNote, &req.CreatedAt, &decidedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if decidedBy.Valid {
+		id := int(decidedBy.Int64)
+		req.DecidedBy = &id
+	}
+	if decidedAt.Valid {
+		req.DecidedAt = &decidedAt.Time
+	}
+	return &req, nil
+}
+
+// CreateRevealRequest stores a request to reveal a report's reporter. With
+// approved set, the request counts as granted right away.
+func (db *DB) CreateRevealRequest(reportID, requestedBy int, justification string, approved bool) (*models.RevealRequest, error) {
+	status := models.RevealPending
+	var decidedAt interface{}
+	now := time.Now().UTC()
+	if approved {
+		status = models.RevealApproved
+		decidedAt = now
+	}
+
+	result, err := db.Exec(`INSERT INTO identity_reveals (report_id, requested_by, justification, status, created_at, decided_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, reportID, requestedBy, justification, status, now, decidedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetRevealRequest(int(id))
+}
+
+func (db *DB) GetRevealRequest(id int) (*models.RevealRequest, error) {
+	return scanRevealRequest(db.QueryRow(`SELECT `+revealColumns+revealFrom+` WHERE v.id = ?`, id))
+}
+
+// ListRevealRequests returns one page of reveal requests, newest first,
+// optionally only those with status.
+func (db *DB) ListRevealRequests(status string, page models.PageRequest) ([]models.RevealRequest, string, error) {
+	query := `SELECT ` + revealColumns + revealFrom + ` WHERE (? = '' OR v.status = ?)`
+	args := []interface{}{status, status}
+
+	if page.Cursor != "" {
+		var lastID int
+		if err := decodeCursor(page.Cursor, "-id", &lastID); err != nil {
+			return nil, "", err
+		}
+		query += ` AND v.id < ?`
+		args = append(args, lastID)
+	}
+	query += ` ORDER BY v.id DESC LIMIT ?`
+
+	rows, err := db.Query(query, append(args, page.Limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	requests := []models.RevealRequest{}
+	for rows.Next() {
+		req, err := scanRevealRequest(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		requests = append(requests, *req)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	requests, next := pageResult(requests, page.Limit, "-id", func(last models.RevealRequest) []interface{} {
+		return []interface{}{last.ID}
+	})
+	return requests, next, nil
+}
+
+// DecideRevealRequest approves or denies a pending request. It returns
+// sql.ErrNoRows when the request is not pending anymore.
+func (db *DB) DecideRevealRequest(id, decidedBy int, status, note string) (*models.RevealRequest, error) {
+	result, err := db.Exec(`UPDATE identity_reveals SET status = ?, decided_by = ?, decision_note = ?, decided_at = ?
+		WHERE id = ? AND status = 'pending'`, status, decidedBy, note, time.Now().UTC(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return db.GetRevealRequest(id)
+}
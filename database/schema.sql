@@ -5,13 +5,44 @@ CREATE TABLE IF NOT EXISTS users (
     email TEXT NOT NULL,
     display_name TEXT NOT NULL,
     is_staff BOOLEAN DEFAULT FALSE,
-    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    intra_id INTEGER NULL,
+    campus_id INTEGER NULL,
+    is_active BOOLEAN DEFAULT TRUE,
+    updated_at DATETIME NULL,
+    last_seen_at DATETIME NULL,
+    role TEXT NOT NULL DEFAULT 'student',
+    erased_at DATETIME NULL
+);
+
+-- Campus directory, seeded from all_campuses.json and refreshed from intra
+CREATE TABLE IF NOT EXISTS campuses (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    city TEXT NOT NULL DEFAULT '',
+    country TEXT NOT NULL DEFAULT '',
+    time_zone TEXT NOT NULL DEFAULT '',
+    active BOOLEAN DEFAULT TRUE,
+    public BOOLEAN DEFAULT TRUE,
+    users_count INTEGER DEFAULT 0,
+    updated_at DATETIME NOT NULL
+);
+
+-- Sync bookkeeping per campus, used for incremental syncs
+CREATE TABLE IF NOT EXISTS campus_syncs (
+    campus_id INTEGER PRIMARY KEY,
+    last_full_sync_at DATETIME NULL,
+    last_synced_at DATETIME NULL
 );
 
 -- Reports table
+-- reporter_ref (the reporter's user ID) and explanation are encrypted;
+-- reporter_index is a keyed hash of reporter_ref for lookups by reporter.
+-- Anonymized reports keep only their reason, project, status and dates.
 CREATE TABLE IF NOT EXISTS reports (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    reporter_id INTEGER NOT NULL,
+    reporter_ref TEXT NOT NULL,
+    reporter_index TEXT NOT NULL DEFAULT '',
     reported_student_login TEXT NOT NULL,
     project_name TEXT NOT NULL,
     reason TEXT NOT NULL,
@@ -20,10 +51,143 @@ CREATE TABLE IF NOT EXISTS reports (
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     reviewed_at DATETIME NULL,
     reviewed_by INTEGER NULL,
-    FOREIGN KEY (reporter_id) REFERENCES users(id),
+    anonymized_at DATETIME NULL,
     FOREIGN KEY (reviewed_by) REFERENCES users(id)
 );
 
+-- Keyed hashes of the words of report explanations and their prefixes, so
+-- encrypted explanations stay searchable
+CREATE TABLE IF NOT EXISTS report_search_terms (
+    term TEXT NOT NULL,
+    report_id INTEGER NOT NULL,
+    PRIMARY KEY (term, report_id),
+    FOREIGN KEY (report_id) REFERENCES reports(id)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS idx_report_search_terms_report ON report_search_terms(report_id);
+
+-- Data keys for field encryption, wrapped by the master key (ENCRYPTION_KEY)
+CREATE TABLE IF NOT EXISTS data_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    purpose TEXT NOT NULL,
+    wrapped_key TEXT NOT NULL,
+    master_key_id TEXT NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME NOT NULL
+);
+
+-- Append-only audit log. Each entry's hash covers the previous entry's hash,
+-- so removing or editing a row breaks the chain.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TEXT NOT NULL,
+    actor_id INTEGER NULL,
+    actor_login TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL DEFAULT '',
+    target_id TEXT NOT NULL DEFAULT '',
+    details TEXT NULL,
+    ip TEXT NOT NULL DEFAULT '',
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log(action);
+CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id);
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+-- Every time a staff member reads a report, in a listing, on its own or in
+-- an export
+CREATE TABLE IF NOT EXISTS report_access_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    report_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    access_type TEXT NOT NULL,
+    ip TEXT NOT NULL DEFAULT '',
+    accessed_at DATETIME NOT NULL,
+    FOREIGN KEY (report_id) REFERENCES reports(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_report_access_report ON report_access_log(report_id, id);
+CREATE INDEX IF NOT EXISTS idx_report_access_user ON report_access_log(user_id, accessed_at);
+
+-- Staff accounts that read an unusual number of reports in a short time
+CREATE TABLE IF NOT EXISTS access_alerts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    report_count INTEGER NOT NULL,
+    window_start DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    resolved_at DATETIME NULL,
+    resolved_by INTEGER NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (resolved_by) REFERENCES users(id)
+);
+
+-- Requests to see who submitted a report, and their approval
+CREATE TABLE IF NOT EXISTS identity_reveals (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    report_id INTEGER NOT NULL,
+    requested_by INTEGER NOT NULL,
+    justification TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    decided_by INTEGER NULL,
+    decision_note TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    decided_at DATETIME NULL,
+    FOREIGN KEY (report_id) REFERENCES reports(id),
+    FOREIGN KEY (requested_by) REFERENCES users(id),
+    FOREIGN KEY (decided_by) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_identity_reveals_status ON identity_reveals(status, id);
+
+-- Legal holds on open cases: reports about login (on project_name, when
+-- set) and their reporters cannot be erased until the hold is released
+CREATE TABLE IF NOT EXISTS legal_holds (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    login TEXT NOT NULL,
+    project_name TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL,
+    created_by INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    released_by INTEGER NULL,
+    released_at DATETIME NULL,
+    FOREIGN KEY (created_by) REFERENCES users(id),
+    FOREIGN KEY (released_by) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_legal_holds_login ON legal_holds(login);
+
+-- Keyed hashes of the logins of erased users, so campus syncs do not import
+-- them again
+CREATE TABLE IF NOT EXISTS erased_subjects (
+    login_hash TEXT PRIMARY KEY,
+    erased_at DATETIME NOT NULL
+);
+
+-- Named report filters saved by staff members
+CREATE TABLE IF NOT EXISTS report_filter_presets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    filter TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    UNIQUE (user_id, name)
+);
+
 -- Staff notifications for when reports reach threshold
 CREATE TABLE IF NOT EXISTS staff_notifications (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -46,6 +210,115 @@ CREATE TABLE IF NOT EXISTS user_report_stats (
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+-- Login sessions; the cookie only carries a random token, stored here hashed
+CREATE TABLE IF NOT EXISTS sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash TEXT UNIQUE NOT NULL,
+    user_id INTEGER NOT NULL,
+    oauth_token TEXT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at DATETIME NULL,
+    expires_at DATETIME NOT NULL,
+    mfa_verified_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Authenticator app (TOTP) enrolments; the secret is field-encrypted
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INTEGER PRIMARY KEY,
+    secret TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    enabled_at DATETIME NULL,
+    last_used_step INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Hashed single-use recovery codes for users who lose their authenticator
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    used_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Accounts at identity providers (42, OIDC) that log in as a user
+CREATE TABLE IF NOT EXISTS user_identities (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_login_at DATETIME NULL,
+    UNIQUE (provider, subject),
+    UNIQUE (user_id, provider),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- API keys for service integrations; only a hash of each key is stored
+CREATE TABLE IF NOT EXISTS api_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    key_prefix TEXT NOT NULL,
+    key_hash TEXT UNIQUE NOT NULL,
+    user_id INTEGER NOT NULL,
+    scopes TEXT NOT NULL,
+    rate_limit INTEGER NOT NULL,
+    created_by INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    last_used_at DATETIME NULL,
+    last_used_ip TEXT NOT NULL DEFAULT '',
+    revoked_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (created_by) REFERENCES users(id)
+);
+
+-- Background jobs run by the in-process job runner
+CREATE TABLE IF NOT EXISTS jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,
+    params TEXT NOT NULL DEFAULT '{}',
+    lock_key TEXT NOT NULL,
+    status TEXT DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'succeeded', 'failed', 'cancelled')),
+    progress TEXT NULL,
+    result TEXT NULL,
+    error TEXT NULL,
+    requested_by TEXT NOT NULL,
+    cancel_requested BOOLEAN DEFAULT FALSE,
+    owner TEXT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    started_at DATETIME NULL,
+    finished_at DATETIME NULL,
+    heartbeat_at DATETIME NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status, id);
+
+-- One row per schedule slot, so a slot is only enqueued once across instances
+CREATE TABLE IF NOT EXISTS job_schedule_runs (
+    schedule_name TEXT NOT NULL,
+    due_at DATETIME NOT NULL,
+    job_id INTEGER NULL,
+    PRIMARY KEY (schedule_name, due_at)
+);
+
+-- Token buckets of the shared rate limiter, so instances draw from the same
+-- budget. Times are Unix seconds with a fraction; full_at is when the
+-- bucket is full again and the row can be dropped.
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    bucket_key TEXT PRIMARY KEY,
+    tokens REAL NOT NULL,
+    updated_at REAL NOT NULL,
+    full_at REAL NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_full_at ON rate_limit_buckets(full_at);
+
 -- Report reasons (predefined options)
 CREATE TABLE IF NOT EXISTS report_reasons (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
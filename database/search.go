@@ -0,0 +1,317 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"whistleblower/models"
+)
+
+// ftsIndex is an external-content FTS5 index over some columns of a table.
+// Triggers keep it in step with every write to the table, so syncs, logins
+// and manual edits are searchable straight away.
+type ftsIndex struct {
+	name     string
+	table    string
+	columns  []string
+	tokenize string
+}
+
+var ftsIndexes = []ftsIndex{
+	{
+		name:     "users_fts",
+		table:    "users",
+		columns:  []string{"login", "display_name", "email"},
+		tokenize: "unicode61 remove_diacritics 2 tokenchars '-_'",
+	},
+}
+
+// retiredFTSIndexes are indexes that must not exist anymore. reports_fts
+// held the words of report explanations in plaintext; encrypted
+// explanations are searched through report_search_terms instead.
+var retiredFTSIndexes = []ftsIndex{
+	{name: "reports_fts", table: "reports", columns: []string{"explanation"}},
+}
+
+func (idx ftsIndex) triggers() map[string]string {
+	cols := strings.Join(idx.columns, ", ")
+	newValues := "new." + strings.Join(idx.columns, ", new.")
+	oldValues := "old." + strings.Join(idx.columns, ", old.")
+
+	insert := fmt.Sprintf(`INSERT INTO %s (rowid, %s) VALUES (new.id, %s);`, idx.name, cols, newValues)
+	remove := fmt.Sprintf(`INSERT INTO %s (%s, rowid, %s) VALUES ('delete', old.id, %s);`, idx.name, idx.name, cols, oldValues)
+
+	return map[string]string{
+		idx.name + "_insert": fmt.Sprintf(`CREATE TRIGGER %s_insert AFTER INSERT ON %s BEGIN %s END`,
+			idx.name, idx.table, insert),
+		idx.name + "_delete": fmt.Sprintf(`CREATE TRIGGER %s_delete AFTER DELETE ON %s BEGIN %s END`,
+			idx.name, idx.table, remove),
+		idx.name + "_update": fmt.Sprintf(`CREATE TRIGGER %s_update AFTER UPDATE OF %s ON %s BEGIN %s %s END`,
+			idx.name, cols, idx.table, remove, insert),
+	}
+}
+
+// initSearch sets up the FTS5 indexes. FTS5 is only compiled into
+// go-sqlite3 with the sqlite_fts5 build tag; without it search falls back to
+// LIKE scans and the triggers are removed, since they would make every write
+// to the indexed tables fail.
+func (db *DB) initSearch() error {
+	// CREATE VIRTUAL TABLE IF NOT EXISTS succeeds without the module once
+	// the table exists, so ask SQLite directly.
+	var hasFTS5 bool
+	if err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&hasFTS5); err != nil {
+		return err
+	}
+	for _, idx := range retiredFTSIndexes {
+		if err := db.dropFTSIndex(idx, hasFTS5); err != nil {
+			return fmt.Errorf("%s: %w", idx.name, err)
+		}
+	}
+
+	if !hasFTS5 {
+		log.Println("Warning: SQLite was built without FTS5 (build with -tags sqlite_fts5), search falls back to LIKE")
+		for _, idx := range ftsIndexes {
+			for name := range idx.triggers() {
+				if _, err := db.Exec(`DROP TRIGGER IF EXISTS ` + name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, idx := range ftsIndexes {
+		if err := db.initFTSIndex(idx); err != nil {
+			return fmt.Errorf("%s: %w", idx.name, err)
+		}
+	}
+
+	db.fts = true
+	return nil
+}
+
+// dropFTSIndex removes an index and its triggers. The index table itself can
+// only be dropped by an SQLite build with FTS5.
+func (db *DB) dropFTSIndex(idx ftsIndex, hasFTS5 bool) error {
+	for name := range idx.triggers() {
+		if _, err := db.Exec(`DROP TRIGGER IF EXISTS ` + name); err != nil {
+			return err
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, idx.name).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	if !hasFTS5 {
+		log.Printf("Warning: %s is no longer used but can only be dropped by a build with FTS5", idx.name)
+		return nil
+	}
+
+	if _, err := db.Exec(`DROP TABLE ` + idx.name); err != nil {
+		return err
+	}
+	log.Printf("Dropped search index %s", idx.name)
+	return nil
+}
+
+func (db *DB) initFTSIndex(idx ftsIndex) error {
+	_, err := db.Exec(fmt.Sprintf(`CREATE VIRTUAL TABLE IF NOT EXISTS %s USING fts5(
+		%s,
+		content = '%s', content_rowid = 'id',
+		tokenize = "%s",
+		prefix = '2 3'
+	)`, idx.name, strings.Join(idx.columns, ", "), idx.table, idx.tokenize))
+	if err != nil {
+		return err
+	}
+
+	// A missing trigger means the index was just created, or writes
+	// happened while running without FTS5, so it has to be rebuilt.
+	rebuild := false
+	for name, query := range idx.triggers() {
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?`, name).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+		rebuild = true
+	}
+
+	if rebuild {
+		if _, err := db.Exec(fmt.Sprintf(`INSERT INTO %s (%s) VALUES ('rebuild')`, idx.name, idx.name)); err != nil {
+			return err
+		}
+		log.Printf("Rebuilt search index %s", idx.name)
+	}
+
+	return nil
+}
+
+// SearchUsers finds users by login, display name or email and returns one
+// page of results, the cursor of the next page and the total number of
+// matches. Every word of the query is matched as a prefix. An exact login
+// match comes first, then logins starting with the query, then the best
+// full-text matches.
+func (db *DB) SearchUsers(search models.UserSearch, page models.PageRequest) ([]models.StudentSearchResult, string, int, error) {
+	// Ranked results have no stable key to seek to, so the cursor holds the
+	// offset. It is tied to the query so it can't be reused for another.
+	sort := "rank:" + search.Query
+	offset := 0
+	if page.Cursor != "" {
+		if err := decodeCursor(page.Cursor, sort, &offset); err != nil {
+			return nil, "", 0, err
+		}
+	}
+
+	results := []models.StudentSearchResult{}
+	var total int
+	var err error
+	if db.fts {
+		terms := searchTerms(search.Query)
+		if len(terms) == 0 {
+			return nil, "", 0, nil
+		}
+		results, total, err = db.searchUsersFTS(search, terms, page.Limit+1, offset)
+	} else {
+		results, total, err = db.searchUsersLike(search, page.Limit+1, offset)
+	}
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	var next string
+	if len(results) > page.Limit {
+		results = results[:page.Limit]
+		next = encodeCursor(sort, offset+page.Limit)
+	}
+	return results, next, total, nil
+}
+
+// searchTerms turns free text into an FTS5 query of quoted prefix terms, so
+// user input can never be read as FTS5 syntax.
+func searchTerms(query string) string {
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_'
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		terms = append(terms, `"`+word+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// userSearchFilters returns the SQL conditions for the campus and active
+// filters on users aliased as u, and their arguments.
+func userSearchFilters(search models.UserSearch) (string, []interface{}) {
+	var where string
+	var args []interface{}
+
+	if search.CampusID > 0 {
+		where += ` AND u.campus_id = ?`
+		args = append(args, search.CampusID)
+	}
+	if search.Active != nil {
+		where += ` AND COALESCE(u.is_active, TRUE) = ?`
+		args = append(args, *search.Active)
+	}
+	return where, args
+}
+
+func (db *DB) searchUsersFTS(search models.UserSearch, terms string, limit, offset int) ([]models.StudentSearchResult, int, error) {
+	filters, filterArgs := userSearchFilters(search)
+	from := ` FROM users_fts JOIN users u ON u.id = users_fts.rowid
+		WHERE users_fts MATCH ?` + filters
+
+	args := append([]interface{}{terms}, filterArgs...)
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	// bm25 weights favour login over display name over email.
+	query := `SELECT u.login, u.email, u.display_name, u.campus_id, u.is_active` + from + `
+		ORDER BY u.login = ? COLLATE NOCASE DESC,
+			u.login LIKE ? ESCAPE '\' DESC,
+			bm25(users_fts, 10.0, 5.0, 1.0),
+			u.login
+		LIMIT ? OFFSET ?`
+
+	q := strings.TrimSpace(search.Query)
+	args = append(args, q, escapeLike(q)+"%", limit, offset)
+
+	results, err := db.queryUserSearch(query, args...)
+	return results, total, err
+}
+
+func (db *DB) searchUsersLike(search models.UserSearch, limit, offset int) ([]models.StudentSearchResult, int, error) {
+	q := strings.TrimSpace(search.Query)
+	pattern := "%" + escapeLike(q) + "%"
+
+	filters, filterArgs := userSearchFilters(search)
+	from := ` FROM users u
+		WHERE (u.login LIKE ? ESCAPE '\' OR u.display_name LIKE ? ESCAPE '\' OR u.email LIKE ? ESCAPE '\')` + filters
+
+	args := append([]interface{}{pattern, pattern, pattern}, filterArgs...)
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT u.login, u.email, u.display_name, u.campus_id, u.is_active` + from + `
+		ORDER BY u.login = ? COLLATE NOCASE DESC,
+			u.login LIKE ? ESCAPE '\' DESC,
+			u.display_name LIKE ? ESCAPE '\' DESC,
+			u.login
+		LIMIT ? OFFSET ?`
+
+	prefix := escapeLike(q) + "%"
+	args = append(args, q, prefix, prefix, limit, offset)
+
+	results, err := db.queryUserSearch(query, args...)
+	return results, total, err
+}
+
+func (db *DB) queryUserSearch(query string, args ...interface{}) ([]models.StudentSearchResult, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []models.StudentSearchResult{}
+	for rows.Next() {
+		var result models.StudentSearchResult
+		var campusID sql.NullInt64
+		var isActive sql.NullBool
+		err := rows.Scan(&result.Login, &result.Email, &result.DisplayName, &campusID, &isActive)
+		if err != nil {
+			return nil, err
+		}
+		result.CampusID = int(campusID.Int64)
+		result.IsActive = !isActive.Valid || isActive.Bool
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// escapeLike escapes LIKE wildcards so they match literally with
+// ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"whistleblower/models"
+)
+
+const sessionColumns = `id, token_hash, user_id, oauth_token, user_agent, ip_address, created_at, last_seen_at, expires_at,
+	mfa_verified_at`
+
+func scanSession(row scanner) (*models.Session, error) {
+	var session models.Session
+	var oauthToken sql.NullString
+	var lastSeen, mfaVerified sql.NullTime
+	err := row.Scan(&session.ID, &session.TokenHash, &session.UserID, &oauthToken,
+		&session.UserAgent, &session.IPAddress, &session.CreatedAt, &lastSeen, &session.ExpiresAt, &mfaVerified)
+	if err != nil {
+		return nil, err
+	}
+
+	session.OAuthToken = oauthToken.String
+	if lastSeen.Valid {
+		session.LastSeenAt = &lastSeen.Time
+	}
+	if mfaVerified.Valid {
+		session.MFAVerifiedAt = &mfaVerified.Time
+	}
+	return &session, nil
+}
+
+func (db *DB) CreateSession(session *models.Session) error {
+	query := `INSERT INTO sessions (token_hash, user_id, oauth_token, user_agent, ip_address, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	now := time.Now().UTC()
+	result, err := db.Exec(query, session.TokenHash, session.UserID, nullString(session.OAuthToken),
+		session.UserAgent, session.IPAddress, now, session.ExpiresAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	session.ID = int(id)
+	session.LastSeenAt = &now
+	return nil
+}
+
+// GetSessionByTokenHash returns the session for a cookie token hash, or
+// sql.ErrNoRows if it does not exist or has expired.
+func (db *DB) GetSessionByTokenHash(tokenHash string) (*models.Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE token_hash = ? AND expires_at > ?`
+	return scanSession(db.QueryRow(query, tokenHash, time.Now().UTC()))
+}
+
+// ListUserSessions returns a user's unexpired sessions, most recently used
+// first.
+func (db *DB) ListUserSessions(userID int) ([]models.Session, error) {
+	rows, err := db.Query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? AND expires_at > ?
+		ORDER BY COALESCE(last_seen_at, created_at) DESC, id DESC`, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession records that a session was used just now, from ip.
+func (db *DB) TouchSession(sessionID int, ip string) error {
+	_, err := db.Exec(`UPDATE sessions SET last_seen_at = ?, ip_address = ? WHERE id = ?`,
+		time.Now().UTC(), ip, sessionID)
+	return err
+}
+
+func (db *DB) UpdateSessionOAuthToken(sessionID int, oauthToken string) error {
+	_, err := db.Exec(`UPDATE sessions SET oauth_token = ? WHERE id = ?`, nullString(oauthToken), sessionID)
+	return err
+}
+
+// DeleteSession ends one of a user's sessions. It reports false if the user
+// has no session with that ID.
+func (db *DB) DeleteSession(sessionID, userID int) (bool, error) {
+	result, err := db.Exec(`DELETE FROM sessions WHERE id = ? AND user_id = ?`, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := rowsAffected(result)
+	return n > 0, err
+}
+
+// DeleteUserSessions ends all of a user's sessions except the one with ID
+// keep, which may be 0 to end them all, and returns how many were ended.
+func (db *DB) DeleteUserSessions(userID, keep int) (int, error) {
+	result, err := db.Exec(`DELETE FROM sessions WHERE user_id = ? AND id != ?`, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected(result)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"whistleblower/models"
+)
+
+// fieldTOTPSecret names the encrypted TOTP secret column.
+const fieldTOTPSecret = "user_totp.secret"
+
+// GetTOTP returns a user's authenticator enrolment, pending or enabled, or
+// sql.ErrNoRows if they have none.
+func (db *DB) GetTOTP(userID int) (*models.TOTPEnrollment, error) {
+	var t models.TOTPEnrollment
+	var secret string
+	var enabled sql.NullTime
+	err := db.QueryRow(`SELECT user_id, secret, created_at, enabled_at, last_used_step FROM user_totp
+		WHERE user_id = ?`, userID).Scan(&t.UserID, &secret, &t.CreatedAt, &enabled, &t.LastUsedStep)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Secret, err = db.openField(fieldTOTPSecret, secret); err != nil {
+		return nil, err
+	}
+	if enabled.Valid {
+		t.EnabledAt = &enabled.Time
+	}
+	return &t, nil
+}
+
+// StartTOTPEnrollment stores a new pending secret for a user, replacing a
+// pending one. It reports false, and changes nothing, if the user already
+// has an enabled authenticator.
+func (db *DB) StartTOTPEnrollment(userID int, secret string) (bool, error) {
+	sealed, err := db.sealField(fieldTOTPSecret, secret)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(`INSERT INTO user_totp (user_id, secret, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at,
+			last_used_step = 0
+		WHERE user_totp.enabled_at IS NULL`, userID, sealed, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := rowsAffected(result)
+	return n > 0, err
+}
+
+// EnableTOTP turns a pending enrolment on after its first code, at step,
+// and replaces the user's recovery codes.
+func (db *DB) EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE user_totp SET enabled_at = ?, last_used_step = ?
+		WHERE user_id = ? AND enabled_at IS NULL`, time.Now().UTC(), step, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := rowsAffected(result); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code from step was accepted. It reports false
+// if a code from that step or a later one was accepted already, which means
+// the code is being replayed.
+func (db *DB) UseTOTPStep(userID int, step int64) (bool, error) {
+	result, err := db.Exec(`UPDATE user_totp SET last_used_step = ?
+		WHERE user_id = ? AND enabled_at IS NOT NULL AND last_used_step < ?`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := rowsAffected(result)
+	return n > 0, err
+}
+
+// UseRecoveryCode spends one of a user's recovery codes. It reports false if
+// the code is not theirs or was used already.
+func (db *DB) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	result, err := db.Exec(`UPDATE recovery_codes SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`, time.Now().UTC(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := rowsAffected(result)
+	return n > 0, err
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has.
+func (db *DB) CountRecoveryCodes(userID int) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID).Scan(&n)
+	return n, err
+}
+
+// ReplaceRecoveryCodes invalidates a user's recovery codes and stores new
+// ones.
+func (db *DB) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)`,
+			userID, hash, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteTOTP removes a user's authenticator and recovery codes, and clears
+// the two-factor check of their sessions. It reports false if the user had
+// no authenticator.
+func (db *DB) DeleteTOTP(userID int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	n, err := deleteTOTP(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET mfa_verified_at = NULL WHERE user_id = ?`, userID); err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+func deleteTOTP(tx *sql.Tx, userID int) (int, error) {
+	result, err := tx.Exec(`DELETE FROM user_totp WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return 0, err
+	}
+	return rowsAffected(result)
+}
+
+// MarkSessionMFAVerified records that a session just passed a two-factor
+// check.
+func (db *DB) MarkSessionMFAVerified(sessionID int, at time.Time) error {
+	_, err := db.Exec(`UPDATE sessions SET mfa_verified_at = ? WHERE id = ?`, at.UTC(), sessionID)
+	return err
+}
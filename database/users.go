@@ -0,0 +1,78 @@
+package database
+
+import (
+	"database/sql"
+
+	"whistleblower/models"
+)
+
+const userColumns = `id, login, email, display_name, is_staff, created_at, intra_id, campus_id, is_active, role`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row scanner) (*models.User, error) {
+	var user models.User
+	var intraID, campusID sql.NullInt64
+	var isActive sql.NullBool
+
+	err := row.Scan(
+		&user.ID, &user.Login, &user.Email,
+		&user.DisplayName, &user.IsStaff, &user.CreatedAt,
+		&intraID, &campusID, &isActive, &user.Role,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	user.IntraID = int(intraID.Int64)
+	user.CampusID = int(campusID.Int64)
+	user.IsActive = !isActive.Valid || isActive.Bool
+
+	return &user, nil
+}
+
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
+
+// SetUserRole changes a user's role, keeping is_staff in line with it, and
+// returns the role the user had before. When the change takes rights away,
+// the user's sessions are ended too, so they have to log in again under the
+// new role; sessionsEnded says how many.
+func (db *DB) SetUserRole(login, role string) (previous string, sessionsEnded int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(`SELECT id, role FROM users WHERE login = ?`, login).Scan(&userID, &previous)
+	if err != nil {
+		return "", 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET role = ?, is_staff = ?, updated_at = CURRENT_TIMESTAMP WHERE login = ?`,
+		role, role != models.RoleStudent, login)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if models.RoleRank(role) < models.RoleRank(previous) {
+		result, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+		if err != nil {
+			return "", 0, err
+		}
+		if sessionsEnded, err = rowsAffected(result); err != nil {
+			return "", 0, err
+		}
+	}
+
+	return previous, sessionsEnded, tx.Commit()
+}
+
+func (db *DB) GetUserByID(id int) (*models.User, error) {
+	return scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
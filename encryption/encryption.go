@@ -0,0 +1,194 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	KeySize = 32
+
+	versionPrefix = "v1."
+)
+
+// Cipher encrypts small values such as OAuth tokens with AES-256-GCM before
+// they are written to the database. It is also the master key that wraps
+// the data keys of a Keyring.
+type Cipher struct {
+	aead  cipher.AEAD
+	keyID string
+
+	// previous holds retired keys, which still decrypt during a key
+	// rotation but never encrypt.
+	previous []*Cipher
+
+	ephemeral bool
+}
+
+func NewCipher(key []byte) (*Cipher, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+
+	sum := sha256.Sum256(key)
+	return &Cipher{aead: aead, keyID: hex.EncodeToString(sum[:4])}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// KeyID identifies the key without revealing it, so stored values can record
+// which master key protects them.
+func (c *Cipher) KeyID() string {
+	return c.keyID
+}
+
+// Ephemeral reports whether the key was generated at startup because none
+// was configured, so nothing it encrypts survives a restart.
+func (c *Cipher) Ephemeral() bool {
+	return c.ephemeral
+}
+
+// FromEnv loads the key from ENCRYPTION_KEY (base64) or ENCRYPTION_KEY_FILE.
+// Without either, a random key is generated: encrypted values then only
+// survive until the next restart, which is fine for development but not for
+// production.
+//
+// During a key rotation ENCRYPTION_KEY_PREVIOUS holds the retired keys,
+// comma separated, so values they encrypted can still be read.
+func FromEnv() (*Cipher, error) {
+	c, err := currentKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, encoded := range strings.Split(os.Getenv("ENCRYPTION_KEY_PREVIOUS"), ",") {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("previous encryption key is not valid base64: %w", err)
+		}
+		previous, err := NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("previous %w", err)
+		}
+		c.previous = append(c.previous, previous)
+	}
+
+	return c, nil
+}
+
+func currentKeyFromEnv() (*Cipher, error) {
+	encoded := os.Getenv("ENCRYPTION_KEY")
+
+	if encoded == "" {
+		if path := os.Getenv("ENCRYPTION_KEY_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+			}
+			encoded = strings.TrimSpace(string(data))
+		}
+	}
+
+	if encoded == "" {
+		log.Printf("Warning: ENCRYPTION_KEY not set, using an ephemeral key; stored tokens will not survive a restart")
+		key := make([]byte, KeySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		c, err := NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		c.ephemeral = true
+		return c, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %w", err)
+	}
+
+	return NewCipher(key)
+}
+
+func (c *Cipher) Encrypt(plaintext []byte) (string, error) {
+	sealed, err := seal(c.aead, plaintext, nil)
+	if err != nil {
+		return "", err
+	}
+	return versionPrefix + sealed, nil
+}
+
+// Decrypt opens a value encrypted with the current key or, during a
+// rotation, one of the previous keys.
+func (c *Cipher) Decrypt(value string) ([]byte, error) {
+	if !strings.HasPrefix(value, versionPrefix) {
+		return nil, errors.New("unsupported ciphertext format")
+	}
+
+	plaintext, err := open(c.aead, strings.TrimPrefix(value, versionPrefix), nil)
+	for _, previous := range c.previous {
+		if err == nil {
+			break
+		}
+		plaintext, err = open(previous.aead, strings.TrimPrefix(value, versionPrefix), nil)
+	}
+	return plaintext, err
+}
+
+// seal encrypts plaintext under a fresh random nonce and returns the nonce
+// and ciphertext together, base64 encoded.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, additionalData)
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func open(aead cipher.AEAD, encoded string, additionalData []byte) ([]byte, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,239 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Envelope encryption: database fields are encrypted with data keys, and the
+// data keys are stored in the database wrapped (encrypted) by the master key
+// from the environment. Rotating the master key only rewraps the data keys;
+// rotating a data key starts encrypting new values with a fresh key while
+// older values stay readable until they are re-encrypted.
+
+// Purposes of the keys a Keyring keeps.
+const (
+	PurposeData  = "data"
+	PurposeIndex = "index"
+)
+
+// fieldPrefix starts every value sealed by a Keyring. It is followed by the
+// data key ID, a dot and the base64 nonce and ciphertext.
+const fieldPrefix = "v2."
+
+// WrappedKey is a data key as stored, encrypted by the master key.
+type WrappedKey struct {
+	ID          int
+	Purpose     string
+	Wrapped     string
+	MasterKeyID string
+	Active      bool
+	CreatedAt   time.Time
+}
+
+// KeyStore persists the wrapped keys of a Keyring.
+type KeyStore interface {
+	LoadDataKeys() ([]WrappedKey, error)
+	// AddDataKey stores a new key and fills in its ID. An active key
+	// replaces the active key of the same purpose.
+	AddDataKey(key *WrappedKey) error
+	UpdateWrappedKeys(keys []WrappedKey) error
+}
+
+// Keyring encrypts database fields with the active data key and decrypts
+// them with whichever data key sealed them. It also computes blind indexes:
+// keyed hashes that allow equality lookups on encrypted values.
+type Keyring struct {
+	master *Cipher
+	store  KeyStore
+
+	keys     map[int]cipher.AEAD
+	active   int
+	indexKey []byte
+}
+
+// OpenKeyring unwraps the stored data keys with master, creating the first
+// data and index keys on first use. Keys still wrapped by a previous master
+// key are rewrapped with the current one. created reports whether a new
+// index key was made, in which case existing blind indexes are stale.
+func OpenKeyring(master *Cipher, store KeyStore) (k *Keyring, created bool, err error) {
+	stored, err := store.LoadDataKeys()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load data keys: %w", err)
+	}
+
+	k = &Keyring{master: master, store: store, keys: map[int]cipher.AEAD{}}
+
+	var rewrap []WrappedKey
+	for _, wk := range stored {
+		key, err := master.Decrypt(wk.Wrapped)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to unwrap data key %d (wrapped by master key %s): %w",
+				wk.ID, wk.MasterKeyID, err)
+		}
+
+		if wk.MasterKeyID != master.KeyID() {
+			if wk.Wrapped, err = master.Encrypt(key); err != nil {
+				return nil, false, err
+			}
+			wk.MasterKeyID = master.KeyID()
+			rewrap = append(rewrap, wk)
+		}
+
+		switch wk.Purpose {
+		case PurposeIndex:
+			if wk.Active {
+				k.indexKey = key
+			}
+		default:
+			aead, err := newAEAD(key)
+			if err != nil {
+				return nil, false, fmt.Errorf("data key %d: %w", wk.ID, err)
+			}
+			k.keys[wk.ID] = aead
+			if wk.Active {
+				k.active = wk.ID
+			}
+		}
+	}
+
+	if len(rewrap) > 0 {
+		if err := store.UpdateWrappedKeys(rewrap); err != nil {
+			return nil, false, fmt.Errorf("failed to rewrap data keys: %w", err)
+		}
+		log.Printf("Rewrapped %d data keys with master key %s", len(rewrap), master.KeyID())
+	}
+
+	if k.active == 0 {
+		if _, err := k.RotateDataKey(); err != nil {
+			return nil, false, err
+		}
+	}
+	if k.indexKey == nil {
+		key, err := k.addKey(PurposeIndex)
+		if err != nil {
+			return nil, false, err
+		}
+		k.indexKey = key
+		created = true
+	}
+
+	return k, created, nil
+}
+
+// RotateDataKey makes a new data key the one new values are encrypted with
+// and returns its ID. Values sealed with older keys stay readable.
+func (k *Keyring) RotateDataKey() (int, error) {
+	key, err := k.addKey(PurposeData)
+	if err != nil {
+		return 0, err
+	}
+
+	// addKey made the new key the active one.
+	aead, err := newAEAD(key)
+	if err != nil {
+		return 0, err
+	}
+	k.keys[k.active] = aead
+	return k.active, nil
+}
+
+func (k *Keyring) addKey(purpose string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := k.master.Encrypt(key)
+	if err != nil {
+		return nil, err
+	}
+
+	wk := &WrappedKey{
+		Purpose:     purpose,
+		Wrapped:     wrapped,
+		MasterKeyID: k.master.KeyID(),
+		Active:      true,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := k.store.AddDataKey(wk); err != nil {
+		return nil, fmt.Errorf("failed to store %s key: %w", purpose, err)
+	}
+	if purpose == PurposeData {
+		k.active = wk.ID
+	}
+	return key, nil
+}
+
+// ActiveKeyID is the ID of the data key new values are encrypted with.
+func (k *Keyring) ActiveKeyID() int {
+	return k.active
+}
+
+// Encrypt seals plaintext for the named field. The field name is bound to
+// the ciphertext, so a value copied into another column fails to decrypt.
+func (k *Keyring) Encrypt(field, plaintext string) (string, error) {
+	sealed, err := seal(k.keys[k.active], []byte(plaintext), []byte(field))
+	if err != nil {
+		return "", err
+	}
+	return fieldPrefix + strconv.Itoa(k.active) + "." + sealed, nil
+}
+
+// Decrypt opens a value Encrypt sealed for the same field.
+func (k *Keyring) Decrypt(field, value string) (string, error) {
+	id, ok := SealedKeyID(value)
+	if !ok {
+		return "", fmt.Errorf("%s: value is not encrypted", field)
+	}
+
+	aead, ok := k.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%s: unknown data key %d", field, id)
+	}
+
+	_, sealed, _ := strings.Cut(strings.TrimPrefix(value, fieldPrefix), ".")
+	plaintext, err := open(aead, sealed, []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", field, err)
+	}
+	return string(plaintext), nil
+}
+
+// SealedKeyID returns the ID of the data key a Keyring value was sealed
+// with, and false for values that are not sealed.
+func SealedKeyID(value string) (int, bool) {
+	if !strings.HasPrefix(value, fieldPrefix) {
+		return 0, false
+	}
+	idPart, _, ok := strings.Cut(strings.TrimPrefix(value, fieldPrefix), ".")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(idPart)
+	return id, err == nil
+}
+
+// BlindIndex returns the keyed hash of value for lookups on the named
+// field.
+func (k *Keyring) BlindIndex(field, value string) string {
+	return BlindIndex(k.indexKey, field, value)
+}
+
+// BlindIndex hashes value for the named field with HMAC-SHA256. Without a
+// key the hash still allows lookups but can be recomputed by anyone, which
+// only suits databases that store the values in plaintext anyway.
+func BlindIndex(key []byte, field, value string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d:%s;%s", len(field), field, value)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,155 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// memoryKeyStore keeps wrapped keys in memory.
+type memoryKeyStore struct {
+	keys []WrappedKey
+}
+
+func (s *memoryKeyStore) LoadDataKeys() ([]WrappedKey, error) {
+	return append([]WrappedKey(nil), s.keys...), nil
+}
+
+func (s *memoryKeyStore) AddDataKey(key *WrappedKey) error {
+	for i := range s.keys {
+		if s.keys[i].Purpose == key.Purpose && key.Active {
+			s.keys[i].Active = false
+		}
+	}
+	key.ID = len(s.keys) + 1
+	s.keys = append(s.keys, *key)
+	return nil
+}
+
+func (s *memoryKeyStore) UpdateWrappedKeys(keys []WrappedKey) error {
+	for _, key := range keys {
+		s.keys[key.ID-1] = key
+	}
+	return nil
+}
+
+func masterKey(t *testing.T, b byte) string {
+	t.Helper()
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, KeySize))
+}
+
+// tamper changes one character in the middle of a sealed value; the last
+// one may only carry padding bits.
+func tamper(sealed string) string {
+	i := len(sealed) - 8
+	c := byte('A')
+	if sealed[i] == c {
+		c = 'B'
+	}
+	return sealed[:i] + string(c) + sealed[i+1:]
+}
+
+func openTestKeyring(t *testing.T, store KeyStore, current string, previous ...string) *Keyring {
+	t.Helper()
+	t.Setenv("ENCRYPTION_KEY", current)
+	t.Setenv("ENCRYPTION_KEY_PREVIOUS", strings.Join(previous, ","))
+	master, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _, err := OpenKeyring(master, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k := openTestKeyring(t, &memoryKeyStore{}, masterKey(t, 1))
+	sealed, err := k.Encrypt("explanation", "copied ft_split")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		field   string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"same field", "explanation", sealed, "copied ft_split", false},
+		{"other field", "reporter_ref", sealed, "", true},
+		{"tampered", "explanation", tamper(sealed), "", true},
+		{"plaintext", "explanation", "copied ft_split", "", true},
+		{"unknown key", "explanation", strings.Replace(sealed, fieldPrefix+"1.", fieldPrefix+"99.", 1), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := k.Decrypt(tt.field, tt.value)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("Decrypt(%q) = %q, %v; want %q, error %v", tt.field, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	store := &memoryKeyStore{}
+	oldMaster, newMaster := masterKey(t, 1), masterKey(t, 2)
+
+	k := openTestKeyring(t, store, oldMaster)
+	before, _ := k.Encrypt("explanation", "before")
+	index := k.BlindIndex("reporter", "42")
+
+	// A new data key seals new values; the old one still opens old ones.
+	oldID := k.ActiveKeyID()
+	newID, err := k.RotateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == oldID {
+		t.Fatalf("RotateDataKey kept key %d", oldID)
+	}
+	after, _ := k.Encrypt("explanation", "after")
+	if id, _ := SealedKeyID(after); id != newID {
+		t.Errorf("new value sealed with key %d, want %d", id, newID)
+	}
+
+	// A new master key rewraps the data keys, with the old one as previous.
+	k = openTestKeyring(t, store, newMaster, oldMaster)
+	for _, wk := range store.keys {
+		if wk.MasterKeyID != k.master.KeyID() {
+			t.Errorf("key %d still wrapped by %s", wk.ID, wk.MasterKeyID)
+		}
+	}
+
+	// Once rewrapped, the old master key is no longer needed.
+	k = openTestKeyring(t, store, newMaster)
+	tests := []struct {
+		value, want string
+	}{
+		{before, "before"},
+		{after, "after"},
+	}
+	for _, tt := range tests {
+		if got, err := k.Decrypt("explanation", tt.value); err != nil || got != tt.want {
+			t.Errorf("Decrypt after rotation = %q, %v; want %q", got, err, tt.want)
+		}
+	}
+	if k.ActiveKeyID() != newID {
+		t.Errorf("active key %d after reopening, want %d", k.ActiveKeyID(), newID)
+	}
+	if got := k.BlindIndex("reporter", "42"); got != index {
+		t.Errorf("blind index changed across rotation: %s, want %s", got, index)
+	}
+
+	// Without the master key that wraps them, the keys cannot be opened.
+	t.Setenv("ENCRYPTION_KEY", masterKey(t, 3))
+	t.Setenv("ENCRYPTION_KEY_PREVIOUS", "")
+	master, _ := FromEnv()
+	if _, _, err := OpenKeyring(master, store); err == nil {
+		t.Error("OpenKeyring with the wrong master key succeeded")
+	}
+}
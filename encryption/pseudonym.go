@@ -0,0 +1,72 @@
+package encryption
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Pseudonymizer derives stable pseudonyms with HMAC-SHA256, so the same
+// inputs always give the same pseudonym while the key stays secret, and
+// pseudonyms cannot be reversed or recomputed without it.
+type Pseudonymizer struct {
+	key []byte
+}
+
+func NewPseudonymizer(key []byte) (*Pseudonymizer, error) {
+	if len(key) < KeySize {
+		return nil, fmt.Errorf("pseudonym key must be at least %d bytes, got %d", KeySize, len(key))
+	}
+	return &Pseudonymizer{key: key}, nil
+}
+
+// PseudonymizerFromEnv loads the key from PSEUDONYM_KEY (base64) or
+// PSEUDONYM_KEY_FILE. Without either, a random key is generated and
+// pseudonyms change on every restart.
+func PseudonymizerFromEnv() (*Pseudonymizer, error) {
+	encoded := os.Getenv("PSEUDONYM_KEY")
+
+	if encoded == "" {
+		if path := os.Getenv("PSEUDONYM_KEY_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read pseudonym key file: %w", err)
+			}
+			encoded = strings.TrimSpace(string(data))
+		}
+	}
+
+	if encoded == "" {
+		log.Printf("Warning: PSEUDONYM_KEY not set, using an ephemeral key; reporter pseudonyms will change on restart")
+		key := make([]byte, KeySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		return NewPseudonymizer(key)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("pseudonym key is not valid base64: %w", err)
+	}
+
+	return NewPseudonymizer(key)
+}
+
+// Pseudonym returns a short pseudonym for parts, such as a reporter and the
+// case they reported in. Parts are length-prefixed so ("ab", "c") and
+// ("a", "bc") differ.
+func (p *Pseudonymizer) Pseudonym(prefix string, parts ...string) string {
+	mac := hmac.New(sha256.New, p.key)
+	for _, part := range parts {
+		fmt.Fprintf(mac, "%d:%s;", len(part), part)
+	}
+	return prefix + "-" + hex.EncodeToString(mac.Sum(nil)[:5])
+}
@@ -0,0 +1,375 @@
+// Package fakeintra is a small stand-in for the 42 intra API used for
+// offline development and demos. It serves OAuth and the handful of /v2
+// endpoints the application calls, backed by JSON fixture files.
+package fakeintra
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const tokenLifetime = 2 * time.Hour
+
+type fixtureUser struct {
+	ID          int       `json:"id"`
+	Login       string    `json:"login"`
+	Email       string    `json:"email"`
+	DisplayName string    `json:"displayname"`
+	CampusID    int       `json:"campus_id"`
+	Staff       bool      `json:"staff?"`
+	Active      bool      `json:"active?"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type Server struct {
+	users    []fixtureUser
+	projects map[string][]string
+	campuses []map[string]interface{}
+
+	mu      sync.Mutex
+	codes   map[string]string
+	tokens  map[string]string
+	refresh map[string]string
+}
+
+// NewServer loads users.json and projects_users.json from fixturesDir and the
+// campus list from campusesFile (normally all_campuses.json).
+func NewServer(fixturesDir, campusesFile string) (*Server, error) {
+	s := &Server{
+		codes:   make(map[string]string),
+		tokens:  make(map[string]string),
+		refresh: make(map[string]string),
+	}
+
+	if err := readJSON(filepath.Join(fixturesDir, "users.json"), &s.users); err != nil {
+		return nil, err
+	}
+	if err := readJSON(filepath.Join(fixturesDir, "projects_users.json"), &s.projects); err != nil {
+		return nil, err
+	}
+	if err := readJSON(campusesFile, &s.campuses); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(s.users, func(i, j int) bool { return s.users[i].ID < s.users[j].ID })
+
+	return s, nil
+}
+
+func readJSON(path string, out interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read fixture: %w", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to parse fixture %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *Server) Handler() http.Handler {
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	r.GET("/oauth/authorize", s.authorize)
+	r.POST("/oauth/token", s.token)
+
+	v2 := r.Group("/v2", s.requireToken)
+	{
+		v2.GET("/me", s.me)
+		v2.GET("/users", s.searchUsers)
+		v2.GET("/users/:login/projects_users", s.projectsUsers)
+		v2.GET("/campus", s.listCampuses)
+		v2.GET("/campus/:id/users", s.campusUsers)
+	}
+
+	return r
+}
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html><head><title>Fake 42 intra</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto;">
+<h1>Fake 42 intra</h1>
+<p>Development mode: pick the user to log in as.</p>
+<ul>
+{{range .Users}}<li><a href="{{$.Base}}&login={{.Login}}">{{.Login}}</a> - {{.DisplayName}}{{if .Staff}} (staff){{end}}</li>
+{{end}}</ul>
+</body></html>`))
+
+func (s *Server) authorize(c *gin.Context) {
+	redirectURI := c.Query("redirect_uri")
+	if redirectURI == "" {
+		c.String(http.StatusBadRequest, "missing redirect_uri")
+		return
+	}
+
+	login := c.Query("login")
+	if login == "" {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		authorizePage.Execute(c.Writer, gin.H{
+			"Base":  template.URL(c.Request.URL.RequestURI()),
+			"Users": s.users,
+		})
+		return
+	}
+
+	if s.userByLogin(login) == nil {
+		c.String(http.StatusBadRequest, "unknown fixture user")
+		return
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = login
+	s.mu.Unlock()
+
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid redirect_uri")
+		return
+	}
+	query := target.Query()
+	query.Set("code", code)
+	query.Set("state", c.Query("state"))
+	target.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusFound, target.String())
+}
+
+func (s *Server) token(c *gin.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var login string
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		var ok bool
+		if login, ok = s.codes[c.PostForm("code")]; !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_grant"})
+			return
+		}
+		delete(s.codes, c.PostForm("code"))
+	case "refresh_token":
+		var ok bool
+		if login, ok = s.refresh[c.PostForm("refresh_token")]; !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_grant"})
+			return
+		}
+		delete(s.refresh, c.PostForm("refresh_token"))
+	case "client_credentials":
+		// App tokens are not tied to a user.
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+		return
+	}
+
+	accessToken := randomString()
+	s.tokens[accessToken] = login
+
+	response := gin.H{
+		"access_token": accessToken,
+		"token_type":   "bearer",
+		"expires_in":   int(tokenLifetime.Seconds()),
+		"scope":        "public",
+		"created_at":   time.Now().Unix(),
+	}
+	if login != "" {
+		refreshToken := randomString()
+		s.refresh[refreshToken] = login
+		response["refresh_token"] = refreshToken
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) requireToken(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	s.mu.Lock()
+	login, ok := s.tokens[token]
+	s.mu.Unlock()
+
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	c.Set("login", login)
+	c.Header("X-Secondly-RateLimit-Limit", "2")
+	c.Header("X-Hourly-RateLimit-Limit", "1200")
+	c.Next()
+}
+
+func (s *Server) me(c *gin.Context) {
+	user := s.userByLogin(c.GetString("login"))
+	if user == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "App tokens have no resource owner"})
+		return
+	}
+	// Like the intra, /v2/me also lists the user's campuses.
+	c.JSON(http.StatusOK, struct {
+		fixtureUser
+		CampusUsers []gin.H `json:"campus_users"`
+	}{*user, []gin.H{{"campus_id": user.CampusID, "is_primary": true}}})
+}
+
+func (s *Server) searchUsers(c *gin.Context) {
+	query := strings.ToLower(c.Query("search[login]"))
+
+	var results []fixtureUser
+	for _, user := range s.users {
+		if query == "" || strings.Contains(user.Login, query) {
+			results = append(results, user)
+		}
+	}
+
+	paginate(c, results)
+}
+
+func (s *Server) projectsUsers(c *gin.Context) {
+	login := c.Param("login")
+	if s.userByLogin(login) == nil {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	var results []gin.H
+	for i, name := range s.projects[login] {
+		results = append(results, gin.H{
+			"id":      i + 1,
+			"status":  "finished",
+			"project": gin.H{"name": name, "slug": strings.ToLower(name)},
+		})
+	}
+
+	paginate(c, results)
+}
+
+func (s *Server) listCampuses(c *gin.Context) {
+	paginate(c, s.campuses)
+}
+
+func (s *Server) campusUsers(c *gin.Context) {
+	campusID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	from, to, err := parseRange(c.Query("range[updated_at]"))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	var results []fixtureUser
+	for _, user := range s.users {
+		if user.CampusID != campusID {
+			continue
+		}
+		if !from.IsZero() && user.UpdatedAt.Before(from) {
+			continue
+		}
+		if !to.IsZero() && user.UpdatedAt.After(to) {
+			continue
+		}
+		results = append(results, user)
+	}
+	if c.Query("sort") == "updated_at,id" {
+		sort.SliceStable(results, func(i, j int) bool {
+			if !results[i].UpdatedAt.Equal(results[j].UpdatedAt) {
+				return results[i].UpdatedAt.Before(results[j].UpdatedAt)
+			}
+			return results[i].ID < results[j].ID
+		})
+	}
+
+	paginate(c, results)
+}
+
+func (s *Server) userByLogin(login string) *fixtureUser {
+	for i := range s.users {
+		if s.users[i].Login == login {
+			return &s.users[i]
+		}
+	}
+	return nil
+}
+
+// parseRange reads intra's "from,to" range syntax.
+func parseRange(value string) (time.Time, time.Time, error) {
+	var from, to time.Time
+	if value == "" {
+		return from, to, nil
+	}
+
+	parts := strings.SplitN(value, ",", 2)
+	if len(parts) != 2 {
+		return from, to, fmt.Errorf("range must be from,to")
+	}
+
+	var err error
+	if parts[0] != "" {
+		if from, err = time.Parse(time.RFC3339, parts[0]); err != nil {
+			return from, to, err
+		}
+	}
+	if parts[1] != "" {
+		if to, err = time.Parse(time.RFC3339, parts[1]); err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
+
+// paginate writes one page of items with intra's page/per_page semantics and
+// X-Total/X-Page/X-Per-Page headers.
+func paginate[T any](c *gin.Context, items []T) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "30"))
+	if perPage < 1 || perPage > 100 {
+		perPage = 30
+	}
+
+	c.Header("X-Total", strconv.Itoa(len(items)))
+	c.Header("X-Page", strconv.Itoa(page))
+	c.Header("X-Per-Page", strconv.Itoa(perPage))
+
+	start := (page - 1) * perPage
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + perPage
+	if end > len(items) {
+		end = len(items)
+	}
+
+	pageItems := items[start:end]
+	if pageItems == nil {
+		pageItems = []T{}
+	}
+	c.JSON(http.StatusOK, pageItems)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/models"
+)
+
+// recordReportAccess logs that user read the given reports and raises an
+// access alert when the user's recent volume crosses the threshold. Like
+// audit, failures are logged and do not fail the request.
+func (h *Handler) recordReportAccess(c *gin.Context, user *models.User, reportIDs []int, accessType string) {
+	if err := h.db.RecordReportAccess(user.ID, reportIDs, accessType, c.ClientIP()); err != nil {
+		log.Printf("Failed to record %s access of %d reports by %s: %v", accessType, len(reportIDs), user.Login, err)
+		return
+	}
+
+	windowStart := time.Now().Add(-h.cfg.AccessAlertWindow)
+	count, err := h.db.CountReportsAccessedSince(user.ID, windowStart)
+	if err != nil {
+		log.Printf("Failed to count report accesses by %s: %v", user.Login, err)
+		return
+	}
+	if count <= h.cfg.AccessAlertThreshold {
+		return
+	}
+
+	alert, created, err := h.db.RaiseAccessAlert(user.ID, count, windowStart)
+	if err != nil {
+		log.Printf("Failed to raise access alert for %s: %v", user.Login, err)
+		return
+	}
+	if !created {
+		return
+	}
+
+	log.Printf("ALERT: %s read %d reports in the last %s", user.Login, count, h.cfg.AccessAlertWindow)
+	h.audit(c, user, models.AuditAccessAlert, "user", user.Login, gin.H{
+		"alert_id":     alert.ID,
+		"report_count": count,
+		"window":       h.cfg.AccessAlertWindow.String(),
+	})
+}
+
+// GetReportAccess shows a campus admin who read a report: a summary per
+// staff member under viewers, and the raw access log, newest first and
+// paginated, under accesses.
+func (h *Handler) GetReportAccess(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report ID"})
+		return
+	}
+
+	report, err := h.db.GetReport(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get report"})
+		return
+	}
+
+	// Admins tied to a campus only see reports about students of that campus.
+	if admin.CampusID != 0 {
+		student, err := h.db.GetUserByLogin(report.ReportedStudentLogin)
+		if err == nil && student.CampusID != 0 && student.CampusID != admin.CampusID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+			return
+		}
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	accesses, next, err := h.db.ListReportAccess(report.ID, page)
+	if err != nil {
+		respondListError(c, err, "Failed to get report access log")
+		return
+	}
+
+	viewers, err := h.db.GetReportViewers(report.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get report access log"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditLogView, "report", strconv.Itoa(report.ID), gin.H{"view": "report_access"})
+
+	c.JSON(http.StatusOK, gin.H{
+		"report_id":   report.ID,
+		"viewers":     viewers,
+		"accesses":    accesses,
+		"limit":       page.Limit,
+		"next_cursor": next,
+	})
+}
+
+// ListAccessAlerts lists unresolved access alerts, or all of them with
+// all=true, newest first.
+func (h *Handler) ListAccessAlerts(c *gin.Context) {
+	if _, ok := h.requireAdmin(c); !ok {
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	alerts, next, err := h.db.ListAccessAlerts(c.Query("all") == "true", page)
+	if err != nil {
+		respondListError(c, err, "Failed to get access alerts")
+		return
+	}
+
+	respondPage(c, "alerts", alerts, page, next, -1)
+}
+
+func (h *Handler) ResolveAccessAlert(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert ID"})
+		return
+	}
+
+	resolved, err := h.db.ResolveAccessAlert(id, admin.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve access alert"})
+		return
+	}
+	if !resolved {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No unresolved alert with that ID"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditAlertResolve, "access_alert", strconv.Itoa(id), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Access alert resolved"})
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/auth"
+	"whistleblower/models"
+	"whistleblower/ratelimit"
+)
+
+// API keys look like wbk_<43 random characters>. The first characters are
+// kept in clear as the key's prefix, so admins can tell keys apart.
+const (
+	apiKeyMarker      = "wbk_"
+	apiKeyPrefixLen   = len(apiKeyMarker) + 8
+	apiKeyDefaultTTL  = 90 * 24 * time.Hour
+	apiKeyDefaultRate = 60
+)
+
+// apiKeyTouchInterval is how often a key's last use is written back.
+const apiKeyTouchInterval = time.Minute
+
+// apiKeyScopes maps the routes API keys may call to the scope each needs.
+// Every other route refuses API keys.
+var apiKeyScopes = map[string]string{
+	"GET /api/stats":               models.ScopeStatsRead,
+	"GET /api/staff/project-stats": models.ScopeStatsRead,
+	"GET /api/report-reasons":      models.ScopeReportsCreate,
+	"GET /api/students/search":     models.ScopeReportsCreate,
+	"POST /api/reports":            models.ScopeReportsCreate,
+	"GET /api/campuses":            models.ScopeSyncRun,
+	"POST /api/sync-users":         models.ScopeSyncRun,
+	"GET /api/jobs/:id":            models.ScopeSyncRun,
+}
+
+// APIKeyAuth authenticates requests that carry an API key in an
+// "Authorization: Bearer" header. The request then acts as the key's owner,
+// with cookies ignored, and may only call routes the key's scopes cover, at
+// most the key's rate limit per minute. Requests without the header pass
+// through to the session cookie.
+func (h *Handler) APIKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found || !strings.HasPrefix(token, apiKeyMarker) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization must be Bearer <API key>"})
+			return
+		}
+
+		key, err := h.db.GetAPIKeyByHash(auth.HashAPIKey(token))
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid, expired or revoked API key"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+			return
+		}
+
+		user, err := h.db.GetUserByID(key.UserID)
+		if err != nil || !user.IsActive {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "The API key's user no longer exists or is inactive"})
+			return
+		}
+
+		scope, ok := apiKeyScopes[c.Request.Method+" "+c.FullPath()]
+		if !ok || !slices.Contains(key.Scopes, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "The API key does not grant access to this endpoint"})
+			return
+		}
+
+		policy := ratelimit.Policy{Limit: key.RateLimit, Period: time.Minute}
+		if !h.takeRateLimit(c, "api-key|"+strconv.Itoa(key.ID), policy) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "API key rate limit exceeded"})
+			return
+		}
+
+		ip := c.ClientIP()
+		if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > apiKeyTouchInterval || key.LastUsedIP != ip {
+			if err := h.db.TouchAPIKey(key.ID, ip); err != nil {
+				log.Printf("Failed to update API key %d: %v", key.ID, err)
+			}
+		}
+
+		c.Set(requestAuthKey, &requestAuth{apiKey: key, user: user})
+		c.Next()
+	}
+}
+
+// currentAPIKey returns the API key the request authenticated with, if any.
+func (h *Handler) currentAPIKey(c *gin.Context) *models.APIKey {
+	if cached, ok := c.Get(requestAuthKey); ok {
+		return cached.(*requestAuth).apiKey
+	}
+	return nil
+}
+
+// ListAPIKeys lists usable API keys, or all of them with all=true, newest
+// first.
+func (h *Handler) ListAPIKeys(c *gin.Context) {
+	if _, ok := h.requireAdmin(c); !ok {
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	keys, next, err := h.db.ListAPIKeys(c.Query("all") == "true", page)
+	if err != nil {
+		respondListError(c, err, "Failed to get API keys")
+		return
+	}
+
+	respondPage(c, "api_keys", keys, page, next, -1)
+}
+
+// CreateAPIKey issues an API key. The key itself is only in this response;
+// the database keeps its hash.
+func (h *Handler) CreateAPIKey(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	owner := admin
+	if req.Login != "" && req.Login != admin.Login {
+		var err error
+		owner, err = h.db.GetUserByLogin(req.Login)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+			return
+		}
+	}
+
+	ttl := apiKeyDefaultTTL
+	if req.ExpiresInDays > 0 {
+		ttl = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+	rate := apiKeyDefaultRate
+	if req.RateLimit > 0 {
+		rate = req.RateLimit
+	}
+
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+
+	secret := generateAPIKey()
+	key := &models.APIKey{
+		Name:      req.Name,
+		Prefix:    secret[:apiKeyPrefixLen],
+		KeyHash:   auth.HashAPIKey(secret),
+		UserID:    owner.ID,
+		Login:     owner.Login,
+		Scopes:    slices.Compact(scopes),
+		RateLimit: rate,
+		CreatedBy: admin.ID,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	}
+	if err := h.db.CreateAPIKey(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditAPIKeyCreate, "api_key", strconv.Itoa(key.ID), gin.H{
+		"name":       key.Name,
+		"login":      key.Login,
+		"scopes":     key.Scopes,
+		"rate_limit": key.RateLimit,
+		"expires_at": key.ExpiresAt,
+	})
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key": key,
+		"key":     secret,
+		"message": "Store the key now; it cannot be shown again",
+	})
+}
+
+func (h *Handler) RevokeAPIKey(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	revoked, err := h.db.RevokeAPIKey(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No unrevoked API key with that ID"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditAPIKeyRevoke, "api_key", strconv.Itoa(id), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+func generateAPIKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return apiKeyMarker + base64.RawURLEncoding.EncodeToString(b)
+}
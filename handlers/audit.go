@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/models"
+)
+
+// audit appends an entry for a privileged action to the audit log. actor may
+// be nil for actions taken before anyone is logged in. A failed write is
+// logged rather than failing the request, which has already taken effect.
+func (h *Handler) audit(c *gin.Context, actor *models.User, action, targetType, targetID string, details interface{}) {
+	entry := &models.AuditEntry{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         c.ClientIP(),
+	}
+	if actor != nil {
+		entry.ActorID = &actor.ID
+		entry.ActorLogin = actor.Login
+	}
+	if details != nil {
+		data, err := json.Marshal(details)
+		if err != nil {
+			log.Printf("audit: failed to encode details of %s: %v", action, err)
+		}
+		entry.Details = data
+	}
+
+	if err := h.db.AppendAuditEntry(entry); err != nil {
+		log.Printf("audit: failed to record %s by %q: %v", action, entry.ActorLogin, err)
+	}
+}
+
+// ListAuditLog pages through the audit log for admins, newest first, filtered
+// by actor, action, target_type and target_id. Reviewers are kept out: the
+// log has every student's logins with times and IPs, which lined up with
+// report times would point to who filed a report.
+func (h *Handler) ListAuditLog(c *gin.Context) {
+	user, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	var filter models.AuditFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	entries, next, err := h.db.ListAuditEntries(filter, page)
+	if err != nil {
+		respondListError(c, err, "Failed to get audit log")
+		return
+	}
+
+	h.audit(c, user, models.AuditLogView, "", "", filter)
+	respondPage(c, "entries", entries, page, next, -1)
+}
+
+// VerifyAuditLog recomputes the audit log's hash chain for admins.
+func (h *Handler) VerifyAuditLog(c *gin.Context) {
+	if _, ok := h.requireAdmin(c); !ok {
+		return
+	}
+
+	result, err := h.db.VerifyAuditChain()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"verification": result})
+}
+
+// SetUserRole lets an admin promote or demote a user. A demoted user is
+// logged out of all their sessions.
+func (h *Handler) SetUserRole(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok || !h.requireStepUp(c, admin) {
+		return
+	}
+
+	var req models.SetRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	login := c.Param("login")
+	if login == admin.Login && req.Role != models.RoleAdmin {
+		c.JSON(http.StatusConflict, gin.H{"error": "Admins cannot remove their own admin role"})
+		return
+	}
+
+	previous, sessionsEnded, err := h.db.SetUserRole(login, req.Role)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change role"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditRoleChange, "user", login, gin.H{
+		"from":             previous,
+		"to":               req.Role,
+		"reason":           req.Reason,
+		"sessions_revoked": sessionsEnded,
+	})
+
+	user, err := h.db.GetUserByLogin(login)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user, "sessions_revoked": sessionsEnded})
+}
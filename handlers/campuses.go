@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/jobs"
+	"whistleblower/models"
+)
+
+// GetCampuses searches the campus directory by name, city or country, so
+// campus IDs no longer have to be looked up by hand before a sync.
+func (h *Handler) GetCampuses(c *gin.Context) {
+	if _, ok := h.requireUser(c); !ok {
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	campuses, next, total, err := h.db.SearchCampuses(c.Query("q"), c.Query("active") == "true", page)
+	if err != nil {
+		respondListError(c, err, "Failed to get campuses")
+		return
+	}
+
+	respondPage(c, "campuses", campuses, page, next, total)
+}
+
+// RefreshCampuses reloads the campus directory from intra in the background.
+func (h *Handler) RefreshCampuses(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	job, _, err := h.jobs.EnqueueUnique(jobs.KindCampusDirectoryRefresh, nil, user.Login)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start campus directory refresh"})
+		return
+	}
+
+	h.audit(c, user, models.AuditDirectoryRefresh, "job", strconv.Itoa(job.ID), nil)
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "job": job})
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds handler settings read from the environment.
+type Config struct {
+	// An access alert is raised when one staff account reads more than
+	// AccessAlertThreshold distinct reports (REPORT_ACCESS_ALERT_THRESHOLD,
+	// default 100) within AccessAlertWindow (REPORT_ACCESS_ALERT_WINDOW,
+	// default an hour).
+	AccessAlertThreshold int
+	AccessAlertWindow    time.Duration
+
+	// RevealRequiresApproval makes identity reveals wait for a second admin
+	// (REVEAL_REQUIRES_APPROVAL).
+	RevealRequiresApproval bool
+
+	// SecureCookies marks cookies Secure, so browsers only send them over
+	// HTTPS (and to localhost). COOKIE_SECURE=false turns it off, for plain
+	// HTTP deployments only.
+	SecureCookies bool
+
+	// AllowedOrigins are origins besides the server's own host that may
+	// send state-changing requests, such as "https://whistleblower.42.fr"
+	// (ALLOWED_ORIGINS, comma-separated).
+	AllowedOrigins []string
+
+	// StaffTwoFactorRequired locks staff out of staff endpoints until they
+	// enroll an authenticator app (STAFF_2FA_REQUIRED).
+	StaffTwoFactorRequired bool
+
+	// StepUpWindow is how recent a session's two-factor check, or its
+	// login for users without an authenticator, must be for sensitive
+	// actions such as exports and identity reveals (STEP_UP_WINDOW, default
+	// 10 minutes).
+	StepUpWindow time.Duration
+
+	// RateLimits throttle routes, keyed "METHOD /path" as registered, with
+	// the "default" rule for the others; RATE_LIMITS entries apply over the
+	// default rules. RateLimitBackend (RATE_LIMIT_BACKEND) is "memory", or
+	// "database" to share buckets between instances.
+	RateLimits       map[string]RateLimitRule
+	RateLimitBackend string
+
+	// CSPReportOnly (CSP_REPORT_ONLY) sends the Content-Security-Policy as
+	// report-only, to try a policy out without breaking pages.
+	// CSPStyleSources (CSP_STYLE_SOURCES, space-separated) are allowed
+	// stylesheet origins besides the site itself.
+	CSPReportOnly   bool
+	CSPStyleSources []string
+
+	// HSTSMaxAge is how long browsers keep to HTTPS after a visit; zero
+	// sends no Strict-Transport-Security header (HSTS_MAX_AGE, default a
+	// year, off with COOKIE_SECURE=false).
+	HSTSMaxAge time.Duration
+}
+
+// ConfigFromEnv reads the Config from the environment, over the defaults.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		AccessAlertThreshold: 100,
+		AccessAlertWindow:    time.Hour,
+		SecureCookies:        true,
+		StepUpWindow:         10 * time.Minute,
+		RateLimits:           defaultRateLimits(),
+		RateLimitBackend:     "memory",
+		CSPStyleSources:      []string{"https://cdn.jsdelivr.net"},
+		HSTSMaxAge:           365 * 24 * time.Hour,
+	}
+
+	if v := os.Getenv("REPORT_ACCESS_ALERT_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.AccessAlertThreshold = n
+		} else {
+			log.Printf("Warning: invalid REPORT_ACCESS_ALERT_THRESHOLD %q", v)
+		}
+	}
+	if v := os.Getenv("REPORT_ACCESS_ALERT_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.AccessAlertWindow = d
+		} else {
+			log.Printf("Warning: invalid REPORT_ACCESS_ALERT_WINDOW %q", v)
+		}
+	}
+
+	cfg.RevealRequiresApproval = os.Getenv("REVEAL_REQUIRES_APPROVAL") == "true"
+
+	if os.Getenv("COOKIE_SECURE") == "false" {
+		log.Println("Warning: COOKIE_SECURE=false, session cookies are sent over plain HTTP")
+		cfg.SecureCookies = false
+		cfg.HSTSMaxAge = 0
+	}
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+		}
+	}
+
+	cfg.StaffTwoFactorRequired = os.Getenv("STAFF_2FA_REQUIRED") == "true"
+	if v := os.Getenv("STEP_UP_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.StepUpWindow = d
+		} else {
+			log.Printf("Warning: invalid STEP_UP_WINDOW %q", v)
+		}
+	}
+
+	if v := os.Getenv("RATE_LIMITS"); v != "" {
+		if err := parseRateLimits(cfg.RateLimits, v); err != nil {
+			log.Printf("Warning: invalid RATE_LIMITS %q: %v", v, err)
+		}
+	}
+	switch v := os.Getenv("RATE_LIMIT_BACKEND"); v {
+	case "":
+	case "memory", "database":
+		cfg.RateLimitBackend = v
+	default:
+		log.Printf("Warning: invalid RATE_LIMIT_BACKEND %q", v)
+	}
+
+	cfg.CSPReportOnly = os.Getenv("CSP_REPORT_ONLY") == "true"
+	if v, ok := os.LookupEnv("CSP_STYLE_SOURCES"); ok {
+		cfg.CSPStyleSources = strings.Fields(v)
+	}
+	if v := os.Getenv("HSTS_MAX_AGE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.HSTSMaxAge = d
+		} else {
+			log.Printf("Warning: invalid HSTS_MAX_AGE %q", v)
+		}
+	}
+
+	return cfg
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CSRF protection uses a double-submit token: a random token in the
+// csrf_token cookie, which pages read and send back in the X-CSRF-Token
+// header (or a csrf_token form field). Another site can make the browser
+// send the cookie, but it cannot read it to fill in the header.
+const (
+	csrfCookie    = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+// csrfTokenTTL is how long the CSRF cookie lives. It is replaced on every
+// login, so it only needs to outlast a session.
+const csrfTokenTTL = 2 * sessionTTL
+
+// setCookie sets a cookie for the whole site with the app's cookie policy:
+// SameSite=Strict, and Secure unless COOKIE_SECURE=false.
+func (h *Handler) setCookie(c *gin.Context, name, value string, maxAge int, httpOnly bool) {
+	h.setCookieSameSite(c, name, value, maxAge, httpOnly, http.SameSiteStrictMode)
+}
+
+func (h *Handler) setCookieSameSite(c *gin.Context, name, value string, maxAge int, httpOnly bool, sameSite http.SameSite) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		MaxAge:   maxAge,
+		Path:     "/",
+		Secure:   h.cfg.SecureCookies,
+		HttpOnly: httpOnly,
+		SameSite: sameSite,
+	})
+}
+
+// issueCSRFToken sets a new CSRF token cookie and returns the token.
+func (h *Handler) issueCSRFToken(c *gin.Context) string {
+	token := generateToken()
+	// Not HttpOnly: the page's scripts read the token from the cookie.
+	h.setCookie(c, csrfCookie, token, int(csrfTokenTTL.Seconds()), false)
+	return token
+}
+
+// CSRFProtection rejects state-changing requests (anything but GET, HEAD
+// and OPTIONS) that come from another origin or do not carry the CSRF
+// token. It hands out the token cookie on any request that lacks one.
+// Requests authenticated with an API key are exempt: browsers never send
+// the key on their own, so there is nothing to forge. It has to run after
+// APIKeyAuth. CSP violation reports are exempt too: browsers send them on
+// their own, without the token, and they change nothing.
+func (h *Handler) CSRFProtection() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.currentAPIKey(c) != nil || c.FullPath() == cspReportPath {
+			c.Next()
+			return
+		}
+
+		token, err := c.Cookie(csrfCookie)
+		if err != nil || token == "" {
+			token = h.issueCSRFToken(c)
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		if !h.allowedOrigin(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Cross-origin request refused"})
+			return
+		}
+
+		sent := c.GetHeader(csrfHeader)
+		if sent == "" && strings.HasPrefix(c.ContentType(), "application/x-www-form-urlencoded") {
+			sent = c.PostForm(csrfFormField)
+		}
+		if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// allowedOrigin checks the Origin header, or the Referer when there is no
+// Origin, against the server's own host and ALLOWED_ORIGINS. Requests with
+// neither header do not come from a browser page and only need the token.
+func (h *Handler) allowedOrigin(c *gin.Context) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		origin = c.GetHeader("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Host == c.Request.Host {
+		return true
+	}
+
+	for _, allowed := range h.cfg.AllowedOrigins {
+		if u.Scheme+"://"+u.Host == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -1,38 +1,101 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"whistleblower/auth"
 	"whistleblower/database"
+	"whistleblower/encryption"
+	"whistleblower/intra"
+	"whistleblower/jobs"
 	"whistleblower/models"
+	"whistleblower/ratelimit"
 )
 
+const sessionTTL = 24 * time.Hour
+
 type Handler struct {
-	db *database.DB
+	db     *database.DB
+	intra  *intra.Client
+	tokens *auth.TokenStore
+	jobs   *jobs.Runner
+	cfg    Config
+
+	pseudonyms *encryption.Pseudonymizer
+	limits     ratelimit.Store
+	providers  *auth.Providers
 }
 
-func NewHandler(db *database.DB) *Handler {
-	return &Handler{db: db}
+func NewHandler(db *database.DB, intraClient *intra.Client, providers *auth.Providers, tokens *auth.TokenStore,
+	runner *jobs.Runner, pseudonyms *encryption.Pseudonymizer, cfg Config) *Handler {
+	return &Handler{
+		db:         db,
+		intra:      intraClient,
+		providers:  providers,
+		tokens:     tokens,
+		jobs:       runner,
+		cfg:        cfg,
+		pseudonyms: pseudonyms,
+		limits:     newRateLimitStore(db, cfg.RateLimitBackend),
+	}
 }
 
+// Login starts a login with the identity provider in the URL, or 42. With
+// link=true it links the provider's account to the logged-in user instead.
 func (h *Handler) Login(c *gin.Context) {
+	provider := h.providerFromParam(c)
+	if provider == nil {
+		return
+	}
+
 	state := generateState()
-	c.SetCookie("oauth_state", state, 300, "/", "", false, true)
-	
-	authURL := auth.GetAuthURL(state)
+	// The state cookie also remembers the provider and, when linking, which
+	// session to link to: the auth_token cookie is SameSite=Strict, so the
+	// callback from the provider does not carry it.
+	stored := provider.Name() + ":login:" + state
+	if c.Query("link") == "true" {
+		session, _ := h.currentSession(c)
+		if session == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+		stored = provider.Name() + ":link:" + state + ":" + session.TokenHash
+	}
+
+	authURL, err := provider.AuthURL(c.Request.Context(), state)
+	if err != nil {
+		log.Printf("Failed to start %s login: %v", provider.Name(), err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	// Lax, not Strict: the browser has to send the state back on the
+	// redirect from the provider, which is a cross-site navigation.
+	h.setCookieSameSite(c, "oauth_state", stored, 300, true, http.SameSiteLaxMode)
 	c.Redirect(http.StatusTemporaryRedirect, authURL)
 }
 
 func (h *Handler) Callback(c *gin.Context) {
-	state := c.Query("state")
-	storedState, err := c.Cookie("oauth_state")
-	if err != nil || state != storedState {
+	provider := h.providerFromParam(c)
+	if provider == nil {
+		return
+	}
+
+	storedState, _ := c.Cookie("oauth_state")
+	h.setCookie(c, "oauth_state", "", -1, true)
+	// provider:mode:state, and the session's token hash when linking
+	parts := strings.SplitN(storedState, ":", 4)
+	if len(parts) < 3 || parts[0] != provider.Name() || c.Query("state") != parts[2] {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
 		return
 	}
@@ -43,35 +106,79 @@ func (h *Handler) Callback(c *gin.Context) {
 		return
 	}
 
-	auth42User, err := auth.GetUserFromCode(code)
+	identity, oauthToken, err := provider.Exchange(c.Request.Context(), code)
 	if err != nil {
+		log.Printf("%s login failed: %v", provider.Name(), err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
 		return
 	}
 
-	// Check if user already exists to preserve admin rights
-	existingUser, err := h.db.GetUserByLogin(auth42User.Login)
-
-	user := &models.User{
-		Login:       auth42User.Login,
-		Email:       auth42User.Email,
-		DisplayName: auth42User.DisplayName,
-		IsStaff:     false, // Default for new users
+	if err := provider.CheckCampus(identity); err != nil {
+		renderHTML(c, http.StatusForbidden, "access_denied.html", gin.H{
+			"user_name": identity.DisplayName,
+			"message":   "Access Denied: This portal is not open to your campus.",
+		})
+		return
 	}
 
-	// Preserve existing admin rights if user already exists
-	if err == nil && existingUser != nil {
-		user.IsStaff = existingUser.IsStaff
+	var linkTo *models.User
+	if parts[1] == "link" && len(parts) == 4 {
+		session, err := h.db.GetSessionByTokenHash(parts[3])
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Your session ended before the account was linked"})
+			return
+		}
+		if linkTo, err = h.db.GetUserByID(session.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+			return
+		}
 	}
 
-	if err := h.db.CreateUser(user); err != nil {
+	user, err := h.identityUser(provider, identity, linkTo)
+	if errors.Is(err, errLoginTaken) || errors.Is(err, database.ErrIdentityConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to resolve %s identity %s: %v", provider.Name(), identity.Subject, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
-	token := generateToken()
-	c.SetCookie("auth_token", token, 3600*24, "/", "", false, true)
-	c.SetCookie("user_login", user.Login, 3600*24, "/", "", false, false)
+	if linkTo != nil {
+		h.audit(c, user, models.AuditIdentityLink, "user", user.Login, gin.H{
+			"provider": provider.Name(),
+			"subject":  identity.Subject,
+		})
+		c.Redirect(http.StatusTemporaryRedirect, "/dashboard")
+		return
+	}
+
+	user, err = h.applyRoleMapping(c, provider, identity, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	// Only tokens the app calls APIs with are kept.
+	var sealedToken string
+	if oauthToken != nil {
+		if sealedToken, err = h.tokens.Seal(oauthToken); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to secure session"})
+			return
+		}
+	}
+
+	if err := h.startSession(c, user, sealedToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	h.audit(c, user, models.AuditLogin, "user", user.Login, gin.H{"staff": user.IsStaff, "provider": provider.Name()})
+
+	// A new session gets a new CSRF token, so a token planted before login
+	// is worthless afterwards.
+	h.issueCSRFToken(c)
 	
 	c.Redirect(http.StatusTemporaryRedirect, "/dashboard")
 }
@@ -83,34 +190,50 @@ func (h *Handler) SearchStudents(c *gin.Context) {
 		return
 	}
 
-	_, err := c.Cookie("user_login")
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+	if _, ok := h.requireUser(c); !ok {
+		return
+	}
+
+	var search models.UserSearch
+	if err := c.ShouldBindQuery(&search); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, ok := pageFromQuery(c, 20, 100)
+	if !ok {
 		return
 	}
 
 	// Search in local database instead of 42 API for better performance
-	results, err := h.db.SearchUsers(query)
+	results, next, total, err := h.db.SearchUsers(search, page)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search students"})
+		respondListError(c, err, "Failed to search students")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"students": results})
+	respondPage(c, "students", results, page, next, total)
 }
 
 func (h *Handler) GetStudentProjects(c *gin.Context) {
 	login := c.Param("login")
 	
-	token, err := c.Cookie("auth_token")
-	if err != nil {
+	session, _ := h.currentSession(c)
+	if session == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
 		return
 	}
 
-	projects, err := auth.GetStudentProjects(login, token)
+	// Query intra as the logged-in user with their stored OAuth token
+	userTokens, err := h.tokens.TokenSource(c.Request.Context(), session)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "No intra token for session - please login again with 42"})
+		return
+	}
+
+	projects, err := h.intra.GetStudentProjects(c.Request.Context(), login, userTokens)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get student projects"})
+		respondIntraError(c, err, "Failed to get student projects")
 		return
 	}
 
@@ -118,31 +241,32 @@ func (h *Handler) GetStudentProjects(c *gin.Context) {
 }
 
 func (h *Handler) CreateReport(c *gin.Context) {
-	userLogin, err := c.Cookie("user_login")
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+	user, ok := h.requireUser(c)
+	if !ok {
 		return
 	}
 
-	user, err := h.db.GetUserByLogin(userLogin)
-	if err != nil {
-		// Debug: provide more info about the issue
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "User not found in database", 
-			"login_from_cookie": userLogin,
-			"hint": "Try logging out and logging back in via /login",
-		})
+	req, ok := bindReportRequest(c)
+	if !ok {
 		return
 	}
 
-	var req models.CreateReportRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	reporter := user
+	onBehalf := req.OnBehalfOf != "" && req.OnBehalfOf != user.Login
+	if onBehalf {
+		if h.currentAPIKey(c) == nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "on_behalf_of needs an API key with the reports:create scope"})
+			return
+		}
+		var err error
+		if reporter, err = h.db.GetUserByLogin(req.OnBehalfOf); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "on_behalf_of is not a known user"})
+			return
+		}
 	}
 
 	report := &models.Report{
-		ReporterID:          user.ID,
+		ReporterID:          reporter.ID,
 		ReportedStudentLogin: req.ReportedStudentLogin,
 		ProjectName:         req.ProjectName,
 		Reason:              req.Reason,
@@ -154,6 +278,14 @@ func (h *Handler) CreateReport(c *gin.Context) {
 		return
 	}
 
+	// The entry names the key, not the student the report was filed for,
+	// so the audit log does not link reporters to reports.
+	if onBehalf {
+		h.audit(c, user, models.AuditReportOnBehalf, "report", strconv.Itoa(report.ID), gin.H{
+			"api_key": h.currentAPIKey(c).ID,
+		})
+	}
+
 	reportCount, err := h.db.GetReportCountForProject(req.ReportedStudentLogin, req.ProjectName)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check report count"})
@@ -168,7 +300,7 @@ func (h *Handler) CreateReport(c *gin.Context) {
 		}
 		
 		if err := h.db.CreateStaffNotification(notification); err != nil {
-			fmt.Printf("Failed to create staff notification: %v\n", err)
+			log.Printf("Failed to create staff notification: %v", err)
 		}
 	}
 
@@ -179,47 +311,23 @@ func (h *Handler) CreateReport(c *gin.Context) {
 }
 
 func (h *Handler) GetReportReasons(c *gin.Context) {
-	reasons, err := h.db.GetReportReasons()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get report reasons"})
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"reasons": reasons})
-}
-
-func (h *Handler) GetPendingReports(c *gin.Context) {
-	userLogin, err := c.Cookie("user_login")
+	reasons, next, total, err := h.db.GetReportReasons(page)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		respondListError(c, err, "Failed to get report reasons")
 		return
 	}
 
-	user, err := h.db.GetUserByLogin(userLogin)
-	if err != nil || !user.IsStaff {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Staff access required"})
-		return
-	}
-
-	reports, err := h.db.GetPendingReports()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get reports"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"reports": reports})
+	respondPage(c, "reasons", reasons, page, next, total)
 }
 
 func (h *Handler) ReviewReport(c *gin.Context) {
-	userLogin, err := c.Cookie("user_login")
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
-		return
-	}
-
-	user, err := h.db.GetUserByLogin(userLogin)
-	if err != nil || !user.IsStaff {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Staff access required"})
+	user, ok := h.requireStaff(c)
+	if !ok {
 		return
 	}
 
@@ -241,60 +349,98 @@ func (h *Handler) ReviewReport(c *gin.Context) {
 		return
 	}
 
+	h.audit(c, user, models.AuditReportReview, "report", reportIDStr, gin.H{"status": req.Status})
+
 	c.JSON(http.StatusOK, gin.H{"message": "Report reviewed successfully"})
 }
 
 func (h *Handler) SyncCampusUsers(c *gin.Context) {
-	// Simplify authentication - just check if user is logged in via cookie
-	userLogin, err := c.Cookie("user_login")
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated - please login first"})
+	user, ok := h.requireUser(c)
+	if !ok {
 		return
 	}
 
-
-	campusID := c.DefaultQuery("campus_id", "1")
-	campusIDInt, err := strconv.Atoi(campusID)
-	if err != nil {
+	// campus_id takes one ID, a comma-separated list, or "all" for every
+	// active campus in the directory.
+	var campusIDs []int
+	var err error
+	campusParam := c.DefaultQuery("campus_id", "1")
+	if campusParam == "all" {
+		if campusIDs, err = h.db.GetActiveCampusIDs(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load campus directory"})
+			return
+		}
+	} else if campusIDs, err = parseCampusIDs(campusParam); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid campus ID"})
 		return
 	}
-
-	// Get OAuth token using client credentials (doesn't require user to be in DB)
-	token, err := auth.GetClientCredentialsToken()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get OAuth token: " + err.Error()})
+	if len(campusIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No active campuses in the directory"})
 		return
 	}
 
-	auth42Users, err := auth.GetAllCampusUsers(campusIDInt, token)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch campus users: " + err.Error()})
-		return
-	}
+	full := c.Query("full") == "true"
 
-	users := make([]models.User, len(auth42Users))
-	for i, auth42User := range auth42Users {
-		users[i] = models.User{
-			Login:       auth42User.Login,
-			Email:       auth42User.Email,
-			DisplayName: auth42User.DisplayName,
-			IsStaff:     false,
+	// Any user may sync a campus incrementally. Syncing several campuses or
+	// a full sync costs far more intra quota, so it takes staff, or an API
+	// key, which APIKeyAuth has already checked for the sync:run scope.
+	if (campusParam == "all" || len(campusIDs) > 1 || full) && h.currentAPIKey(c) == nil {
+		if user, ok = h.requireStaff(c); !ok {
+			return
 		}
 	}
 
-	if err := h.db.BulkCreateUsers(users); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save users to database: " + err.Error()})
+	// Syncing a large campus takes minutes, so each campus syncs in its own
+	// background job. A sync of the same campus that is already queued or
+	// running is returned instead of starting a second one.
+	queued, err := jobs.EnqueueCampusSyncs(h.jobs, campusIDs, full, user.Login)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start campus sync"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": fmt.Sprintf("Users synced successfully from campus %d", campusIDInt),
-		"count":   len(users),
-		"requested_by": userLogin,
+	jobIDs := make([]int, len(queued))
+	for i, job := range queued {
+		jobIDs[i] = job.ID
+	}
+
+	h.audit(c, user, models.AuditSyncStart, "campus", "", gin.H{
+		"campus_ids": campusIDs,
+		"full":       full,
+		"job_ids":    jobIDs,
 	})
+
+	response := gin.H{
+		"message":      fmt.Sprintf("Sync of %d campuses started", len(queued)),
+		"job_ids":      jobIDs,
+		"jobs":         queued,
+		"requested_by": user.Login,
+	}
+	if len(queued) == 1 {
+		response["message"] = fmt.Sprintf("Sync of campus %d started", campusIDs[0])
+		response["job_id"] = queued[0].ID
+		response["job"] = queued[0]
+		c.Header("Location", fmt.Sprintf("/api/jobs/%d", queued[0].ID))
+	}
+
+	c.JSON(http.StatusAccepted, response)
 }
 
+func parseCampusIDs(value string) ([]int, error) {
+	seen := make(map[int]bool)
+	var campusIDs []int
+	for _, part := range strings.Split(value, ",") {
+		campusID, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || campusID <= 0 {
+			return nil, fmt.Errorf("invalid campus ID %q", part)
+		}
+		if !seen[campusID] {
+			seen[campusID] = true
+			campusIDs = append(campusIDs, campusID)
+		}
+	}
+	return campusIDs, nil
+}
 
 func (h *Handler) GetUserStats(c *gin.Context) {
 	count, err := h.db.GetUserCount()
@@ -309,20 +455,8 @@ func (h *Handler) GetUserStats(c *gin.Context) {
 }
 
 func (h *Handler) GetCurrentUser(c *gin.Context) {
-	userLogin, err := c.Cookie("user_login")
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
-		return
-	}
-
-	user, err := h.db.GetUserByLogin(userLogin)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"authenticated": true,
-			"login_from_cookie": userLogin,
-			"in_database": false,
-			"error": "User not in database - need to re-login via OAuth",
-		})
+	user, ok := h.requireUser(c)
+	if !ok {
 		return
 	}
 
@@ -336,37 +470,33 @@ func (h *Handler) GetCurrentUser(c *gin.Context) {
 }
 
 func (h *Handler) GetProjectStats(c *gin.Context) {
-	userLogin, err := c.Cookie("user_login")
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+	if _, ok := h.requireStaff(c); !ok {
 		return
 	}
 
-	user, err := h.db.GetUserByLogin(userLogin)
-	if err != nil || !user.IsStaff {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Staff access required"})
+	var filter models.ProjectStatsFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	projectStats, err := h.db.GetMostReportedProjects()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get project statistics"})
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"projects": projectStats})
-}
-
-func (h *Handler) BulkProjectAction(c *gin.Context) {
-	userLogin, err := c.Cookie("user_login")
+	projectStats, next, total, err := h.db.GetMostReportedProjects(filter, page)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		respondListError(c, err, "Failed to get project statistics")
 		return
 	}
 
-	user, err := h.db.GetUserByLogin(userLogin)
-	if err != nil || !user.IsStaff {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Staff access required"})
+	respondPage(c, "projects", projectStats, page, next, total)
+}
+
+func (h *Handler) BulkProjectAction(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
 		return
 	}
 
@@ -376,12 +506,22 @@ func (h *Handler) BulkProjectAction(c *gin.Context) {
 		return
 	}
 
+	// Approving a whole project at once carries academic consequences.
+	if req.Status == "approved" && !h.requireStepUp(c, user) {
+		return
+	}
+
 	affectedRows, err := h.db.BulkUpdateProjectReports(req.StudentLogin, req.ProjectName, req.Status, user.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update project reports"})
 		return
 	}
 
+	h.audit(c, user, models.AuditBulkAction, "project", req.StudentLogin+"/"+req.ProjectName, gin.H{
+		"status":           req.Status,
+		"affected_reports": affectedRows,
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": fmt.Sprintf("Successfully %s %d pending reports for %s - %s", req.Status, affectedRows, req.StudentLogin, req.ProjectName),
 		"affected_reports": affectedRows,
@@ -389,23 +529,16 @@ func (h *Handler) BulkProjectAction(c *gin.Context) {
 }
 
 func (h *Handler) AdminPage(c *gin.Context) {
-	userLogin, err := c.Cookie("user_login")
-	if err != nil {
+	_, user := h.currentSession(c)
+	if user == nil {
 		// Redirect to login if not authenticated
 		c.Redirect(302, "/login")
 		return
 	}
 
-	user, err := h.db.GetUserByLogin(userLogin)
-	if err != nil {
-		// Redirect to login if user not found in database
-		c.Redirect(302, "/login")
-		return
-	}
-
 	if !user.IsStaff {
 		// Show access denied page for non-staff users
-		c.HTML(403, "access_denied.html", gin.H{
+		renderHTML(c, 403, "access_denied.html", gin.H{
 			"user_name": user.DisplayName,
 			"message": "Access Denied: Staff privileges required to access the admin panel.",
 		})
@@ -413,11 +546,76 @@ func (h *Handler) AdminPage(c *gin.Context) {
 	}
 
 	// User is staff, show admin page
-	c.HTML(200, "admin.html", gin.H{
+	renderHTML(c, 200, "admin.html", gin.H{
 		"user_name": user.DisplayName,
 	})
 }
 
+// requireStaff resolves the logged-in user and checks staff rights, writing
+// the error response itself when the check fails.
+func (h *Handler) requireStaff(c *gin.Context) (*models.User, bool) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return nil, false
+	}
+
+	if !user.IsStaff {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Staff access required"})
+		return nil, false
+	}
+
+	if !h.checkTwoFactor(c, user) {
+		return nil, false
+	}
+
+	return user, true
+}
+
+// requireAdmin is requireStaff for actions reserved to admins.
+func (h *Handler) requireAdmin(c *gin.Context) (*models.User, bool) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return nil, false
+	}
+
+	if user.Role != models.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		return nil, false
+	}
+
+	return user, true
+}
+
+// respondIntraError maps an intra client error to a matching HTTP response.
+// The error itself is only logged, since it can carry intra's response.
+func respondIntraError(c *gin.Context, err error, message string) {
+	status := http.StatusBadGateway
+	var apiErr *intra.APIError
+	var tokenErr *intra.TokenError
+
+	switch {
+	case errors.As(err, &tokenErr):
+		// The app's credentials or the user's refresh token were refused
+		// before the request went out.
+	case errors.Is(err, intra.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, intra.ErrUnauthorized):
+		status = http.StatusUnauthorized
+	case errors.Is(err, intra.ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, intra.ErrRateLimited):
+		status = http.StatusServiceUnavailable
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(apiErr.RetryAfter.Seconds())+1))
+		}
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		status = http.StatusGatewayTimeout
+	}
+
+	log.Printf("%s: %v", message, err)
+	c.JSON(status, gin.H{"error": message})
+}
+
 func generateState() string {
 	b := make([]byte, 32)
 	rand.Read(b)
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/auth"
+	"whistleblower/database"
+	"whistleblower/models"
+)
+
+// errLoginTaken is returned when a provider's first login would create a
+// user whose login already belongs to someone else.
+var errLoginTaken = errors.New("an account with this login already exists; log in and link this provider from your dashboard instead")
+
+// providerFromParam resolves the :provider URL parameter, defaulting to 42,
+// writing a 404 response when there is no such provider.
+func (h *Handler) providerFromParam(c *gin.Context) auth.Provider {
+	name := c.Param("provider")
+	if name == "" {
+		return h.providers.FortyTwo()
+	}
+
+	provider := h.providers.Get(name)
+	if provider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown identity provider"})
+	}
+	return provider
+}
+
+// identityUser finds the user an identity logs in as, creating it on a
+// first login, and records the identity. When linkTo is set the identity is
+// linked to that user instead. Profiles are only refreshed from providers
+// that own the login, so an OIDC login does not overwrite intra data.
+func (h *Handler) identityUser(provider auth.Provider, identity *auth.Identity, linkTo *models.User) (*models.User, error) {
+	user, err := h.db.GetUserByIdentity(identity.Provider, identity.Subject)
+	switch {
+	case err == sql.ErrNoRows:
+		user = linkTo
+		if user == nil {
+			user, err = h.db.GetUserByLogin(identity.Login)
+			if err == nil && !provider.LinksByLogin() {
+				return nil, errLoginTaken
+			}
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+	case err != nil:
+		return nil, err
+	case linkTo != nil && user.ID != linkTo.ID:
+		return nil, database.ErrIdentityConflict
+	}
+
+	if user == nil || (provider.LinksByLogin() && user.Login == identity.Login) {
+		profile := &models.User{
+			Login:       identity.Login,
+			Email:       identity.Email,
+			DisplayName: identity.DisplayName,
+			IntraID:     identity.IntraID,
+		}
+		if user != nil {
+			// Staff rights are managed here, not by the provider.
+			profile.IsStaff = user.IsStaff
+		}
+		if err := h.db.CreateUser(profile); err != nil {
+			return nil, err
+		}
+		if user, err = h.db.GetUserByID(profile.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := h.db.LinkIdentity(user.ID, identity.Provider, identity.Subject, identity.Email); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// applyRoleMapping raises the user's role to the one the provider's role
+// mapping grants. It never lowers a role, so rights given by an admin
+// survive a login.
+func (h *Handler) applyRoleMapping(c *gin.Context, provider auth.Provider, identity *auth.Identity, user *models.User) (*models.User, error) {
+	role := provider.Role(identity)
+	if models.RoleRank(role) <= models.RoleRank(user.Role) {
+		return user, nil
+	}
+
+	previous, _, err := h.db.SetUserRole(user.Login, role)
+	if err != nil {
+		log.Printf("Failed to map %s to role %s: %v", user.Login, role, err)
+		return nil, err
+	}
+	h.audit(c, nil, models.AuditRoleChange, "user", user.Login, gin.H{
+		"from":     previous,
+		"to":       role,
+		"provider": provider.Name(),
+		"reason":   "role mapping",
+	})
+	return h.db.GetUserByID(user.ID)
+}
+
+// ListIdentities lists the identity providers the current user can log in
+// with, and the ones they could link.
+func (h *Handler) ListIdentities(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	identities, err := h.db.ListUserIdentities(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get identities"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"identities": identities,
+		"providers":  loginProviders(h.providers),
+	})
+}
+
+// UnlinkIdentity removes one of the current user's identities. The last one
+// cannot be removed.
+func (h *Handler) UnlinkIdentity(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity ID"})
+		return
+	}
+
+	identity, err := h.db.DeleteIdentity(id, user.ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+		return
+	}
+	if err == database.ErrLastIdentity {
+		c.JSON(http.StatusConflict, gin.H{"error": "You cannot unlink the only way you log in"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink identity"})
+		return
+	}
+
+	h.audit(c, user, models.AuditIdentityUnlink, "user", user.Login, gin.H{
+		"provider": identity.Provider,
+		"subject":  identity.Subject,
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Identity unlinked"})
+}
+
+// IndexPage renders the login page with a button per identity provider.
+func (h *Handler) IndexPage(c *gin.Context) {
+	renderHTML(c, http.StatusOK, "index.html", gin.H{"providers": loginProviders(h.providers)})
+}
+
+// DashboardPage renders the student dashboard.
+func (h *Handler) DashboardPage(c *gin.Context) {
+	renderHTML(c, http.StatusOK, "dashboard.html", nil)
+}
+
+type loginProvider struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	LoginURL string `json:"login_url"`
+}
+
+func loginProviders(providers *auth.Providers) []loginProvider {
+	list := make([]loginProvider, 0, len(providers.List()))
+	for _, p := range providers.List() {
+		list = append(list, loginProvider{Name: p.Name(), Label: p.Label(), LoginURL: "/login/" + p.Name()})
+	}
+	return list
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/database"
+	"whistleblower/jobs"
+	"whistleblower/models"
+)
+
+func (h *Handler) ListJobs(c *gin.Context) {
+	if _, ok := h.requireStaff(c); !ok {
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	jobList, next, err := h.db.ListJobs(c.Query("status"), c.Query("kind"), page)
+	if err != nil {
+		respondListError(c, err, "Failed to get jobs")
+		return
+	}
+
+	respondPage(c, "jobs", jobList, page, next, -1)
+}
+
+func (h *Handler) GetJob(c *gin.Context) {
+	if _, ok := h.requireStaff(c); !ok {
+		return
+	}
+
+	job, ok := h.jobFromParam(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+// GetJobStatus lets whoever started a job, or any staff member, follow its
+// progress.
+func (h *Handler) GetJobStatus(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	job, ok := h.jobFromParam(c)
+	if !ok {
+		return
+	}
+
+	if job.RequestedBy != user.Login && !user.IsStaff {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+func (h *Handler) EnqueueJob(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	var req models.EnqueueJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	job, err := h.jobs.Enqueue(req.Kind, req.Params, user.Login)
+	if err != nil {
+		if errors.Is(err, jobs.ErrUnknownKind) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "kinds": h.jobs.Kinds()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to enqueue job: " + err.Error()})
+		return
+	}
+
+	h.audit(c, user, models.AuditJobEnqueue, "job", strconv.Itoa(job.ID), gin.H{"kind": job.Kind, "params": job.Params})
+
+	c.JSON(http.StatusAccepted, gin.H{"job": job})
+}
+
+func (h *Handler) CancelJob(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	job, ok := h.jobFromParam(c)
+	if !ok {
+		return
+	}
+
+	job, err := h.jobs.Cancel(job.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+		return
+	}
+
+	h.audit(c, user, models.AuditJobCancel, "job", strconv.Itoa(job.ID), gin.H{"kind": job.Kind})
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+func (h *Handler) RetryJob(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	job, ok := h.jobFromParam(c)
+	if !ok {
+		return
+	}
+
+	job, err := h.jobs.Retry(job.ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only failed or cancelled jobs can be retried"})
+		return
+	}
+	if err == database.ErrJobLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "A job with the same lock key is already queued or running"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+		return
+	}
+
+	h.audit(c, user, models.AuditJobRetry, "job", strconv.Itoa(job.ID), gin.H{"kind": job.Kind})
+
+	c.JSON(http.StatusAccepted, gin.H{"job": job})
+}
+
+func (h *Handler) ListJobSchedules(c *gin.Context) {
+	if _, ok := h.requireStaff(c); !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"schedules": h.jobs.Schedules(),
+		"kinds":     h.jobs.Kinds(),
+	})
+}
+
+func (h *Handler) jobFromParam(c *gin.Context) (*models.Job, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return nil, false
+	}
+
+	job, err := h.db.GetJob(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return nil, false
+	}
+
+	return job, true
+}
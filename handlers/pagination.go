@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/database"
+	"whistleblower/models"
+)
+
+// pageFromQuery reads the limit and cursor query parameters shared by the
+// paginated listings.
+func pageFromQuery(c *gin.Context, defaultLimit, maxLimit int) (models.PageRequest, bool) {
+	page := models.PageRequest{Limit: defaultLimit, Cursor: c.Query("cursor")}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return page, false
+		}
+		page.Limit = limit
+	}
+
+	return page, true
+}
+
+// respondPage writes one page of a listing in the format every paginated
+// endpoint shares: the items under key, plus limit, next_cursor (empty on
+// the last page) and, when known, the total number of matches.
+func respondPage(c *gin.Context, key string, items interface{}, page models.PageRequest, next string, total int) {
+	response := gin.H{
+		key:           items,
+		"limit":       page.Limit,
+		"next_cursor": next,
+	}
+	if total >= 0 {
+		response["total"] = total
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// respondListError reports a failed listing, as a bad request when the
+// client sent a cursor or filter the database layer rejected.
+func respondListError(c *gin.Context, err error, message string) {
+	if errors.Is(err, database.ErrInvalidCursor) || errors.Is(err, database.ErrInvalidFilter) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
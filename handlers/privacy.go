@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/database"
+	"whistleblower/models"
+)
+
+// exportReadme is included in ZIP exports to explain their contents.
+const exportReadme = `This archive holds the data the 42 Whistleblower System stores about one user.
+
+user.json            the user account
+reports_filed.json   reports the user submitted
+reports_about.json   reports about the user; who submitted them is not included
+report_stats.json    review outcomes of the reports the user submitted
+notifications.json   staff notifications about the user
+sessions.json        login sessions (times only)
+filter_presets.json  report filters the user saved as staff
+legal_holds.json     legal holds on the user's cases
+identities.json      accounts at identity providers the user logs in with
+`
+
+// ExportUserData downloads everything stored about a user, for data subject
+// access requests. format=zip returns one JSON file per section in a ZIP
+// archive; the default is a single JSON document. Only admins can export,
+// since the export shows which reports the user submitted.
+func (h *Handler) ExportUserData(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok || !h.requireStepUp(c, admin) {
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "zip" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or zip"})
+		return
+	}
+
+	user, ok := h.userFromParam(c)
+	if !ok {
+		return
+	}
+
+	export, err := h.db.ExportDataSubject(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export user data"})
+		return
+	}
+
+	var ids []int
+	ids = append(ids, reportIDs(export.ReportsFiled)...)
+	ids = append(ids, reportIDs(export.ReportsAbout)...)
+	if len(ids) > 0 {
+		h.recordReportAccess(c, admin, ids, models.AccessExport)
+	}
+	h.audit(c, admin, models.AuditDataExport, "user", strconv.Itoa(user.ID), gin.H{
+		"format":        format,
+		"reports_filed": len(export.ReportsFiled),
+		"reports_about": len(export.ReportsAbout),
+	})
+
+	filename := fmt.Sprintf("%s-data-%s.%s", user.Login, export.ExportedAt.Format("20060102-150405"), format)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if format == "json" {
+		c.IndentedJSON(http.StatusOK, export)
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"user.json", export.User},
+		{"reports_filed.json", export.ReportsFiled},
+		{"reports_about.json", export.ReportsAbout},
+		{"report_stats.json", export.ReportStats},
+		{"notifications.json", export.Notifications},
+		{"sessions.json", export.Sessions},
+		{"filter_presets.json", export.FilterPresets},
+		{"legal_holds.json", export.LegalHolds},
+		{"identities.json", export.Identities},
+	}
+
+	archive := zip.NewWriter(c.Writer)
+	createFile := func(name string) (io.Writer, error) {
+		return archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: export.ExportedAt})
+	}
+
+	w, err := createFile("README.txt")
+	if err == nil {
+		_, err = io.WriteString(w, exportReadme)
+	}
+	for _, file := range files {
+		if err != nil {
+			break
+		}
+		if w, err = createFile(file.name); err != nil {
+			break
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.data)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// The headers are sent already; abort so the client sees a
+		// truncated download instead of a valid looking archive.
+		c.Error(err)
+		c.Abort()
+	}
+}
+
+func (h *Handler) PseudonymizeUser(c *gin.Context) {
+	h.eraseUser(c, models.ErasurePseudonymize)
+}
+
+func (h *Handler) EraseUser(c *gin.Context) {
+	h.eraseUser(c, models.ErasureErase)
+}
+
+// eraseUser pseudonymizes or erases a user on an admin's request. The
+// request has to repeat the login as confirmation, and is refused while a
+// legal hold covers one of the user's cases. The audit entry names the user
+// by ID only, so the log does not keep the identity that was removed.
+func (h *Handler) eraseUser(c *gin.Context, mode string) {
+	admin, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	var req models.ErasureRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := h.userFromParam(c)
+	if !ok {
+		return
+	}
+	if req.Confirm != user.Login {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "confirm must repeat the login"})
+		return
+	}
+	if user.ID == admin.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "Admins cannot erase themselves"})
+		return
+	}
+
+	var result *models.ErasureResult
+	var err error
+	if mode == models.ErasureErase {
+		result, err = h.db.EraseUser(user)
+	} else {
+		result, err = h.db.PseudonymizeUser(user)
+	}
+	if err == database.ErrLegalHold {
+		holds, _ := h.db.LegalHoldsCovering(user)
+		c.JSON(http.StatusConflict, gin.H{
+			"error":       "A legal hold covers this user's cases; release it first",
+			"legal_holds": holds,
+		})
+		return
+	}
+	if err != nil && result == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + mode + " user"})
+		return
+	}
+
+	action := models.AuditPseudonymize
+	if mode == models.ErasureErase {
+		action = models.AuditErase
+	}
+	h.audit(c, admin, action, "user", strconv.Itoa(user.ID), gin.H{
+		"reason": req.Reason,
+		"result": result,
+	})
+
+	// The user is gone either way; a failure after the commit only left
+	// other users' report stats stale.
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"result": result, "warning": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": result})
+}
+
+// ListLegalHolds lists active legal holds, or all of them with all=true,
+// newest first.
+func (h *Handler) ListLegalHolds(c *gin.Context) {
+	if _, ok := h.requireAdmin(c); !ok {
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	holds, next, err := h.db.ListLegalHolds(c.Query("all") == "true", page)
+	if err != nil {
+		respondListError(c, err, "Failed to get legal holds")
+		return
+	}
+
+	respondPage(c, "legal_holds", holds, page, next, -1)
+}
+
+// CreateLegalHold places a hold on an open case: the pending reports about a
+// login, or only those on one project.
+func (h *Handler) CreateLegalHold(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreateLegalHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	open, err := h.db.CountOpenReports(req.Login, req.ProjectName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the case"})
+		return
+	}
+	if open == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "No open case: there are no pending reports about this login"})
+		return
+	}
+
+	hold, err := h.db.CreateLegalHold(req.Login, req.ProjectName, req.Reason, admin.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create legal hold"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditLegalHold, "legal_hold", strconv.Itoa(hold.ID), gin.H{
+		"login":   hold.Login,
+		"project": hold.ProjectName,
+		"reason":  hold.Reason,
+	})
+	c.JSON(http.StatusCreated, gin.H{"legal_hold": hold})
+}
+
+func (h *Handler) ReleaseLegalHold(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid legal hold ID"})
+		return
+	}
+
+	released, err := h.db.ReleaseLegalHold(id, admin.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release legal hold"})
+		return
+	}
+	if !released {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active legal hold with that ID"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditLegalHoldRelease, "legal_hold", strconv.Itoa(id), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Legal hold released"})
+}
+
+func (h *Handler) userFromParam(c *gin.Context) (*models.User, bool) {
+	user, err := h.db.GetUserByLogin(c.Param("login"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return nil, false
+	}
+	return user, true
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/database"
+	"whistleblower/ratelimit"
+)
+
+// Rate limit rules are keyed by client or by IP address. A client is the
+// API key a request authenticates with, else the logged-in user, else the
+// IP address.
+const (
+	rateLimitByClient = "client"
+	rateLimitByIP     = "ip"
+)
+
+// defaultRateLimitRoute names the rule for routes without their own.
+const defaultRateLimitRoute = "default"
+
+// RateLimitRule throttles a route. A nil Policy turns limiting off.
+type RateLimitRule struct {
+	Policy *ratelimit.Policy
+	By     string
+}
+
+// defaultRateLimits protect the expensive routes: student search scans the
+// users table, student projects proxies to intra, syncs page through intra
+// and login sends visitors to the identity providers. Static files are not
+// limited. Routes are "METHOD /path" as registered.
+func defaultRateLimits() map[string]RateLimitRule {
+	rule := func(limit int, period time.Duration, burst int, by string) RateLimitRule {
+		return RateLimitRule{Policy: &ratelimit.Policy{Limit: limit, Period: period, Burst: burst}, By: by}
+	}
+	return map[string]RateLimitRule{
+		defaultRateLimitRoute:               rule(300, time.Minute, 0, rateLimitByClient),
+		"GET /api/students/search":          rule(30, time.Minute, 10, rateLimitByClient),
+		"GET /api/students/:login/projects": rule(10, time.Minute, 5, rateLimitByClient),
+		"POST /api/reports":                 rule(20, time.Hour, 5, rateLimitByClient),
+		"GET /login":                        rule(20, time.Minute, 0, rateLimitByIP),
+		"GET /login/:provider":              rule(20, time.Minute, 0, rateLimitByIP),
+		"GET /callback":                     rule(20, time.Minute, 0, rateLimitByIP),
+		"GET /callback/:provider":           rule(20, time.Minute, 0, rateLimitByIP),
+		"POST /api/sync-users":              rule(10, time.Hour, 0, rateLimitByClient),
+		"POST " + cspReportPath:             rule(60, time.Minute, 0, rateLimitByIP),
+		"GET /static/*filepath":             {},
+	}
+}
+
+// parseRateLimits reads RATE_LIMITS entries separated by semicolons, like
+// "GET /api/students/search=30/1m,burst=10,by=ip" or
+// "default=600/1m" or "GET /api/stats=off", over the defaults.
+func parseRateLimits(rules map[string]RateLimitRule, s string) error {
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		route, spec, ok := strings.Cut(entry, "=")
+		route = strings.Join(strings.Fields(route), " ")
+		if !ok || route == "" {
+			return fmt.Errorf("entry %q is not ROUTE=POLICY", entry)
+		}
+
+		spec = strings.TrimSpace(spec)
+		if spec == "off" {
+			rules[route] = RateLimitRule{}
+			continue
+		}
+		rule := RateLimitRule{By: rateLimitByClient}
+		if rest, by, found := strings.Cut(spec, ",by="); found {
+			if by != rateLimitByClient && by != rateLimitByIP {
+				return fmt.Errorf("invalid key %q for %s, want client or ip", by, route)
+			}
+			spec, rule.By = rest, by
+		}
+		policy, err := ratelimit.ParsePolicy(spec)
+		if err != nil {
+			return err
+		}
+		rule.Policy = &policy
+		rules[route] = rule
+	}
+	return nil
+}
+
+// newRateLimitStore returns the bucket store the backend names.
+func newRateLimitStore(db *database.DB, backend string) ratelimit.Store {
+	if backend == "database" {
+		return ratelimit.NewDatabaseStore(db)
+	}
+	return ratelimit.NewMemoryStore()
+}
+
+// RateLimit throttles requests with the rule of their route, or the
+// default rule, and reports the client's budget in RateLimit-* headers.
+// It runs after APIKeyAuth so requests can be keyed by API key.
+func (h *Handler) RateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.Request.Method + " " + c.FullPath()
+		rule, ok := h.cfg.RateLimits[route]
+		if !ok {
+			route = defaultRateLimitRoute
+			rule = h.cfg.RateLimits[route]
+		}
+		if rule.Policy == nil {
+			c.Next()
+			return
+		}
+
+		if !h.takeRateLimit(c, route+"|"+h.rateLimitClient(c, rule.By), *rule.Policy) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests; slow down"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// rateLimitClient identifies who a request's bucket belongs to.
+func (h *Handler) rateLimitClient(c *gin.Context, by string) string {
+	if by == rateLimitByClient {
+		if key := h.currentAPIKey(c); key != nil {
+			return "key:" + strconv.Itoa(key.ID)
+		}
+		if _, user := h.currentSession(c); user != nil {
+			return "user:" + strconv.Itoa(user.ID)
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// takeRateLimit takes a token from bucket and sets the RateLimit headers,
+// and Retry-After when it is empty. Requests are let through if the store
+// fails, so a database hiccup does not take the site down.
+func (h *Handler) takeRateLimit(c *gin.Context, bucket string, p ratelimit.Policy) bool {
+	result, err := h.limits.Take(bucket, p, time.Now())
+	if err != nil {
+		log.Printf("Failed to check rate limit %s: %v", bucket, err)
+		return true
+	}
+
+	c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", p.Limit, int(p.Period.Seconds()), result.Limit))
+	if !result.Allowed {
+		c.Header("Retry-After", strconv.Itoa(max(1, ceilSeconds(result.RetryAfter))))
+	}
+	return result.Allowed
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
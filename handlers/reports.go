@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/database"
+	"whistleblower/markdown"
+	"whistleblower/models"
+)
+
+// ListReports lists reports for staff. Query parameters are the fields of
+// models.ReportFilter plus limit and cursor; preset=<name> starts from one of
+// the caller's saved filters, which explicit parameters then override.
+// Without a status filter only pending reports are listed.
+func (h *Handler) ListReports(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	filter, ok := h.reportFilterFromQuery(c, user)
+	if !ok {
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	reports, next, total, err := h.db.SearchReports(filter, page)
+	if err != nil {
+		respondListError(c, err, "Failed to get reports")
+		return
+	}
+
+	h.pseudonymizeReporters(reports)
+	renderExplanations(reports)
+	h.recordReportAccess(c, user, reportIDs(reports), models.AccessList)
+	h.audit(c, user, models.AuditReportList, "report", "", gin.H{"filter": filter, "count": len(reports)})
+
+	c.JSON(http.StatusOK, gin.H{
+		"reports":     reports,
+		"limit":       page.Limit,
+		"next_cursor": next,
+		"total":       total,
+		"filter":      filter,
+	})
+}
+
+// GetReport shows a single report to staff.
+func (h *Handler) GetReport(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report ID"})
+		return
+	}
+
+	report, err := h.db.GetReport(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get report"})
+		return
+	}
+
+	report.Reporter = h.reporterPseudonym(report)
+	report.ExplanationHTML = markdown.ToHTML(report.Explanation)
+	h.recordReportAccess(c, user, []int{report.ID}, models.AccessDetail)
+	h.audit(c, user, models.AuditReportView, "report", strconv.Itoa(report.ID), nil)
+
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
+
+// renderExplanations renders the reports' explanations for staff pages.
+// Reports stored before explanations were sanitized may hold raw HTML;
+// ToHTML escapes it all the same.
+func renderExplanations(reports []models.Report) {
+	for i := range reports {
+		reports[i].ExplanationHTML = markdown.ToHTML(reports[i].Explanation)
+	}
+}
+
+// maxExportRows caps a single export so one request cannot dump the whole
+// reports table.
+const maxExportRows = 5000
+
+// ExportReports downloads the reports matching the same filters as
+// ListReports as CSV.
+func (h *Handler) ExportReports(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok || !h.requireStepUp(c, user) {
+		return
+	}
+
+	filter, ok := h.reportFilterFromQuery(c, user)
+	if !ok {
+		return
+	}
+
+	var reports []models.Report
+	page := models.PageRequest{Limit: 500}
+	for {
+		batch, next, total, err := h.db.SearchReports(filter, page)
+		if err != nil {
+			respondListError(c, err, "Failed to export reports")
+			return
+		}
+		if total > maxExportRows {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Export matches %d reports; narrow the filters to at most %d", total, maxExportRows),
+			})
+			return
+		}
+		reports = append(reports, batch...)
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+
+	h.recordReportAccess(c, user, reportIDs(reports), models.AccessExport)
+	h.audit(c, user, models.AuditExport, "report", "", gin.H{"filter": filter, "count": len(reports)})
+
+	filename := fmt.Sprintf("reports-%s.csv", time.Now().UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "created_at", "status", "reason", "project_name",
+		"reported_student_login", "reporter", "explanation", "reviewed_at", "reviewed_by"})
+	for _, r := range reports {
+		var reviewedAt, reviewedBy string
+		if r.ReviewedAt != nil {
+			reviewedAt = r.ReviewedAt.UTC().Format(time.RFC3339)
+		}
+		if r.ReviewedBy != nil {
+			reviewedBy = strconv.Itoa(*r.ReviewedBy)
+		}
+		w.Write([]string{strconv.Itoa(r.ID), r.CreatedAt.UTC().Format(time.RFC3339), r.Status, r.Reason,
+			r.ProjectName, r.ReportedStudentLogin, h.reporterPseudonym(&r), r.Explanation,
+			reviewedAt, reviewedBy})
+	}
+	w.Flush()
+}
+
+// reportFilterFromQuery builds the report filter of a listing or export from
+// the caller's preset, if one is named, and the query parameters.
+func (h *Handler) reportFilterFromQuery(c *gin.Context, user *models.User) (models.ReportFilter, bool) {
+	filter := models.ReportFilter{Status: "pending"}
+	if name := c.Query("preset"); name != "" {
+		preset, err := h.db.GetReportFilterPreset(user.ID, name)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Filter preset not found"})
+			return filter, false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get filter preset"})
+			return filter, false
+		}
+		filter = preset.Filter
+	}
+
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return filter, false
+	}
+
+	return filter, true
+}
+
+func reportIDs(reports []models.Report) []int {
+	ids := make([]int, len(reports))
+	for i, report := range reports {
+		ids[i] = report.ID
+	}
+	return ids
+}
+
+func (h *Handler) ListReportFilterPresets(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	presets, err := h.db.GetReportFilterPresets(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get filter presets"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"presets": presets})
+}
+
+// SaveReportFilterPreset stores the filter in the request body under the
+// name in the path, replacing an existing preset of that name.
+func (h *Handler) SaveReportFilterPreset(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	name := c.Param("name")
+	if len(name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Preset name is too long"})
+		return
+	}
+
+	var filter models.ReportFilter
+	if err := c.ShouldBindJSON(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := database.ValidateReportFilter(filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preset, err := h.db.SaveReportFilterPreset(user.ID, name, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save filter preset"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"preset": preset})
+}
+
+func (h *Handler) DeleteReportFilterPreset(c *gin.Context) {
+	user, ok := h.requireStaff(c)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.db.DeleteReportFilterPreset(user.ID, c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete filter preset"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Filter preset not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Filter preset deleted"})
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/models"
+)
+
+// reporterPseudonym names the reporter of r without identifying them. The
+// pseudonym is the same for all of a reporter's reports in one case (one
+// student and project) and unrelated across cases, so reviewers can tell
+// repeat reports apart without learning who sent them.
+func (h *Handler) reporterPseudonym(r *models.Report) string {
+	return h.pseudonyms.Pseudonym("reporter", strconv.Itoa(r.ReporterID), r.ReportedStudentLogin, r.ProjectName)
+}
+
+func (h *Handler) pseudonymizeReporters(reports []models.Report) {
+	for i := range reports {
+		reports[i].Reporter = h.reporterPseudonym(&reports[i])
+	}
+}
+
+// RequestIdentityReveal asks to see who submitted a report. Only admins may
+// ask, with a written justification. Unless REVEAL_REQUIRES_APPROVAL is set
+// the identity is returned right away; otherwise a second admin has to
+// approve the request first.
+func (h *Handler) RequestIdentityReveal(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok || !h.requireStepUp(c, admin) {
+		return
+	}
+
+	reportID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report ID"})
+		return
+	}
+
+	var req models.RevealIdentityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A justification of at least 20 characters is required"})
+		return
+	}
+
+	report, err := h.db.GetReport(reportID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get report"})
+		return
+	}
+
+	reveal, err := h.db.CreateRevealRequest(report.ID, admin.ID, req.Justification, !h.cfg.RevealRequiresApproval)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record reveal request"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditRevealRequest, "report", strconv.Itoa(report.ID), gin.H{
+		"reveal_request_id": reveal.ID,
+		"justification":     req.Justification,
+		"status":            reveal.Status,
+	})
+
+	if reveal.Status == models.RevealPending {
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "Reveal request recorded; another admin has to approve it",
+			"request": reveal,
+		})
+		return
+	}
+
+	h.respondIdentity(c, admin, reveal, report)
+}
+
+// ListRevealRequests lists reveal requests for admins, newest first,
+// optionally filtered by status.
+func (h *Handler) ListRevealRequests(c *gin.Context) {
+	if _, ok := h.requireAdmin(c); !ok {
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	requests, next, err := h.db.ListRevealRequests(c.Query("status"), page)
+	if err != nil {
+		respondListError(c, err, "Failed to get reveal requests")
+		return
+	}
+
+	respondPage(c, "requests", requests, page, next, -1)
+}
+
+func (h *Handler) ApproveRevealRequest(c *gin.Context) {
+	h.decideRevealRequest(c, models.RevealApproved)
+}
+
+func (h *Handler) DenyRevealRequest(c *gin.Context) {
+	h.decideRevealRequest(c, models.RevealDenied)
+}
+
+// decideRevealRequest records a second admin's decision on a pending reveal
+// request. Admins cannot decide on their own requests.
+func (h *Handler) decideRevealRequest(c *gin.Context, status string) {
+	admin, ok := h.requireAdmin(c)
+	if !ok || (status == models.RevealApproved && !h.requireStepUp(c, admin)) {
+		return
+	}
+
+	reveal, ok := h.revealFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req models.RevealDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if reveal.RequestedBy == admin.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "A reveal request has to be decided by a different admin"})
+		return
+	}
+
+	reveal, err := h.db.DecideRevealRequest(reveal.ID, admin.ID, status, req.Note)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Reveal request was already decided"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record decision"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditRevealDecision, "report", strconv.Itoa(reveal.ReportID), gin.H{
+		"reveal_request_id": reveal.ID,
+		"requested_by":      reveal.RequesterName,
+		"decision":          status,
+		"note":              req.Note,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"request": reveal})
+}
+
+// GetRevealedIdentity returns the reporter behind an approved reveal request
+// to the admin who asked for it. Every call is audited.
+func (h *Handler) GetRevealedIdentity(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok || !h.requireStepUp(c, admin) {
+		return
+	}
+
+	reveal, ok := h.revealFromParam(c)
+	if !ok {
+		return
+	}
+
+	if reveal.RequestedBy != admin.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the admin who requested the reveal can see the identity"})
+		return
+	}
+	if reveal.Status != models.RevealApproved {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Reveal request is " + reveal.Status})
+		return
+	}
+
+	report, err := h.db.GetReport(reveal.ReportID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get report"})
+		return
+	}
+
+	h.respondIdentity(c, admin, reveal, report)
+}
+
+// respondIdentity writes the identity of report's reporter and records the
+// reveal in the audit log.
+func (h *Handler) respondIdentity(c *gin.Context, admin *models.User, reveal *models.RevealRequest, report *models.Report) {
+	reporter, err := h.db.GetUserByID(report.ReporterID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get reporter"})
+		return
+	}
+
+	identity := models.RevealedReporter{
+		Pseudonym:   h.reporterPseudonym(report),
+		UserID:      reporter.ID,
+		Login:       reporter.Login,
+		DisplayName: reporter.DisplayName,
+	}
+
+	h.audit(c, admin, models.AuditIdentityReveal, "report", strconv.Itoa(report.ID), gin.H{
+		"reveal_request_id": reveal.ID,
+		"pseudonym":         identity.Pseudonym,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"request": reveal, "reporter": identity})
+}
+
+func (h *Handler) revealFromParam(c *gin.Context) (*models.RevealRequest, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reveal request ID"})
+		return nil, false
+	}
+
+	reveal, err := h.db.GetRevealRequest(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reveal request not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get reveal request"})
+		return nil, false
+	}
+
+	return reveal, true
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cspNonceKey is the context key of the request's script nonce.
+const cspNonceKey = "cspNonce"
+
+// cspReportPath is where browsers send Content-Security-Policy violations.
+const cspReportPath = "/csp-report"
+
+// maxCSPReportSize caps the body of a violation report.
+const maxCSPReportSize = 64 << 10
+
+// permissionsPolicy turns off browser features the site never uses.
+const permissionsPolicy = "camera=(), microphone=(), geolocation=(), payment=(), usb=(), interest-cohort=()"
+
+// SecurityHeaders sets the response headers that confine what pages can do:
+// a Content-Security-Policy that only runs scripts carrying this request's
+// nonce, HSTS, and headers against framing, referrer leaks and unused
+// browser features. Templates put the nonce on their script tags, so pages
+// must be rendered with renderHTML.
+func (h *Handler) SecurityHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nonce := generateToken()
+		c.Set(cspNonceKey, nonce)
+
+		header := "Content-Security-Policy"
+		if h.cfg.CSPReportOnly {
+			header = "Content-Security-Policy-Report-Only"
+		}
+		c.Header(header, h.contentSecurityPolicy(nonce))
+		c.Header("Reporting-Endpoints", `csp="`+cspReportPath+`"`)
+
+		if h.cfg.HSTSMaxAge > 0 {
+			c.Header("Strict-Transport-Security", "max-age="+strconv.Itoa(int(h.cfg.HSTSMaxAge.Seconds()))+"; includeSubDomains")
+		}
+		c.Header("X-Frame-Options", "DENY")
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Referrer-Policy", "same-origin")
+		c.Header("Permissions-Policy", permissionsPolicy)
+		c.Next()
+	}
+}
+
+// contentSecurityPolicy builds the policy for a response. Scripts need the
+// nonce, so injected markup cannot run code; styles may also come from
+// CSP_STYLE_SOURCES, which holds the stylesheet CDN.
+func (h *Handler) contentSecurityPolicy(nonce string) string {
+	styles := append([]string{"'self'"}, h.cfg.CSPStyleSources...)
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src 'self' 'nonce-" + nonce + "'",
+		"style-src " + strings.Join(styles, " "),
+		"img-src 'self' data:",
+		"connect-src 'self'",
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+		"report-uri " + cspReportPath,
+		"report-to csp",
+	}, "; ")
+}
+
+// renderHTML renders a page template with the request's script nonce,
+// available to templates as .cspNonce.
+func renderHTML(c *gin.Context, code int, name string, data gin.H) {
+	if data == nil {
+		data = gin.H{}
+	}
+	data[cspNonceKey] = c.GetString(cspNonceKey)
+	c.HTML(code, name, data)
+}
+
+// cspViolation is the part of a violation report worth logging.
+type cspViolation struct {
+	DocumentURL string
+	Directive   string
+	BlockedURL  string
+	SourceFile  string
+	LineNumber  int
+}
+
+// legacyCSPReport is the report-uri format, with hyphenated keys.
+type legacyCSPReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		BlockedURI         string `json:"blocked-uri"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+	} `json:"csp-report"`
+}
+
+// reportingAPIReport is one entry of a Reporting API (report-to) list.
+type reportingAPIReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		BlockedURL         string `json:"blockedURL"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+	} `json:"body"`
+}
+
+// CSPReport logs Content-Security-Policy violations sent by browsers, in
+// either the report-uri or the Reporting API format. It is exempt from
+// CSRF checks, since browsers send reports without the token.
+func (h *Handler) CSPReport(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxCSPReportSize))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var violations []cspViolation
+	if strings.HasPrefix(c.ContentType(), "application/reports+json") {
+		var reports []reportingAPIReport
+		if err := json.Unmarshal(body, &reports); err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		for _, r := range reports {
+			if r.Type == "csp-violation" {
+				violations = append(violations, cspViolation{r.Body.DocumentURL, r.Body.EffectiveDirective,
+					r.Body.BlockedURL, r.Body.SourceFile, r.Body.LineNumber})
+			}
+		}
+	} else {
+		var r legacyCSPReport
+		if err := json.Unmarshal(body, &r); err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		directive := r.Report.EffectiveDirective
+		if directive == "" {
+			directive = r.Report.ViolatedDirective
+		}
+		violations = append(violations, cspViolation{r.Report.DocumentURI, directive,
+			r.Report.BlockedURI, r.Report.SourceFile, r.Report.LineNumber})
+	}
+
+	for _, v := range violations {
+		log.Printf("CSP violation on %q: %q blocked %q at %q line %d",
+			v.DocumentURL, v.Directive, v.BlockedURL, v.SourceFile, v.LineNumber)
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/auth"
+	"whistleblower/models"
+)
+
+// sessionTouchInterval is how often a session's last use is written back.
+// Requests in between only update it when the client's IP changed.
+const sessionTouchInterval = time.Minute
+
+// maxUserAgentLength caps the User-Agent stored with a session.
+const maxUserAgentLength = 512
+
+const requestAuthKey = "request_auth"
+
+// requestAuth caches the session or API key and the user behind a request.
+type requestAuth struct {
+	session *models.Session
+	apiKey  *models.APIKey
+	user    *models.User
+}
+
+// currentSession resolves the session behind the auth_token cookie and its
+// user, once per request. Both are nil when the request is not logged in or
+// its session was ended or has expired. For requests authenticated with an
+// API key, the session is nil and the user is the key's owner.
+func (h *Handler) currentSession(c *gin.Context) (*models.Session, *models.User) {
+	if cached, ok := c.Get(requestAuthKey); ok {
+		a := cached.(*requestAuth)
+		return a.session, a.user
+	}
+	a := &requestAuth{}
+	c.Set(requestAuthKey, a)
+
+	token, err := c.Cookie("auth_token")
+	if err != nil || token == "" {
+		return nil, nil
+	}
+
+	session, err := h.db.GetSessionByTokenHash(auth.HashSessionToken(token))
+	if err == sql.ErrNoRows {
+		// Ended elsewhere or expired: drop the dead cookies.
+		h.clearSessionCookies(c)
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Failed to look up session: %v", err)
+		return nil, nil
+	}
+
+	user, err := h.db.GetUserByID(session.UserID)
+	if err != nil {
+		return nil, nil
+	}
+
+	ip := c.ClientIP()
+	if session.LastSeenAt == nil || time.Since(*session.LastSeenAt) > sessionTouchInterval || session.IPAddress != ip {
+		if err := h.db.TouchSession(session.ID, ip); err != nil {
+			log.Printf("Failed to update session %d: %v", session.ID, err)
+		}
+	}
+
+	a.session, a.user = session, user
+	return session, user
+}
+
+// requireUser resolves the logged-in user, writing a 401 response when there
+// is none.
+func (h *Handler) requireUser(c *gin.Context) (*models.User, bool) {
+	_, user := h.currentSession(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return nil, false
+	}
+	return user, true
+}
+
+// startSession creates a session for user and sets its cookie.
+func (h *Handler) startSession(c *gin.Context, user *models.User, sealedOAuthToken string) error {
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	token := generateToken()
+	session := &models.Session{
+		TokenHash:  auth.HashSessionToken(token),
+		UserID:     user.ID,
+		OAuthToken: sealedOAuthToken,
+		UserAgent:  userAgent,
+		IPAddress:  c.ClientIP(),
+		ExpiresAt:  time.Now().Add(sessionTTL),
+	}
+	if err := h.db.CreateSession(session); err != nil {
+		return err
+	}
+
+	h.setCookie(c, "auth_token", token, int(sessionTTL.Seconds()), true)
+	// user_login used to identify the user; it is no longer read, and is
+	// cleared so old browsers do not keep sending it.
+	h.setCookie(c, "user_login", "", -1, false)
+	return nil
+}
+
+func (h *Handler) clearSessionCookies(c *gin.Context) {
+	h.setCookie(c, "auth_token", "", -1, true)
+	h.setCookie(c, "user_login", "", -1, false)
+}
+
+// Logout ends the current session and clears its cookies. It succeeds when
+// there is no session too, so a stale page can always log out.
+func (h *Handler) Logout(c *gin.Context) {
+	session, user := h.currentSession(c)
+	if session != nil {
+		if _, err := h.db.DeleteSession(session.ID, user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end session"})
+			return
+		}
+		h.audit(c, user, models.AuditLogout, "session", strconv.Itoa(session.ID), nil)
+	}
+
+	h.clearSessionCookies(c)
+	h.issueCSRFToken(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// ListSessions lists the current user's active sessions with the device and
+// IP address they were last used from.
+func (h *Handler) ListSessions(c *gin.Context) {
+	current, user := h.currentSession(c)
+	if current == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return
+	}
+
+	sessions, err := h.db.ListUserSessions(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sessions"})
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Device = describeDevice(sessions[i].UserAgent)
+		sessions[i].Current = sessions[i].ID == current.ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeSession ends one of the current user's sessions, such as the one on
+// a lost laptop. Revoking the current session logs out.
+func (h *Handler) RevokeSession(c *gin.Context) {
+	current, user := h.currentSession(c)
+	if current == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	revoked, err := h.db.DeleteSession(id, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	h.audit(c, user, models.AuditSessionRevoke, "session", strconv.Itoa(id), nil)
+	if id == current.ID {
+		h.clearSessionCookies(c)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeSessions ends all of the current user's other sessions, and the
+// current one too with include_current=true.
+func (h *Handler) RevokeSessions(c *gin.Context) {
+	current, user := h.currentSession(c)
+	if current == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return
+	}
+
+	includeCurrent := c.Query("include_current") == "true"
+	keep := current.ID
+	if includeCurrent {
+		keep = 0
+	}
+
+	n, err := h.db.DeleteUserSessions(user.ID, keep)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	h.audit(c, user, models.AuditSessionRevoke, "user", user.Login, gin.H{
+		"sessions_revoked": n,
+		"include_current":  includeCurrent,
+	})
+	if includeCurrent {
+		h.clearSessionCookies(c)
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions_revoked": n})
+}
+
+// RevokeUserSessions lets an admin log a user out everywhere, for instance
+// when their account may be compromised.
+func (h *Handler) RevokeUserSessions(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	user, ok := h.userFromParam(c)
+	if !ok {
+		return
+	}
+
+	n, err := h.db.DeleteUserSessions(user.ID, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	h.audit(c, admin, models.AuditSessionRevoke, "user", user.Login, gin.H{"sessions_revoked": n})
+	c.JSON(http.StatusOK, gin.H{"sessions_revoked": n})
+}
+
+// describeDevice names the browser and operating system in a User-Agent
+// header, such as "Firefox on Linux", for the session list.
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	// Order matters: Edge and Opera also claim to be Chrome, and Chrome
+	// claims to be Safari.
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, os := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, os.token) {
+			return browser + " on " + os.name
+		}
+	}
+	return browser
+}
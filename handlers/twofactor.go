@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/auth"
+	"whistleblower/models"
+	"whistleblower/ratelimit"
+)
+
+// totpIssuer names the app in authenticator apps.
+const totpIssuer = "42 Whistleblower"
+
+// twoFactorAttemptsPerMinute caps code guesses per user. With codes valid
+// for about a minute and a half, guessing one takes weeks.
+const twoFactorAttemptsPerMinute = 5
+
+// twoFactorEnrollment returns the user's enabled authenticator, or nil.
+func (h *Handler) twoFactorEnrollment(userID int) (*models.TOTPEnrollment, error) {
+	enrollment, err := h.db.GetTOTP(userID)
+	if err == sql.ErrNoRows || (err == nil && enrollment.EnabledAt == nil) {
+		return nil, nil
+	}
+	return enrollment, err
+}
+
+// checkTwoFactor is the part of requireStaff that enforces two-factor
+// authentication: staff with an authenticator must have entered a code in
+// this session, and with STAFF_2FA_REQUIRED staff without one are sent to
+// enroll. Requests with an API key are exempt; keys are issued by admins
+// and limited to their scopes.
+func (h *Handler) checkTwoFactor(c *gin.Context, user *models.User) bool {
+	session, _ := h.currentSession(c)
+	if session == nil {
+		return true
+	}
+
+	enrollment, err := h.twoFactorEnrollment(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check two-factor authentication"})
+		return false
+	}
+
+	if enrollment == nil {
+		if h.cfg.StaffTwoFactorRequired {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":      "Staff accounts must set up two-factor authentication",
+				"two_factor": "enroll",
+			})
+			return false
+		}
+		return true
+	}
+
+	if session.MFAVerifiedAt == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Enter your two-factor code", "two_factor": "verify"})
+		return false
+	}
+	return true
+}
+
+// requireStepUp guards sensitive actions, such as bulk approvals, identity
+// reveals, role changes and exports, behind a recent re-authentication:
+// a two-factor code entered within STEP_UP_WINDOW, or for users without an
+// authenticator, a login within it.
+func (h *Handler) requireStepUp(c *gin.Context, user *models.User) bool {
+	session, _ := h.currentSession(c)
+	if session == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This action needs a logged-in browser session"})
+		return false
+	}
+
+	enrollment, err := h.twoFactorEnrollment(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check two-factor authentication"})
+		return false
+	}
+
+	since := time.Now().Add(-h.cfg.StepUpWindow)
+	if enrollment != nil {
+		if session.MFAVerifiedAt == nil || session.MFAVerifiedAt.Before(since) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Confirm this action with your two-factor code", "step_up": "totp"})
+			return false
+		}
+		return true
+	}
+
+	if session.CreatedAt.Before(since) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Log in again to confirm this action", "step_up": "login"})
+		return false
+	}
+	return true
+}
+
+// allowTwoFactorAttempt counts a code guess by user, writing a 429 response
+// when they are over the limit.
+func (h *Handler) allowTwoFactorAttempt(c *gin.Context, user *models.User) bool {
+	policy := ratelimit.Policy{Limit: twoFactorAttemptsPerMinute, Period: time.Minute}
+	allowed := h.takeRateLimit(c, "2fa|"+strconv.Itoa(user.ID), policy)
+	if !allowed {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts; wait a minute"})
+	}
+	return allowed
+}
+
+// checkSecondFactor verifies an authenticator or recovery code, writing the
+// error response itself when it is wrong. It reports whether a recovery code
+// was spent.
+func (h *Handler) checkSecondFactor(c *gin.Context, user *models.User, req models.TwoFactorCodeRequest) (recovery bool, ok bool) {
+	now := time.Now()
+	if !h.allowTwoFactorAttempt(c, user) {
+		return false, false
+	}
+
+	enrollment, err := h.twoFactorEnrollment(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check two-factor authentication"})
+		return false, false
+	}
+	if enrollment == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return false, false
+	}
+
+	var valid bool
+	switch {
+	case req.RecoveryCode != "":
+		recovery = true
+		valid, err = h.db.UseRecoveryCode(user.ID, auth.HashRecoveryCode(req.RecoveryCode))
+	case req.Code != "":
+		step, matched := auth.ValidateTOTP(enrollment.Secret, req.Code, now, enrollment.LastUsedStep)
+		if matched {
+			valid, err = h.db.UseTOTPStep(user.ID, step)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code or recovery_code is required"})
+		return false, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return false, false
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or already used code"})
+		return false, false
+	}
+	return recovery, true
+}
+
+// GetTwoFactorStatus reports whether the current user has an authenticator,
+// whether it is required, and when this session last passed a check.
+func (h *Handler) GetTwoFactorStatus(c *gin.Context) {
+	session, user := h.currentSession(c)
+	if session == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return
+	}
+
+	enrollment, err := h.db.GetTOTP(user.ID)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get two-factor status"})
+		return
+	}
+	left, err := h.db.CountRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get two-factor status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":             enrollment != nil && enrollment.EnabledAt != nil,
+		"pending":             enrollment != nil && enrollment.EnabledAt == nil,
+		"required":            h.cfg.StaffTwoFactorRequired && user.IsStaff,
+		"recovery_codes_left": left,
+		"verified_at":         session.MFAVerifiedAt,
+	})
+}
+
+// EnrollTwoFactor starts setting up an authenticator app for a staff user.
+// It returns the secret, and the otpauth:// URI to show as a QR code; the
+// authenticator is only enabled once ActivateTwoFactor sees a code from it.
+func (h *Handler) EnrollTwoFactor(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+	if !user.IsStaff {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is for staff accounts"})
+		return
+	}
+
+	secret := auth.GenerateTOTPSecret()
+	started, err := h.db.StartTOTPEnrollment(user.ID, secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrolment"})
+		return
+	}
+	if !started {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": auth.TOTPURI(totpIssuer, user.Login, secret),
+	})
+}
+
+// ActivateTwoFactor enables a pending authenticator with a first code from
+// it, and returns the user's recovery codes. They are only shown here.
+func (h *Handler) ActivateTwoFactor(c *gin.Context) {
+	session, user := h.currentSession(c)
+	if session == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+
+	now := time.Now()
+	if !h.allowTwoFactorAttempt(c, user) {
+		return
+	}
+
+	enrollment, err := h.db.GetTOTP(user.ID)
+	if err == sql.ErrNoRows || (err == nil && enrollment.EnabledAt != nil) {
+		c.JSON(http.StatusConflict, gin.H{"error": "No pending two-factor enrolment"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get enrolment"})
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(enrollment.Secret, req.Code, now, enrollment.LastUsedStep)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code; check your device's clock"})
+		return
+	}
+
+	codes := auth.GenerateRecoveryCodes()
+	if err := h.db.EnableTOTP(user.ID, step, hashRecoveryCodes(codes)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	if err := h.db.MarkSessionMFAVerified(session.ID, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+
+	h.audit(c, user, models.Audit2FAEnable, "user", user.Login, nil)
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": codes,
+		"message":        "Two-factor authentication enabled. Store the recovery codes now; they cannot be shown again",
+	})
+}
+
+// VerifyTwoFactor checks a code for the current session, after login or
+// before a sensitive action.
+func (h *Handler) VerifyTwoFactor(c *gin.Context) {
+	session, user := h.currentSession(c)
+	if session == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recovery, ok := h.checkSecondFactor(c, user, req)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := h.db.MarkSessionMFAVerified(session.ID, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+
+	response := gin.H{"verified_at": now}
+	if recovery {
+		left, err := h.db.CountRecoveryCodes(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count recovery codes"})
+			return
+		}
+		h.audit(c, user, models.Audit2FARecoveryUsed, "user", user.Login, gin.H{"recovery_codes_left": left})
+		response["recovery_codes_left"] = left
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes.
+func (h *Handler) RegenerateRecoveryCodes(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	enrollment, err := h.twoFactorEnrollment(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get enrolment"})
+		return
+	}
+	if enrollment == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !h.requireStepUp(c, user) {
+		return
+	}
+
+	codes := auth.GenerateRecoveryCodes()
+	if err := h.db.ReplaceRecoveryCodes(user.ID, hashRecoveryCodes(codes)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace recovery codes"})
+		return
+	}
+
+	h.audit(c, user, models.Audit2FARecoveryNew, "user", user.Login, nil)
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTwoFactor removes the current user's authenticator. Staff cannot
+// while two-factor authentication is required.
+func (h *Handler) DisableTwoFactor(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+	if h.cfg.StaffTwoFactorRequired && user.IsStaff {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for staff accounts"})
+		return
+	}
+	if !h.requireStepUp(c, user) {
+		return
+	}
+
+	removed, err := h.db.DeleteTOTP(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	h.audit(c, user, models.Audit2FADisable, "user", user.Login, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// ResetUserTwoFactor lets an admin remove a user's authenticator, for a lost
+// device without recovery codes. The user enrolls again at their next login.
+func (h *Handler) ResetUserTwoFactor(c *gin.Context) {
+	admin, ok := h.requireAdmin(c)
+	if !ok || !h.requireStepUp(c, admin) {
+		return
+	}
+
+	user, ok := h.userFromParam(c)
+	if !ok {
+		return
+	}
+
+	removed, err := h.db.DeleteTOTP(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The user has no authenticator"})
+		return
+	}
+
+	h.audit(c, admin, models.Audit2FAReset, "user", user.Login, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset"})
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	return hashes
+}
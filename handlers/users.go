@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"whistleblower/models"
+)
+
+// ListUsers pages through the local user table for staff, filtered by
+// campus_id, active and staff.
+func (h *Handler) ListUsers(c *gin.Context) {
+	if _, ok := h.requireStaff(c); !ok {
+		return
+	}
+
+	var filter models.UserFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, ok := pageFromQuery(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	users, next, total, err := h.db.ListUsers(filter, page)
+	if err != nil {
+		respondListError(c, err, "Failed to get users")
+		return
+	}
+
+	respondPage(c, "users", users, page, next, total)
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+	"whistleblower/markdown"
+	"whistleblower/models"
+)
+
+// Limits on submitted reports, in characters after normalization.
+const (
+	maxLoginLength       = 32
+	maxProjectNameLength = 100
+	maxReasonLength      = 50
+	minExplanationLength = 20
+	maxExplanationLength = 5000
+	// Users of other identity providers have a "provider:" prefix.
+	maxUserLoginLength = 64
+
+	// maxReportBodySize caps the request body, so an oversized explanation
+	// is refused before it is read into memory.
+	maxReportBodySize = 64 << 10
+)
+
+var (
+	// Intra logins are lowercase letters, digits, dashes and underscores.
+	loginPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	// Project names as intra spells them, like "ft_printf" or
+	// "C Piscine Shell 00".
+	projectNamePattern = regexp.MustCompile(`^[\pL\pN][\pL\pN _.+:/()'&#-]*$`)
+	reasonPattern      = regexp.MustCompile(`^[\pL\pN][\pL\pN _-]*$`)
+)
+
+// fieldErrors collects the problems found in a request.
+type fieldErrors []models.FieldError
+
+func (errs *fieldErrors) add(field, code, format string, args ...interface{}) {
+	*errs = append(*errs, models.FieldError{Field: field, Code: code, Message: field + " " + fmt.Sprintf(format, args...)})
+}
+
+// respondInvalid writes a 400 response listing the field errors.
+func respondInvalid(c *gin.Context, errs fieldErrors) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": errs[0].Message, "fields": errs})
+}
+
+// bindReportRequest reads a report from the request body, normalizes its
+// fields and checks them, writing the error response itself when it is
+// refused.
+func bindReportRequest(c *gin.Context) (models.CreateReportRequest, bool) {
+	var req models.CreateReportRequest
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxReportBodySize)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error":  "Report is too large",
+				"fields": []models.FieldError{{Code: "too_large", Message: "the report is too large"}},
+			})
+			return req, false
+		}
+		respondInvalid(c, fieldErrors{{Code: "invalid_json", Message: "the request body is not a valid report"}})
+		return req, false
+	}
+
+	var errs fieldErrors
+	req.ReportedStudentLogin = strings.ToLower(normalizeLine(req.ReportedStudentLogin))
+	req.ProjectName = normalizeLine(req.ProjectName)
+	req.Reason = normalizeLine(req.Reason)
+	req.Explanation = normalizeText(markdown.Sanitize(normalizeText(req.Explanation)))
+	req.OnBehalfOf = normalizeLine(req.OnBehalfOf)
+
+	checkField(&errs, "reported_student_login", req.ReportedStudentLogin, 1, maxLoginLength, loginPattern,
+		"may only contain lowercase letters, digits, dashes and underscores")
+	checkField(&errs, "project_name", req.ProjectName, 1, maxProjectNameLength, projectNamePattern,
+		"may only contain letters, digits, spaces and _.+:/()'&#-")
+	checkField(&errs, "reason", req.Reason, 1, maxReasonLength, reasonPattern,
+		"may only contain letters, digits, spaces, dashes and underscores")
+	checkField(&errs, "explanation", req.Explanation, minExplanationLength, maxExplanationLength, nil, "")
+	if req.OnBehalfOf != "" {
+		checkField(&errs, "on_behalf_of", req.OnBehalfOf, 1, maxUserLoginLength, nil, "")
+	}
+
+	if len(errs) > 0 {
+		respondInvalid(c, errs)
+		return req, false
+	}
+	return req, true
+}
+
+// checkField checks a normalized value's length in characters and, when
+// pattern is set, its characters.
+func checkField(errs *fieldErrors, field, value string, minLength, maxLength int, pattern *regexp.Regexp, charset string) {
+	n := utf8.RuneCountInString(value)
+	switch {
+	case n == 0:
+		errs.add(field, "required", "is required")
+	case n < minLength:
+		errs.add(field, "too_short", "must be at least %d characters", minLength)
+	case n > maxLength:
+		errs.add(field, "too_long", "must be at most %d characters", maxLength)
+	case pattern != nil && !pattern.MatchString(value):
+		errs.add(field, "invalid_characters", "%s", charset)
+	}
+}
+
+// normalizeText puts free text in a canonical form: NFC, "\n" line endings,
+// no control or invisible formatting characters (which can hide or reorder
+// text), plain spaces, tabs as four spaces, no trailing spaces and at most
+// one blank line in a row.
+func normalizeText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	s = norm.NFC.String(strings.ToValidUTF8(s, ""))
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case unicode.IsSpace(r):
+			b.WriteRune(' ')
+		case unicode.IsControl(r):
+		case unicode.Is(unicode.Cf, r) && r != '\u200c' && r != '\u200d':
+			// Dropped, except zero-width (non-)joiners, which emoji and
+			// some scripts need.
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	lines := strings.Split(b.String(), "\n")
+	out := lines[:0]
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, " ")
+		if line == "" {
+			if blank++; blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+// normalizeLine normalizes single-line text, also collapsing runs of
+// whitespace, line breaks included, into one space.
+func normalizeLine(s string) string {
+	return strings.Join(strings.Fields(normalizeText(s)), " ")
+}
@@ -0,0 +1,32 @@
+package intra
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/oauth2"
+	"whistleblower/models"
+)
+
+// GetCampuses returns one page of intra's campus list and the total number
+// of campuses (-1 if intra did not say).
+func (c *Client) GetCampuses(ctx context.Context, tokens oauth2.TokenSource, page int, perPage int) ([]models.Campus, int, error) {
+	params := url.Values{}
+	params.Set("page", strconv.Itoa(page))
+	params.Set("per_page", strconv.Itoa(perPage))
+
+	var campuses []models.Campus
+	header, err := c.doWithHeader(ctx, request{method: http.MethodGet, path: "/v2/campus", query: params, tokens: tokens}, &campuses)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := -1
+	if v, err := strconv.Atoi(header.Get("X-Total")); err == nil {
+		total = v
+	}
+
+	return campuses, total, nil
+}
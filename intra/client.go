@@ -0,0 +1,283 @@
+package intra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const DefaultBaseURL = "https://api.intra.42.fr"
+
+// Config controls how the client talks to the 42 intra API.
+type Config struct {
+	BaseURL           string
+	ClientID          string
+	ClientSecret      string
+	Timeout           time.Duration
+	MaxRetries        int
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+	RequestsPerSecond int
+}
+
+// ConfigFromEnv builds a Config from INTRA_* environment variables, falling
+// back to defaults that fit a standard 42 application (2 requests/second).
+func ConfigFromEnv() Config {
+	cfg := Config{
+		BaseURL:           DefaultBaseURL,
+		ClientID:          os.Getenv("OAUTH_42_CLIENT_ID"),
+		ClientSecret:      os.Getenv("OAUTH_42_CLIENT_SECRET"),
+		Timeout:           15 * time.Second,
+		MaxRetries:        4,
+		MinBackoff:        500 * time.Millisecond,
+		MaxBackoff:        30 * time.Second,
+		RequestsPerSecond: 2,
+	}
+
+	if v := os.Getenv("INTRA_BASE_URL"); v != "" {
+		cfg.BaseURL = strings.TrimRight(v, "/")
+	}
+	if v := os.Getenv("INTRA_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			cfg.Timeout = d
+		} else {
+			log.Printf("Warning: invalid INTRA_TIMEOUT %q, using %s", v, cfg.Timeout)
+		}
+	}
+	if v := os.Getenv("INTRA_MAX_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.MaxRetries = n
+		} else {
+			log.Printf("Warning: invalid INTRA_MAX_RETRIES %q, using %d", v, cfg.MaxRetries)
+		}
+	}
+	if v := os.Getenv("INTRA_RATE_LIMIT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.RequestsPerSecond = n
+		} else {
+			log.Printf("Warning: invalid INTRA_RATE_LIMIT %q, using %d", v, cfg.RequestsPerSecond)
+		}
+	}
+
+	return cfg
+}
+
+// Client is the single entry point for calls to the 42 intra API. It is safe
+// for concurrent use and should be shared across the process so that every
+// caller respects the same rate limit.
+type Client struct {
+	baseURL    string
+	http       *http.Client
+	limiter    *limiter
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	app        *appTokenSource
+}
+
+func NewClient(cfg Config) *Client {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultBaseURL
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+
+	c := &Client{
+		baseURL:    cfg.BaseURL,
+		http:       &http.Client{Timeout: cfg.Timeout},
+		limiter:    newLimiter(cfg.RequestsPerSecond),
+		maxRetries: cfg.MaxRetries,
+		minBackoff: cfg.MinBackoff,
+		maxBackoff: cfg.MaxBackoff,
+	}
+	c.app = newAppTokenSource(c, cfg.ClientID, cfg.ClientSecret)
+
+	return c
+}
+
+// BaseURL returns the intra root the client talks to.
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// HTTPClient returns the underlying HTTP client so the OAuth code exchange
+// uses the same timeout.
+func (c *Client) HTTPClient() *http.Client {
+	return c.http
+}
+
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	tokens      oauth2.TokenSource
+	contentType string
+	body        []byte
+}
+
+// do sends req, retrying on network errors, 429 and 5xx responses, and
+// decodes a successful JSON response into out.
+func (c *Client) do(ctx context.Context, req request, out interface{}) error {
+	_, err := c.doWithHeader(ctx, req, out)
+	return err
+}
+
+// doWithHeader is do for callers that also need the response headers, such
+// as the X-Total pagination count. The access token is fetched once, and a
+// failure to get one is returned without retrying. When intra rejects the
+// cached app token, it is replaced and the request sent once more.
+func (c *Client) doWithHeader(ctx context.Context, req request, out interface{}) (http.Header, error) {
+	token, err := c.accessToken(req)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := c.retry(ctx, req, token, out)
+	if errors.Is(err, ErrUnauthorized) && req.tokens == c.app {
+		c.app.invalidate(token)
+		if token, err = c.accessToken(req); err != nil {
+			return nil, err
+		}
+		header, err = c.retry(ctx, req, token, out)
+	}
+	return header, err
+}
+
+// accessToken returns the token req is sent with, or nil if it needs none.
+func (c *Client) accessToken(req request) (*oauth2.Token, error) {
+	if req.tokens == nil {
+		return nil, nil
+	}
+	token, err := req.tokens.Token()
+	if err != nil {
+		return nil, &TokenError{Method: req.method, Path: req.path, Err: err}
+	}
+	return token, nil
+}
+
+// retry sends req with token, retrying on network errors, 429 and 5xx
+// responses.
+func (c *Client) retry(ctx context.Context, req request, token *oauth2.Token, out interface{}) (http.Header, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt, lastErr)); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := c.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.send(ctx, req, token)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("intra %s %s: %w", req.method, req.path, err)
+			continue
+		}
+
+		c.limiter.observe(resp.Header)
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil {
+				return resp.Header, nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return nil, fmt.Errorf("intra %s %s: failed to decode response: %w", req.method, req.path, err)
+			}
+			return resp.Header, nil
+		}
+
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		apiErr := &APIError{
+			Method:     req.method,
+			Path:       req.path,
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			RetryAfter: retryAfter(resp.Header),
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			wait := apiErr.RetryAfter
+			if wait <= 0 {
+				wait = time.Second
+			}
+			c.limiter.pauseUntil(time.Now().Add(wait))
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return nil, apiErr
+		}
+		lastErr = apiErr
+	}
+
+	return nil, lastErr
+}
+
+func (c *Client) send(ctx context.Context, req request, token *oauth2.Token) (*http.Response, error) {
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Accept", "application/json")
+	if req.contentType != "" {
+		httpReq.Header.Set("Content-Type", req.contentType)
+	}
+	if token != nil {
+		token.SetAuthHeader(httpReq)
+	}
+
+	return c.http.Do(httpReq)
+}
+
+// backoff returns how long to wait before the given retry attempt. A
+// Retry-After from intra wins over the exponential schedule.
+func (c *Client) backoff(attempt int, lastErr error) time.Duration {
+	var apiErr *APIError
+	if errors.As(lastErr, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+
+	d := c.minBackoff << uint(attempt-1)
+	if d <= 0 || d > c.maxBackoff {
+		d = c.maxBackoff
+	}
+	// Equal jitter, half fixed and half random, keeps parallel syncs from
+	// retrying in lockstep.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
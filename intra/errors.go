@@ -0,0 +1,65 @@
+package intra
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("intra: unauthorized")
+	ErrForbidden    = errors.New("intra: forbidden")
+	ErrNotFound     = errors.New("intra: not found")
+	ErrRateLimited  = errors.New("intra: rate limited")
+	ErrServer       = errors.New("intra: server error")
+)
+
+// APIError is returned when intra answers with a non-2xx status after all
+// retries have been used up. It matches the sentinel errors above through
+// errors.Is so callers don't have to inspect status codes themselves.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("intra %s %s failed, status: %d", e.Method, e.Path, e.StatusCode)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// TokenError is returned when no access token could be got for a request,
+// so it was never sent. Its cause may be a 401 from the token endpoint,
+// which means the application's credentials or the user's refresh token
+// were refused, not the request.
+type TokenError struct {
+	Method string
+	Path   string
+	Err    error
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("intra %s %s: failed to get access token: %v", e.Method, e.Path, e.Err)
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
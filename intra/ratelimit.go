@@ -0,0 +1,97 @@
+package intra
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limiter spaces out requests so the whole process stays inside the
+// application's intra quota. It is shared by every caller of a Client, so
+// concurrent syncs and handlers draw from the same budget.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(requestsPerSecond int) *limiter {
+	if requestsPerSecond <= 0 {
+		requestsPerSecond = 1
+	}
+	return &limiter{interval: time.Second / time.Duration(requestsPerSecond)}
+}
+
+// wait blocks until the caller may send its next request.
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	return sleep(ctx, delay)
+}
+
+// pauseUntil holds back every request until t.
+func (l *limiter) pauseUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.next) {
+		l.next = t
+	}
+}
+
+// observe adjusts the limiter from the rate limit headers intra sends back.
+func (l *limiter) observe(header http.Header) {
+	if limit, err := strconv.Atoi(header.Get("X-Secondly-RateLimit-Limit")); err == nil && limit > 0 {
+		l.mu.Lock()
+		if interval := time.Second / time.Duration(limit); interval > l.interval {
+			l.interval = interval
+		}
+		l.mu.Unlock()
+	}
+
+	if header.Get("X-Secondly-RateLimit-Remaining") == "0" {
+		l.pauseUntil(time.Now().Add(time.Second))
+	}
+	if header.Get("X-Hourly-RateLimit-Remaining") == "0" {
+		l.pauseUntil(time.Now().Truncate(time.Hour).Add(time.Hour))
+	}
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an
+// HTTP date.
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,123 @@
+package intra
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// appTokenEarlyExpiry is how long before expires_in the cached application
+// token gets replaced, so no request goes out with a token that dies in
+// flight.
+const appTokenEarlyExpiry = time.Minute
+
+const appTokenFetchTimeout = 2 * time.Minute
+
+// appTokenFetcher requests application tokens through the client
+// credentials grant.
+type appTokenFetcher struct {
+	client       *Client
+	clientID     string
+	clientSecret string
+}
+
+// appTokenSource caches the application token and serialises refreshes
+// across goroutines. Unlike oauth2.ReuseTokenSource, it can drop a token
+// that intra rejects before its expiry.
+type appTokenSource struct {
+	fetcher *appTokenFetcher
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func newAppTokenSource(client *Client, clientID, clientSecret string) *appTokenSource {
+	return &appTokenSource{fetcher: &appTokenFetcher{
+		client:       client,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+	}}
+}
+
+// Token returns the cached token, fetching a new one when there is none or
+// it expires within appTokenEarlyExpiry.
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && (s.token.Expiry.IsZero() || time.Until(s.token.Expiry) > appTokenEarlyExpiry) {
+		return s.token, nil
+	}
+	token, err := s.fetcher.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return token, nil
+}
+
+// invalidate drops the cached token if it is still stale, so the next call
+// to Token fetches a new one. A token another goroutine already replaced is
+// kept.
+func (s *appTokenSource) invalidate(stale *oauth2.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == stale {
+		s.token = nil
+	}
+}
+
+func (f *appTokenFetcher) Token() (*oauth2.Token, error) {
+	if f.clientID == "" || f.clientSecret == "" {
+		return nil, errors.New("intra: OAUTH_42_CLIENT_ID and OAUTH_42_CLIENT_SECRET are required for app tokens")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", f.clientID)
+	form.Set("client_secret", f.clientSecret)
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	// oauth2.TokenSource has no context, so bound the fetch ourselves.
+	ctx, cancel := context.WithTimeout(context.Background(), appTokenFetchTimeout)
+	defer cancel()
+
+	req := request{
+		method:      http.MethodPost,
+		path:        "/oauth/token",
+		contentType: "application/x-www-form-urlencoded",
+		body:        []byte(form.Encode()),
+	}
+	if err := f.client.do(ctx, req, &tokenResponse); err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken: tokenResponse.AccessToken,
+		TokenType:   tokenResponse.TokenType,
+	}
+	if tokenResponse.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+
+	return token, nil
+}
+
+// AppTokenSource returns the shared, cached token source for the
+// application's own credentials. Every handler and background job that
+// calls intra as the application should use it instead of requesting a new
+// token per call.
+func (c *Client) AppTokenSource() oauth2.TokenSource {
+	return c.app
+}
@@ -0,0 +1,101 @@
+package intra
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+	"whistleblower/models"
+)
+
+// Me returns the intra user the token belongs to.
+func (c *Client) Me(ctx context.Context, tokens oauth2.TokenSource) (*models.Auth42User, error) {
+	var user models.Auth42User
+	err := c.do(ctx, request{method: http.MethodGet, path: "/v2/me", tokens: tokens}, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *Client) SearchStudents(ctx context.Context, query string, tokens oauth2.TokenSource) ([]models.StudentSearchResult, error) {
+	params := url.Values{}
+	params.Set("search[login]", query)
+	params.Set("per_page", "10")
+
+	var users []struct {
+		Login       string `json:"login"`
+		DisplayName string `json:"displayname"`
+		Email       string `json:"email"`
+	}
+
+	req := request{method: http.MethodGet, path: "/v2/users", query: params, tokens: tokens}
+	if err := c.do(ctx, req, &users); err != nil {
+		return nil, err
+	}
+
+	results := make([]models.StudentSearchResult, len(users))
+	for i, user := range users {
+		results[i] = models.StudentSearchResult{
+			Login:       user.Login,
+			DisplayName: user.DisplayName,
+			Email:       user.Email,
+		}
+	}
+
+	return results, nil
+}
+
+func (c *Client) GetStudentProjects(ctx context.Context, login string, tokens oauth2.TokenSource) ([]string, error) {
+	var projectUsers []struct {
+		Project struct {
+			Name string `json:"name"`
+		} `json:"project"`
+	}
+
+	path := "/v2/users/" + url.PathEscape(login) + "/projects_users"
+	if err := c.do(ctx, request{method: http.MethodGet, path: path, tokens: tokens}, &projectUsers); err != nil {
+		return nil, err
+	}
+
+	projects := make([]string, len(projectUsers))
+	for i, pu := range projectUsers {
+		projects[i] = pu.Project.Name
+	}
+
+	return projects, nil
+}
+
+// GetCampusUsers fetches one page of /v2/campus/{id}/users, which works with
+// client credentials. A non-zero updatedFrom restricts the page to users
+// updated between updatedFrom and updatedTo, through intra's
+// range[updated_at] filter, sorted by updated_at then ID. The second return
+// value is the total number of matching users from X-Total, or -1 when intra
+// did not send it.
+func (c *Client) GetCampusUsers(ctx context.Context, campusID int, tokens oauth2.TokenSource, page int, perPage int, updatedFrom, updatedTo time.Time) ([]models.Auth42User, int, error) {
+	params := url.Values{}
+	params.Set("page", strconv.Itoa(page))
+	params.Set("per_page", strconv.Itoa(perPage))
+	if !updatedFrom.IsZero() {
+		params.Set("range[updated_at]", updatedFrom.UTC().Format(time.RFC3339)+","+updatedTo.UTC().Format(time.RFC3339))
+		params.Set("sort", "updated_at,id")
+	}
+
+	var users []models.Auth42User
+	path := fmt.Sprintf("/v2/campus/%d/users", campusID)
+	header, err := c.doWithHeader(ctx, request{method: http.MethodGet, path: path, query: params, tokens: tokens}, &users)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := -1
+	if v, err := strconv.Atoi(header.Get("X-Total")); err == nil {
+		total = v
+	}
+
+	return users, total, nil
+}
@@ -0,0 +1,532 @@
+// Package jobs runs background work such as campus syncs inside the server
+// process. Jobs are persisted in the jobs table, so they survive restarts
+// and can be inspected and cancelled through the staff API.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"whistleblower/database"
+	"whistleblower/models"
+)
+
+const (
+	pollInterval      = 2 * time.Second
+	scheduleInterval  = 30 * time.Second
+	heartbeatInterval = 10 * time.Second
+	// staleAfter is how long a running job may go without a heartbeat
+	// before another runner assumes its process died and requeues it.
+	staleAfter = 2 * time.Minute
+)
+
+var ErrUnknownKind = errors.New("unknown job kind")
+
+// Func does the work of one job. It should return soon after ctx is
+// cancelled; the returned value is stored as the job's result.
+type Func func(ctx context.Context, run *Run) (interface{}, error)
+
+type Definition struct {
+	Kind string
+	// LockKey derives the single-instance key from the job params. Jobs
+	// sharing a key never run at the same time. Defaults to Kind.
+	LockKey func(params json.RawMessage) (string, error)
+	// MaxRunning caps how many jobs of this kind one runner executes at
+	// once, below the runner's overall concurrency. Zero means no extra
+	// limit.
+	MaxRunning int
+	Run        Func
+}
+
+// Run is the handle a running job uses to read its params and report
+// progress.
+type Run struct {
+	Job *models.Job
+	db  *database.DB
+}
+
+func (r *Run) Params(v interface{}) error {
+	if len(r.Job.Params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Job.Params, v)
+}
+
+// SetProgress stores v as the job's progress, visible through the jobs API.
+func (r *Run) SetProgress(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.Job.Progress = data
+	return r.db.UpdateJobProgress(r.Job.ID, data)
+}
+
+type Schedule struct {
+	Name    string          `json:"name"`
+	Spec    string          `json:"spec"`
+	Kind    string          `json:"kind"`
+	Params  json.RawMessage `json:"params"`
+	NextRun time.Time       `json:"next_run"`
+
+	cron *cronSpec
+}
+
+type Runner struct {
+	db          *database.DB
+	owner       string
+	concurrency int
+	defs        map[string]Definition
+
+	mu        sync.Mutex
+	schedules []*Schedule
+	running   map[int]context.CancelFunc
+	perKind   map[string]int
+	wake      chan struct{}
+}
+
+func NewRunner(db *database.DB, concurrency int) *Runner {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	hostname, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return &Runner{
+		db:          db,
+		owner:       fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b)),
+		concurrency: concurrency,
+		defs:        make(map[string]Definition),
+		running:     make(map[int]context.CancelFunc),
+		perKind:     make(map[string]int),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func (r *Runner) Register(def Definition) {
+	r.defs[def.Kind] = def
+}
+
+// Kinds returns the registered job kinds.
+func (r *Runner) Kinds() []string {
+	kinds := make([]string, 0, len(r.defs))
+	for kind := range r.defs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// AddSchedule enqueues a job of kind with params every time the five-field
+// cron spec matches, in server local time.
+func (r *Runner) AddSchedule(name, spec, kind string, params interface{}) error {
+	if _, ok := r.defs[kind]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+	}
+
+	cron, err := parseCron(spec)
+	if err != nil {
+		return err
+	}
+
+	data, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schedules = append(r.schedules, &Schedule{
+		Name:    name,
+		Spec:    spec,
+		Kind:    kind,
+		Params:  data,
+		NextRun: cron.next(time.Now()),
+		cron:    cron,
+	})
+	return nil
+}
+
+func (r *Runner) Schedules() []Schedule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	schedules := make([]Schedule, len(r.schedules))
+	for i, s := range r.schedules {
+		schedules[i] = *s
+	}
+	return schedules
+}
+
+// Enqueue persists a new job and wakes the runner.
+func (r *Runner) Enqueue(kind string, params interface{}, requestedBy string) (*models.Job, error) {
+	job, err := r.newJob(kind, params, requestedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.db.CreateJob(job); err != nil {
+		return nil, err
+	}
+
+	r.notify()
+	return job, nil
+}
+
+// EnqueueUnique queues a job unless one with the same lock key is already
+// queued or running, in which case that job is returned with created set to
+// false.
+func (r *Runner) EnqueueUnique(kind string, params interface{}, requestedBy string) (job *models.Job, created bool, err error) {
+	job, err = r.newJob(kind, params, requestedBy)
+	if err != nil {
+		return nil, false, err
+	}
+
+	job, created, err = r.db.CreateUniqueJob(job)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if created {
+		r.notify()
+	}
+	return job, created, nil
+}
+
+// Retry requeues a failed or cancelled job with its saved progress, so jobs
+// that checkpoint resume instead of starting over.
+func (r *Runner) Retry(id int) (*models.Job, error) {
+	job, err := r.db.RequeueJob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.notify()
+	return job, nil
+}
+
+func (r *Runner) newJob(kind string, params interface{}, requestedBy string) (*models.Job, error) {
+	def, ok := r.defs[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+	}
+
+	data, err := marshalParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	lockKey := kind
+	if def.LockKey != nil {
+		if lockKey, err = def.LockKey(data); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+	}
+
+	return &models.Job{
+		Kind:        kind,
+		Params:      data,
+		LockKey:     lockKey,
+		RequestedBy: requestedBy,
+	}, nil
+}
+
+// Cancel stops a queued job immediately and asks a running one to stop.
+func (r *Runner) Cancel(id int) (*models.Job, error) {
+	job, err := r.db.RequestJobCancel(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	if cancel, ok := r.running[id]; ok {
+		cancel()
+	}
+	r.mu.Unlock()
+
+	return job, nil
+}
+
+// Start runs the scheduler and worker loops until ctx is done.
+func (r *Runner) Start(ctx context.Context) {
+	go r.scheduleLoop(ctx)
+	go r.workLoop(ctx)
+	log.Printf("Job runner started (owner %s, concurrency %d)", r.owner, r.concurrency)
+}
+
+func (r *Runner) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Runner) workLoop(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := r.db.RequeueStaleJobs(time.Now().Add(-staleAfter)); err != nil {
+			log.Printf("Failed to requeue stale jobs: %v", err)
+		} else if n > 0 {
+			log.Printf("Requeued %d stale jobs", n)
+		}
+
+		r.claimJobs(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+func (r *Runner) claimJobs(ctx context.Context) {
+	for {
+		r.mu.Lock()
+		full := len(r.running) >= r.concurrency
+		var skipKinds []string
+		for kind, def := range r.defs {
+			if def.MaxRunning > 0 && r.perKind[kind] >= def.MaxRunning {
+				skipKinds = append(skipKinds, kind)
+			}
+		}
+		r.mu.Unlock()
+		if full {
+			return
+		}
+
+		job, err := r.db.ClaimNextJob(r.owner, skipKinds)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to claim job: %v", err)
+			return
+		}
+
+		jobCtx, cancel := context.WithCancel(ctx)
+		r.mu.Lock()
+		r.running[job.ID] = cancel
+		r.perKind[job.Kind]++
+		r.mu.Unlock()
+
+		go r.execute(jobCtx, cancel, job)
+	}
+}
+
+func (r *Runner) execute(ctx context.Context, cancel context.CancelFunc, job *models.Job) {
+	defer func() {
+		cancel()
+		r.mu.Lock()
+		delete(r.running, job.ID)
+		r.perKind[job.Kind]--
+		r.mu.Unlock()
+		r.notify()
+	}()
+
+	def, ok := r.defs[job.Kind]
+	if !ok {
+		r.finish(job, "failed", nil, fmt.Errorf("%w: %s", ErrUnknownKind, job.Kind))
+		return
+	}
+
+	done := make(chan struct{})
+	go r.heartbeat(job.ID, cancel, done)
+
+	log.Printf("Job %d (%s) started", job.ID, job.Kind)
+	result, err := safeRun(ctx, def.Run, &Run{Job: job, db: r.db})
+	close(done)
+
+	if err != nil && ctx.Err() != nil {
+		// Both Cancel and the heartbeat only cancel the context after the
+		// request is stored, so the stored flag tells a cancel apart from
+		// a server shutdown.
+		if stored, getErr := r.db.GetJob(job.ID); getErr == nil && stored.CancelRequested {
+			r.finish(job, "cancelled", result, err)
+			return
+		}
+		// Leave the job running so it is requeued once its heartbeat goes
+		// stale.
+		log.Printf("Job %d (%s) interrupted by shutdown", job.ID, job.Kind)
+		return
+	}
+
+	if err != nil {
+		r.finish(job, "failed", result, err)
+		return
+	}
+	r.finish(job, "succeeded", result, nil)
+}
+
+// heartbeat keeps the job's heartbeat fresh until done is closed, and
+// cancels it once a cancel has been requested from any instance.
+func (r *Runner) heartbeat(jobID int, cancel context.CancelFunc, done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			cancelRequested, err := r.db.HeartbeatJob(jobID)
+			if err != nil {
+				log.Printf("Job %d heartbeat failed: %v", jobID, err)
+				continue
+			}
+			if cancelRequested {
+				cancel()
+			}
+		}
+	}
+}
+
+func safeRun(ctx context.Context, fn Func, run *Run) (result interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return fn(ctx, run)
+}
+
+func (r *Runner) finish(job *models.Job, status string, result interface{}, jobErr error) {
+	var data []byte
+	if result != nil {
+		var err error
+		if data, err = json.Marshal(result); err != nil {
+			log.Printf("Job %d result could not be encoded: %v", job.ID, err)
+		}
+	}
+
+	var errMsg string
+	if jobErr != nil {
+		errMsg = jobErr.Error()
+	}
+
+	if err := r.db.FinishJob(job.ID, status, data, errMsg); err != nil {
+		log.Printf("Failed to record job %d as %s: %v", job.ID, status, err)
+		return
+	}
+
+	// Jobs act on behalf of whoever requested them, so their outcome goes
+	// into the audit log next to the request that started them.
+	summary := map[string]interface{}{"kind": job.Kind, "status": status}
+	if data != nil {
+		summary["result"] = json.RawMessage(data)
+	}
+	if errMsg != "" {
+		summary["error"] = errMsg
+	}
+	details, _ := json.Marshal(summary)
+	entry := &models.AuditEntry{
+		ActorLogin: job.RequestedBy,
+		Action:     models.AuditJobFinish,
+		TargetType: "job",
+		TargetID:   fmt.Sprint(job.ID),
+		Details:    details,
+	}
+	if err := r.db.AppendAuditEntry(entry); err != nil {
+		log.Printf("Failed to audit job %d: %v", job.ID, err)
+	}
+	if jobErr != nil {
+		log.Printf("Job %d (%s) %s: %v", job.ID, job.Kind, status, jobErr)
+	} else {
+		log.Printf("Job %d (%s) %s", job.ID, job.Kind, status)
+	}
+}
+
+func (r *Runner) scheduleLoop(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		r.runDueSchedules()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Runner) runDueSchedules() {
+	now := time.Now()
+
+	r.mu.Lock()
+	var due []Schedule
+	for _, s := range r.schedules {
+		if s.NextRun.IsZero() || now.Before(s.NextRun) {
+			continue
+		}
+		due = append(due, *s)
+		s.NextRun = s.cron.next(now)
+	}
+	r.mu.Unlock()
+
+	for _, s := range due {
+		claimed, err := r.db.ClaimScheduleRun(s.Name, s.NextRun)
+		if err != nil {
+			log.Printf("Schedule %s: failed to claim run: %v", s.Name, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		job, err := r.newJob(s.Kind, s.Params, "schedule:"+s.Name)
+		if err != nil {
+			log.Printf("Schedule %s: invalid job: %v", s.Name, err)
+			continue
+		}
+
+		// Don't pile up runs behind one that is still queued or running.
+		job, created, err := r.db.CreateUniqueJob(job)
+		if err != nil {
+			log.Printf("Schedule %s: failed to enqueue job: %v", s.Name, err)
+			continue
+		}
+		if !created {
+			log.Printf("Schedule %s: skipped, %s is still active", s.Name, job.LockKey)
+			continue
+		}
+		r.notify()
+
+		if err := r.db.SetScheduleRunJob(s.Name, s.NextRun, job.ID); err != nil {
+			log.Printf("Schedule %s: failed to record job: %v", s.Name, err)
+		}
+	}
+}
+
+func marshalParams(params interface{}) (json.RawMessage, error) {
+	switch p := params.(type) {
+	case nil:
+		return json.RawMessage(`{}`), nil
+	case json.RawMessage:
+		if len(p) == 0 {
+			return json.RawMessage(`{}`), nil
+		}
+		if !json.Valid(p) {
+			return nil, errors.New("params are not valid JSON")
+		}
+		return p, nil
+	default:
+		return json.Marshal(p)
+	}
+}
@@ -0,0 +1,449 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"whistleblower/campussync"
+	"whistleblower/database"
+	"whistleblower/models"
+)
+
+const (
+	KindCampusSync             = "campus_sync"
+	KindCampusSyncAll          = "campus_sync_all"
+	KindCampusDirectoryRefresh = "campus_directory_refresh"
+	KindNotificationDigest     = "notification_digest"
+	KindRetentionPurge         = "retention_purge"
+)
+
+// Config lists the built-in schedules. An empty spec disables a schedule.
+type Config struct {
+	SyncCampusIDs []int
+	// SyncAllCampuses schedules a sync of every active campus in the
+	// directory instead of SyncCampusIDs.
+	SyncAllCampuses bool
+	SyncSchedule    string
+	// SyncParallelism is how many campus syncs run at once. They all share
+	// the intra client's rate budget.
+	SyncParallelism   int
+	DirectorySchedule string
+	DigestSchedule    string
+	PurgeSchedule     string
+	JobRetention      time.Duration
+	// RetentionPolicies are applied by every retention purge, in order.
+	RetentionPolicies []models.RetentionPolicy
+}
+
+func ConfigFromEnv() Config {
+	cfg := Config{
+		SyncSchedule:      "0 3 * * *",
+		SyncParallelism:   2,
+		DirectorySchedule: "0 2 * * 0",
+		DigestSchedule:    "0 8 * * *",
+		PurgeSchedule:     "30 4 * * *",
+		JobRetention:      30 * 24 * time.Hour,
+	}
+
+	for _, id := range strings.Split(os.Getenv("SYNC_CAMPUS_IDS"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if id == "all" {
+			cfg.SyncAllCampuses = true
+			continue
+		}
+		campusID, err := strconv.Atoi(id)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid campus ID %q in SYNC_CAMPUS_IDS", id)
+			continue
+		}
+		cfg.SyncCampusIDs = append(cfg.SyncCampusIDs, campusID)
+	}
+
+	if v, ok := os.LookupEnv("SYNC_SCHEDULE"); ok {
+		cfg.SyncSchedule = v
+	}
+	if v := os.Getenv("SYNC_PARALLELISM"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.SyncParallelism = n
+		} else {
+			log.Printf("Warning: invalid SYNC_PARALLELISM %q", v)
+		}
+	}
+	if v, ok := os.LookupEnv("CAMPUS_DIRECTORY_SCHEDULE"); ok {
+		cfg.DirectorySchedule = v
+	}
+	if v, ok := os.LookupEnv("DIGEST_SCHEDULE"); ok {
+		cfg.DigestSchedule = v
+	}
+	if v, ok := os.LookupEnv("PURGE_SCHEDULE"); ok {
+		cfg.PurgeSchedule = v
+	}
+	if v := os.Getenv("JOB_RETENTION_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil && days > 0 {
+			cfg.JobRetention = time.Duration(days) * 24 * time.Hour
+		} else {
+			log.Printf("Warning: invalid JOB_RETENTION_DAYS %q", v)
+		}
+	}
+	if v := os.Getenv("RETENTION_POLICIES"); v != "" {
+		policies, err := database.ParseRetentionPolicies(v)
+		if err != nil {
+			log.Printf("Warning: ignoring RETENTION_POLICIES: %v", err)
+		} else {
+			cfg.RetentionPolicies = policies
+		}
+	}
+
+	return cfg
+}
+
+// RegisterDefaults registers the built-in job kinds and their schedules.
+func RegisterDefaults(r *Runner, db *database.DB, syncer *campussync.Syncer, cfg Config) error {
+	r.Register(Definition{
+		Kind:       KindCampusSync,
+		LockKey:    campusSyncLockKey,
+		MaxRunning: cfg.SyncParallelism,
+		Run:        campusSyncJob(syncer),
+	})
+	r.Register(Definition{
+		Kind: KindCampusSyncAll,
+		Run:  campusSyncAllJob(r, db),
+	})
+	r.Register(Definition{
+		Kind: KindCampusDirectoryRefresh,
+		Run:  campusDirectoryRefreshJob(syncer),
+	})
+	r.Register(Definition{
+		Kind: KindNotificationDigest,
+		Run:  notificationDigestJob(db),
+	})
+	r.Register(Definition{
+		Kind: KindRetentionPurge,
+		Run:  retentionPurgeJob(db, cfg.JobRetention, cfg.RetentionPolicies),
+	})
+
+	if cfg.SyncSchedule != "" && cfg.SyncAllCampuses {
+		if err := r.AddSchedule("campus-sync-all", cfg.SyncSchedule, KindCampusSyncAll, nil); err != nil {
+			return fmt.Errorf("schedule campus-sync-all: %w", err)
+		}
+	} else if cfg.SyncSchedule != "" {
+		for _, campusID := range cfg.SyncCampusIDs {
+			name := fmt.Sprintf("campus-sync-%d", campusID)
+			if err := r.AddSchedule(name, cfg.SyncSchedule, KindCampusSync, CampusSyncParams{CampusID: campusID}); err != nil {
+				return fmt.Errorf("schedule %s: %w", name, err)
+			}
+		}
+	}
+	if cfg.DirectorySchedule != "" {
+		if err := r.AddSchedule("campus-directory-refresh", cfg.DirectorySchedule, KindCampusDirectoryRefresh, nil); err != nil {
+			return fmt.Errorf("schedule campus-directory-refresh: %w", err)
+		}
+	}
+	if cfg.DigestSchedule != "" {
+		if err := r.AddSchedule("notification-digest", cfg.DigestSchedule, KindNotificationDigest, nil); err != nil {
+			return fmt.Errorf("schedule notification-digest: %w", err)
+		}
+	}
+	if cfg.PurgeSchedule != "" {
+		if err := r.AddSchedule("retention-purge", cfg.PurgeSchedule, KindRetentionPurge, nil); err != nil {
+			return fmt.Errorf("schedule retention-purge: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type CampusSyncParams struct {
+	CampusID int  `json:"campus_id"`
+	Full     bool `json:"full,omitempty"`
+}
+
+// campusSyncPageRetries is how often a sync job retries a failing page
+// before it fails. A failed job can be retried and continues from its last
+// checkpoint.
+const campusSyncPageRetries = 3
+
+// maxProgressErrors caps the errors kept in a job's progress.
+const maxProgressErrors = 20
+
+type CampusSyncProgress struct {
+	PagesFetched   int                    `json:"pages_fetched"`
+	PagesTotal     int                    `json:"pages_total,omitempty"`
+	UsersProcessed int                    `json:"users_processed"`
+	UsersTotal     int                    `json:"users_total,omitempty"`
+	Errors         []string               `json:"errors,omitempty"`
+	ETASeconds     *int                   `json:"eta_seconds,omitempty"`
+	Checkpoint     *campussync.Checkpoint `json:"checkpoint,omitempty"`
+}
+
+func campusSyncLockKey(params json.RawMessage) (string, error) {
+	var p CampusSyncParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return "", err
+	}
+	if p.CampusID <= 0 {
+		return "", errors.New("campus_id is required")
+	}
+	return fmt.Sprintf("%s:%d", KindCampusSync, p.CampusID), nil
+}
+
+func campusSyncJob(syncer *campussync.Syncer) Func {
+	return func(ctx context.Context, run *Run) (interface{}, error) {
+		var p CampusSyncParams
+		if err := run.Params(&p); err != nil {
+			return nil, err
+		}
+
+		// A job that failed or was interrupted part way keeps its
+		// checkpoint in the progress, so a retry picks up from there.
+		var progress CampusSyncProgress
+		if len(run.Job.Progress) > 0 {
+			if err := json.Unmarshal(run.Job.Progress, &progress); err != nil {
+				log.Printf("Job %d: ignoring unreadable progress: %v", run.Job.ID, err)
+				progress = CampusSyncProgress{}
+			}
+		}
+		if progress.Checkpoint != nil {
+			log.Printf("Job %d: resuming campus %d sync at page %d", run.Job.ID, p.CampusID, progress.Checkpoint.NextPage)
+		}
+
+		runStarted := time.Now()
+		pagesAtStart := progress.PagesFetched
+		save := func() {
+			if err := run.SetProgress(progress); err != nil {
+				log.Printf("Job %d: failed to save progress: %v", run.Job.ID, err)
+			}
+		}
+
+		return syncer.SyncCampus(ctx, p.CampusID, campussync.Options{
+			Full:        p.Full,
+			Resume:      progress.Checkpoint,
+			PageRetries: campusSyncPageRetries,
+			OnPage: func(cp campussync.Checkpoint, totalUsers int) {
+				progress.Checkpoint = &cp
+				progress.PagesFetched = cp.NextPage - 1
+				progress.UsersProcessed = cp.Summary.Fetched
+				if totalUsers >= 0 {
+					progress.UsersTotal = totalUsers
+					progress.PagesTotal = (totalUsers + campussync.PerPage - 1) / campussync.PerPage
+				}
+				progress.ETASeconds = estimateRemaining(runStarted, progress.PagesFetched-pagesAtStart,
+					progress.PagesTotal-progress.PagesFetched)
+				save()
+			},
+			OnPageError: func(page int, err error) {
+				progress.Errors = append(progress.Errors, fmt.Sprintf("page %d: %v", page, err))
+				if len(progress.Errors) > maxProgressErrors {
+					progress.Errors = progress.Errors[len(progress.Errors)-maxProgressErrors:]
+				}
+				save()
+			},
+		})
+	}
+}
+
+// estimateRemaining extrapolates the time per page seen so far in this run
+// to the pages left. It returns nil until there is something to go on.
+func estimateRemaining(started time.Time, pagesDone, pagesLeft int) *int {
+	if pagesDone <= 0 || pagesLeft < 0 {
+		return nil
+	}
+	perPage := time.Since(started) / time.Duration(pagesDone)
+	seconds := int((perPage * time.Duration(pagesLeft)).Seconds())
+	return &seconds
+}
+
+// EnqueueCampusSyncs queues a sync for each campus, reusing any sync of the
+// same campus that is already queued or running. The runner runs at most
+// SyncParallelism of them at a time.
+func EnqueueCampusSyncs(r *Runner, campusIDs []int, full bool, requestedBy string) ([]*models.Job, error) {
+	var queued []*models.Job
+	for _, campusID := range campusIDs {
+		job, _, err := r.EnqueueUnique(KindCampusSync, CampusSyncParams{CampusID: campusID, Full: full}, requestedBy)
+		if err != nil {
+			return queued, fmt.Errorf("campus %d: %w", campusID, err)
+		}
+		queued = append(queued, job)
+	}
+	return queued, nil
+}
+
+type CampusSyncAllParams struct {
+	Full bool `json:"full,omitempty"`
+}
+
+type CampusSyncAllResult struct {
+	Campuses int   `json:"campuses"`
+	JobIDs   []int `json:"job_ids"`
+}
+
+// campusSyncAllJob fans out into one campus_sync job per active campus in
+// the directory, so each campus keeps its own lock, progress and resume.
+func campusSyncAllJob(r *Runner, db *database.DB) Func {
+	return func(ctx context.Context, run *Run) (interface{}, error) {
+		var p CampusSyncAllParams
+		if err := run.Params(&p); err != nil {
+			return nil, err
+		}
+
+		campusIDs, err := db.GetActiveCampusIDs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load campus directory: %w", err)
+		}
+
+		queued, err := EnqueueCampusSyncs(r, campusIDs, p.Full, run.Job.RequestedBy)
+		result := &CampusSyncAllResult{Campuses: len(campusIDs)}
+		for _, job := range queued {
+			result.JobIDs = append(result.JobIDs, job.ID)
+		}
+		return result, err
+	}
+}
+
+type CampusDirectoryRefreshResult struct {
+	Campuses int `json:"campuses"`
+}
+
+func campusDirectoryRefreshJob(syncer *campussync.Syncer) Func {
+	return func(ctx context.Context, run *Run) (interface{}, error) {
+		count, err := syncer.RefreshDirectory(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("Campus directory refreshed: %d campuses", count)
+		return &CampusDirectoryRefreshResult{Campuses: count}, nil
+	}
+}
+
+type NotificationDigestParams struct {
+	Hours int `json:"hours,omitempty"`
+}
+
+type NotificationDigest struct {
+	Since         time.Time                  `json:"since"`
+	Count         int                        `json:"count"`
+	Notifications []models.StaffNotification `json:"notifications"`
+	AccessAlerts  []models.AccessAlert       `json:"access_alerts"`
+}
+
+// notificationDigestJob collects unresolved threshold notifications from the
+// last day (or params.hours) into one digest, stored as the job result and
+// written to the log.
+func notificationDigestJob(db *database.DB) Func {
+	return func(ctx context.Context, run *Run) (interface{}, error) {
+		p := NotificationDigestParams{Hours: 24}
+		if err := run.Params(&p); err != nil {
+			return nil, err
+		}
+
+		since := time.Now().Add(-time.Duration(p.Hours) * time.Hour)
+		notifications, err := db.GetUnresolvedNotificationsSince(since)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("Notification digest: %d unresolved projects reached the report threshold since %s",
+			len(notifications), since.Format(time.RFC3339))
+		for _, n := range notifications {
+			log.Printf("  %s - %s: %d reports", n.ReportedStudentLogin, n.ProjectName, n.ReportCount)
+		}
+
+		alerts, err := db.GetUnresolvedAccessAlertsSince(since)
+		if err != nil {
+			return nil, err
+		}
+		if len(alerts) > 0 {
+			log.Printf("Notification digest: %d unresolved report access alerts", len(alerts))
+			for _, a := range alerts {
+				log.Printf("  %s read %d reports", a.Login, a.ReportCount)
+			}
+		}
+
+		return NotificationDigest{
+			Since:         since,
+			Count:         len(notifications),
+			Notifications: notifications,
+			AccessAlerts:  alerts,
+		}, nil
+	}
+}
+
+// RetentionPurgeParams are the optional parameters of a retention purge.
+// A dry run changes nothing and reports what a purge would remove.
+type RetentionPurgeParams struct {
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+type RetentionPurgeResult struct {
+	DryRun          bool                      `json:"dry_run,omitempty"`
+	ExpiredSessions int                       `json:"expired_sessions"`
+	FinishedJobs    int                       `json:"finished_jobs"`
+	Policies        []models.RetentionOutcome `json:"policies,omitempty"`
+}
+
+func retentionPurgeJob(db *database.DB, jobRetention time.Duration, policies []models.RetentionPolicy) Func {
+	return func(ctx context.Context, run *Run) (interface{}, error) {
+		var p RetentionPurgeParams
+		if err := run.Params(&p); err != nil {
+			return nil, err
+		}
+		return RetentionPurge(ctx, db, jobRetention, policies, p.DryRun)
+	}
+}
+
+// RetentionPurge removes expired sessions, old finished jobs and what the
+// retention policies cover, logging what it removed. With dryRun set it only
+// reports what it would remove.
+func RetentionPurge(ctx context.Context, db *database.DB, jobRetention time.Duration, policies []models.RetentionPolicy, dryRun bool) (*RetentionPurgeResult, error) {
+	result := &RetentionPurgeResult{DryRun: dryRun}
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+
+	if !dryRun {
+		var err error
+		if result.ExpiredSessions, err = db.DeleteExpiredSessions(); err != nil {
+			return nil, fmt.Errorf("failed to purge sessions: %w", err)
+		}
+		if result.FinishedJobs, err = db.DeleteFinishedJobsBefore(time.Now().Add(-jobRetention)); err != nil {
+			return result, fmt.Errorf("failed to purge jobs: %w", err)
+		}
+		log.Printf("Retention purge: removed %d expired sessions and %d finished jobs",
+			result.ExpiredSessions, result.FinishedJobs)
+	}
+
+	now := time.Now()
+	for _, policy := range policies {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		outcome, err := db.ApplyRetentionPolicy(policy, now, dryRun)
+		if outcome != nil {
+			result.Policies = append(result.Policies, *outcome)
+		}
+		if err != nil {
+			return result, fmt.Errorf("retention policy %s: %w", database.RetentionPolicyName(policy), err)
+		}
+
+		count := outcome.Applied
+		if dryRun {
+			count = outcome.Matched - outcome.Held
+		}
+		log.Printf("Retention purge: %s %d records under %s (older than %s, %d kept by legal holds)",
+			verb, count, outcome.Policy, outcome.Cutoff.Format(time.RFC3339), outcome.Held)
+	}
+	return result, nil
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"whistleblower/auth"
+	"whistleblower/campussync"
 	"whistleblower/database"
+	"whistleblower/encryption"
+	"whistleblower/fakeintra"
 	"whistleblower/handlers"
+	"whistleblower/intra"
+	"whistleblower/jobs"
 )
 
 func main() {
@@ -16,35 +27,78 @@ func main() {
 		log.Fatal("Failed to load environment variables:", err)
 	}
 
-	auth.InitOAuth()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	if os.Getenv("FAKE_INTRA") == "true" {
+		if err := startFakeIntra(); err != nil {
+			log.Fatal("Failed to start fake intra server:", err)
+		}
+	}
 
-	// Get database path from environment or use default
-	dbPath := os.Getenv("DB_PATH")
-	if dbPath == "" {
-		dbPath = "whistleblower.db"
+	intraClient := intra.NewClient(intra.ConfigFromEnv())
+	providers, err := auth.ProvidersFromEnv(intraClient)
+	if err != nil {
+		log.Fatal("Failed to configure identity providers:", err)
 	}
-	
-	db, err := database.NewDatabase(dbPath)
+
+	db, err := database.NewDatabase(databasePath())
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 	defer db.Close()
 
-	h := handlers.NewHandler(db)
+	cipher, err := encryption.FromEnv()
+	if err != nil {
+		log.Fatal("Failed to load encryption key:", err)
+	}
+	if err := db.EnableFieldEncryption(cipher); err != nil {
+		log.Fatal("Failed to enable field encryption:", err)
+	}
+
+	pseudonyms, err := encryption.PseudonymizerFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load pseudonym key:", err)
+	}
+
+	syncer := campussync.New(db, intraClient)
+	if n, err := syncer.SeedDirectory(campusDirectoryFile()); err != nil {
+		log.Printf("Warning: failed to seed campus directory: %v", err)
+	} else if n > 0 {
+		log.Printf("Seeded campus directory with %d campuses", n)
+	}
+
+	runner := jobs.NewRunner(db, jobConcurrency())
+	if err := jobs.RegisterDefaults(runner, db, syncer, jobs.ConfigFromEnv()); err != nil {
+		log.Fatal("Failed to set up job schedules:", err)
+	}
+	runner.Start(context.Background())
+
+	h := handlers.NewHandler(db, intraClient, providers, auth.NewTokenStore(db, cipher, providers.FortyTwo()), runner, pseudonyms, handlers.ConfigFromEnv())
 
 	r := gin.Default()
+	// Per-IP rate limits rely on the client IP, so only proxies in front of
+	// the app may set X-Forwarded-For.
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	r.Use(h.SecurityHeaders())
+	r.Use(h.APIKeyAuth())
+	r.Use(h.RateLimit())
+	r.Use(h.CSRFProtection())
 	r.LoadHTMLGlob("templates/*")
 	r.Static("/static", "./static")
 
-	r.GET("/", func(c *gin.Context) {
-		c.HTML(200, "index.html", gin.H{})
-	})
+	r.GET("/", h.IndexPage)
 
 	r.GET("/login", h.Login)
+	r.GET("/login/:provider", h.Login)
 	r.GET("/callback", h.Callback)
-	r.GET("/dashboard", func(c *gin.Context) {
-		c.HTML(200, "dashboard.html", gin.H{})
-	})
+	r.GET("/callback/:provider", h.Callback)
+	r.POST("/logout", h.Logout)
+	r.GET("/dashboard", h.DashboardPage)
+	r.POST("/csp-report", h.CSPReport)
 
 	r.GET("/admin", h.AdminPage)
 
@@ -56,14 +110,63 @@ func main() {
 		api.GET("/report-reasons", h.GetReportReasons)
 		api.GET("/stats", h.GetUserStats)
 		api.GET("/me", h.GetCurrentUser) // Debug endpoint
-		api.POST("/sync-users", h.SyncCampusUsers) // Moved from staff-only
+		api.POST("/sync-users", h.SyncCampusUsers)
+		api.GET("/jobs/:id", h.GetJobStatus)
+		api.GET("/campuses", h.GetCampuses)
+		api.GET("/sessions", h.ListSessions)
+		api.DELETE("/sessions", h.RevokeSessions)
+		api.DELETE("/sessions/:id", h.RevokeSession)
+		api.GET("/identities", h.ListIdentities)
+		api.DELETE("/identities/:id", h.UnlinkIdentity)
+		api.GET("/2fa", h.GetTwoFactorStatus)
+		api.DELETE("/2fa", h.DisableTwoFactor)
+		api.POST("/2fa/enroll", h.EnrollTwoFactor)
+		api.POST("/2fa/activate", h.ActivateTwoFactor)
+		api.POST("/2fa/verify", h.VerifyTwoFactor)
+		api.POST("/2fa/recovery-codes", h.RegenerateRecoveryCodes)
 		
 		staff := api.Group("/staff")
 		{
-			staff.GET("/reports", h.GetPendingReports)
+			staff.GET("/reports", h.ListReports)
+			staff.GET("/report-presets", h.ListReportFilterPresets)
+			staff.PUT("/report-presets/:name", h.SaveReportFilterPreset)
+			staff.DELETE("/report-presets/:name", h.DeleteReportFilterPreset)
+			staff.GET("/reports/export", h.ExportReports)
+			staff.GET("/reports/:id", h.GetReport)
+			staff.GET("/reports/:id/access", h.GetReportAccess)
 			staff.PUT("/reports/:id", h.ReviewReport)
+			staff.POST("/reports/:id/reveal", h.RequestIdentityReveal)
+			staff.GET("/reveal-requests", h.ListRevealRequests)
+			staff.POST("/reveal-requests/:id/approve", h.ApproveRevealRequest)
+			staff.POST("/reveal-requests/:id/deny", h.DenyRevealRequest)
+			staff.GET("/reveal-requests/:id/identity", h.GetRevealedIdentity)
+			staff.GET("/access-alerts", h.ListAccessAlerts)
+			staff.POST("/access-alerts/:id/resolve", h.ResolveAccessAlert)
 			staff.GET("/project-stats", h.GetProjectStats)
+			staff.GET("/users", h.ListUsers)
+			staff.PUT("/users/:login/role", h.SetUserRole)
+			staff.DELETE("/users/:login/sessions", h.RevokeUserSessions)
+			staff.DELETE("/users/:login/2fa", h.ResetUserTwoFactor)
+			staff.GET("/api-keys", h.ListAPIKeys)
+			staff.POST("/api-keys", h.CreateAPIKey)
+			staff.POST("/api-keys/:id/revoke", h.RevokeAPIKey)
 			staff.POST("/bulk-project-action", h.BulkProjectAction)
+
+			staff.GET("/jobs", h.ListJobs)
+			staff.POST("/jobs", h.EnqueueJob)
+			staff.GET("/jobs/schedules", h.ListJobSchedules)
+			staff.GET("/jobs/:id", h.GetJob)
+			staff.POST("/jobs/:id/cancel", h.CancelJob)
+			staff.POST("/jobs/:id/retry", h.RetryJob)
+			staff.POST("/campuses/refresh", h.RefreshCampuses)
+			staff.GET("/audit", h.ListAuditLog)
+			staff.GET("/audit/verify", h.VerifyAuditLog)
+			staff.GET("/privacy/users/:login/export", h.ExportUserData)
+			staff.POST("/privacy/users/:login/pseudonymize", h.PseudonymizeUser)
+			staff.POST("/privacy/users/:login/erase", h.EraseUser)
+			staff.GET("/legal-holds", h.ListLegalHolds)
+			staff.POST("/legal-holds", h.CreateLegalHold)
+			staff.POST("/legal-holds/:id/release", h.ReleaseLegalHold)
 		}
 	}
 
@@ -94,4 +197,94 @@ func loadEnv() error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// startFakeIntra serves the fixture-backed intra stand-in and points the
+// app at it, so the whole login and sync flow works without 42 credentials.
+func startFakeIntra() error {
+	addr := os.Getenv("FAKE_INTRA_ADDR")
+	if addr == "" {
+		addr = "localhost:4242"
+	}
+	fixtures := os.Getenv("FAKE_INTRA_FIXTURES")
+	if fixtures == "" {
+		fixtures = filepath.Join("fakeintra", "fixtures")
+	}
+
+	server, err := fakeintra.NewServer(fixtures, campusDirectoryFile())
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Fatal(http.Serve(listener, server.Handler()))
+	}()
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	os.Setenv("INTRA_BASE_URL", "http://"+addr)
+	setDefaultEnv("OAUTH_42_CLIENT_ID", "fake-client-id")
+	setDefaultEnv("OAUTH_42_CLIENT_SECRET", "fake-client-secret")
+	setDefaultEnv("OAUTH_42_REDIRECT_URL", "http://localhost:"+port+"/callback")
+
+	log.Printf("Fake intra server listening on http://%s (fixtures: %s)", addr, fixtures)
+	return nil
+}
+
+// databasePath returns DB_PATH, or whistleblower.db when it is unset.
+func databasePath() string {
+	if path := os.Getenv("DB_PATH"); path != "" {
+		return path
+	}
+	return "whistleblower.db"
+}
+
+func campusDirectoryFile() string {
+	if path := os.Getenv("CAMPUS_DIRECTORY_FILE"); path != "" {
+		return path
+	}
+	return campussync.DefaultDirectoryFile
+}
+
+func jobConcurrency() int {
+	if v := os.Getenv("JOB_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Warning: invalid JOB_CONCURRENCY %q, using 2", v)
+	}
+	return 2
+}
+
+// trustedProxies reads TRUSTED_PROXIES, a comma-separated list of IPs and
+// CIDRs, or "none", defaulting to loopback and private networks, where
+// nginx runs.
+func trustedProxies() []string {
+	v := os.Getenv("TRUSTED_PROXIES")
+	if v == "none" {
+		return nil
+	}
+	if v == "" {
+		return []string{"127.0.0.0/8", "::1", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+	}
+	var proxies []string
+	for _, proxy := range strings.Split(v, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+func setDefaultEnv(key, value string) {
+	if os.Getenv(key) == "" {
+		os.Setenv(key, value)
+	}
+}
@@ -0,0 +1,228 @@
+// Package markdown handles the small Markdown subset allowed in report
+// explanations: paragraphs, line breaks, **bold**, *italics*, `code`,
+// fenced code blocks, lists, quotes and http(s) or mailto links. Sanitize
+// cleans text before it is stored; ToHTML renders it with everything else
+// escaped, so stored text is never trusted as HTML.
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	htmlComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlTag     = regexp.MustCompile(`</?[a-zA-Z][a-zA-Z0-9-]*(\s[^<>]*)?/?>`)
+	autolink    = regexp.MustCompile(`<((?:https?://|mailto:)[^<>\s]+)>`)
+	// Link targets may contain one level of parentheses.
+	image = regexp.MustCompile(`!\[([^\]]*)\]\((?:[^()]|\([^()]*\))*\)`)
+	link  = regexp.MustCompile(`\[([^\]]+)\]\(((?:[^()\s]|\([^()\s]*\))+)\)`)
+
+	bold         = regexp.MustCompile(`\*\*([^*\n]+)\*\*|__([^_\n]+)__`)
+	italicStar   = regexp.MustCompile(`\*([^*\s][^*\n]*)\*`)
+	italicScore  = regexp.MustCompile(`(^|[^\pL\pN_])_([^_\n]+)_($|[^\pL\pN_])`)
+	orderedItem  = regexp.MustCompile(`^\d{1,9}[.)] `)
+	placeholders = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// Sanitize drops what the subset does not allow from Markdown source: raw
+// HTML tags and comments, images, which are reduced to their alt text, and
+// links to schemes other than http, https and mailto, which are reduced to
+// their text. Code spans and blocks are kept as they are, since code often
+// looks like HTML.
+func Sanitize(src string) string {
+	lines := strings.Split(src, "\n")
+	var out, text []string
+	flush := func() {
+		if len(text) > 0 {
+			out = append(out, outsideCodeSpans(strings.Join(text, "\n"), sanitizeText))
+			text = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		if !isFence(lines[i]) {
+			text = append(text, lines[i])
+			continue
+		}
+		flush()
+		end := i + 1
+		for end < len(lines) && !isFence(lines[end]) {
+			end++
+		}
+		end = min(end+1, len(lines))
+		out = append(out, lines[i:end]...)
+		i = end - 1
+	}
+	flush()
+	return strings.Join(out, "\n")
+}
+
+// outsideCodeSpans applies fn to the parts of text that are not between
+// backticks.
+func outsideCodeSpans(text string, fn func(string) string) string {
+	parts := strings.Split(text, "`")
+	closed := len(parts) - 1
+	if closed%2 == 1 {
+		closed--
+	}
+	for i := range parts {
+		if i%2 == 0 || i > closed {
+			parts[i] = fn(parts[i])
+		}
+	}
+	return strings.Join(parts, "`")
+}
+
+func sanitizeText(src string) string {
+	src = htmlComment.ReplaceAllString(src, "")
+	src = autolink.ReplaceAllString(src, "$1")
+	src = htmlTag.ReplaceAllString(src, "")
+	src = image.ReplaceAllString(src, "$1")
+	return link.ReplaceAllStringFunc(src, func(m string) string {
+		parts := link.FindStringSubmatch(m)
+		if !safeURL(parts[2]) {
+			return parts[1]
+		}
+		return m
+	})
+}
+
+// safeURL reports whether a link target may be rendered.
+func safeURL(u string) bool {
+	u = strings.ToLower(u)
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "mailto:")
+}
+
+// ToHTML renders Markdown source as HTML. Any HTML in the source comes out
+// escaped, so the result is safe to insert into a page.
+func ToHTML(src string) string {
+	// NUL marks inline's placeholders. New reports cannot contain it, but
+	// reports stored before explanations were normalized can.
+	src = strings.ReplaceAll(src, "\x00", "")
+
+	var out strings.Builder
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + inline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flush()
+
+		case isFence(line):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !isFence(lines[i]); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")))
+			}
+			i--
+			out.WriteString("<blockquote>" + inline(strings.Join(quote, "\n")) + "</blockquote>\n")
+
+		case listItem(trimmed) != "":
+			flush()
+			tag := "ul"
+			if orderedItem.MatchString(trimmed) {
+				tag = "ol"
+			}
+			out.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && listItem(strings.TrimSpace(lines[i])) != ""; i++ {
+				out.WriteString("<li>" + inline(listItem(strings.TrimSpace(lines[i]))) + "</li>\n")
+			}
+			i--
+			out.WriteString("</" + tag + ">\n")
+
+		default:
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flush()
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// isFence reports whether line opens or closes a fenced code block.
+func isFence(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "```")
+}
+
+// listItem returns the text of a list item line, or "" if line is not one.
+func listItem(line string) string {
+	for _, marker := range []string{"- ", "* ", "+ "} {
+		if strings.HasPrefix(line, marker) {
+			return strings.TrimSpace(line[len(marker):])
+		}
+	}
+	if loc := orderedItem.FindStringIndex(line); loc != nil {
+		return strings.TrimSpace(line[loc[1]:])
+	}
+	return ""
+}
+
+// inline renders code spans, links and emphasis in text, escaping the
+// rest. Code spans and links are swapped for placeholders first, so
+// emphasis markers inside them are left alone.
+func inline(text string) string {
+	var held []string
+	hold := func(s string) string {
+		held = append(held, s)
+		return "\x00" + strconv.Itoa(len(held)-1) + "\x00"
+	}
+
+	var b strings.Builder
+	for i, part := range strings.Split(text, "`") {
+		// Odd parts are between backticks, unless the last one is unclosed.
+		if i%2 == 1 && i < strings.Count(text, "`") {
+			b.WriteString(hold("<code>" + html.EscapeString(part) + "</code>"))
+			continue
+		}
+		if i%2 == 1 {
+			part = "`" + part
+		}
+		b.WriteString(part)
+	}
+	text = b.String()
+
+	text = link.ReplaceAllStringFunc(text, func(m string) string {
+		parts := link.FindStringSubmatch(m)
+		if !safeURL(parts[2]) {
+			return m
+		}
+		return hold(`<a href="` + html.EscapeString(parts[2]) + `" rel="nofollow noopener noreferrer">` +
+			emphasis(html.EscapeString(parts[1])) + "</a>")
+	})
+
+	text = emphasis(html.EscapeString(text))
+	text = strings.ReplaceAll(text, "\n", "<br>\n")
+	return placeholders.ReplaceAllStringFunc(text, func(m string) string {
+		n, err := strconv.Atoi(strings.Trim(m, "\x00"))
+		if err != nil || n >= len(held) {
+			return ""
+		}
+		return held[n]
+	})
+}
+
+// emphasis renders bold and italics in escaped text.
+func emphasis(text string) string {
+	text = bold.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = italicStar.ReplaceAllString(text, "<em>$1</em>")
+	return italicScore.ReplaceAllString(text, "$1<em>$2</em>$3")
+}
@@ -0,0 +1,26 @@
+package markdown
+
+import "testing"
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"paragraph", "plain text", "<p>plain text</p>"},
+		{"escapes html", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"emphasis", "**bold** and *italic*", "<p><strong>bold</strong> and <em>italic</em></p>"},
+		{"code span", "run `a *b* c`", "<p>run <code>a *b* c</code></p>"},
+		{"link", "[docs](https://example.com)", `<p><a href="https://example.com" rel="nofollow noopener noreferrer">docs</a></p>`},
+		{"unsafe link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		// Reports stored before explanations were normalized may hold NUL.
+		{"stray placeholder", "see \x007\x00 here", "<p>see 7 here</p>"},
+		{"placeholder next to code", "`a` \x000\x00 \x001\x00", "<p><code>a</code> 0 1</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ToHTML(tt.src); got != tt.want {
+				t.Errorf("ToHTML(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
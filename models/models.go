@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -11,15 +12,97 @@ type User struct {
 	DisplayName string    `json:"display_name" db:"display_name"`
 	IsStaff     bool      `json:"is_staff" db:"is_staff"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	IntraID     int       `json:"intra_id,omitempty" db:"intra_id"`
+	CampusID    int       `json:"campus_id,omitempty" db:"campus_id"`
+	IsActive    bool      `json:"is_active" db:"is_active"`
+	Role        string    `json:"role" db:"role"`
+}
+
+// User roles, from least to most privileged. Staff and admins have IsStaff
+// set; only admins can change roles.
+const (
+	RoleStudent = "student"
+	RoleStaff   = "staff"
+	RoleAdmin   = "admin"
+)
+
+// RoleRank orders roles by the rights they grant; unknown roles rank lowest.
+func RoleRank(role string) int {
+	switch role {
+	case RoleStaff:
+		return 1
+	case RoleAdmin:
+		return 2
+	}
+	return 0
+}
+
+// TOTPEnrollment is a user's authenticator app. It is pending until the user
+// confirms it with a first code.
+type TOTPEnrollment struct {
+	UserID    int        `json:"user_id"`
+	Secret    string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	EnabledAt *time.Time `json:"enabled_at,omitempty"`
+	// LastUsedStep is the time step of the last accepted code; codes from
+	// it or earlier steps are refused, so a code works only once.
+	LastUsedStep int64 `json:"-"`
+}
+
+// TwoFactorCodeRequest carries an authenticator code or, instead, one of
+// the user's recovery codes.
+type TwoFactorCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// UserIdentity links a user to their account at an identity provider. A
+// user can have one identity per provider.
+type UserIdentity struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+type SetRoleRequest struct {
+	Role   string `json:"role" binding:"required,oneof=student staff admin"`
+	Reason string `json:"reason"`
+}
+
+type Session struct {
+	ID         int        `json:"id" db:"id"`
+	TokenHash  string     `json:"-" db:"token_hash"`
+	UserID     int        `json:"user_id" db:"user_id"`
+	OAuthToken string     `json:"-" db:"oauth_token"`
+	UserAgent  string     `json:"user_agent,omitempty" db:"user_agent"`
+	IPAddress  string     `json:"ip_address,omitempty" db:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty" db:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	// MFAVerifiedAt is when the session last passed a two-factor check.
+	MFAVerifiedAt *time.Time `json:"mfa_verified_at,omitempty" db:"mfa_verified_at"`
+	// Device and Current are filled in when listing a user's sessions.
+	Device  string `json:"device,omitempty" db:"-"`
+	Current bool   `json:"current,omitempty" db:"-"`
 }
 
 type Report struct {
 	ID                   int        `json:"id" db:"id"`
-	ReporterID          int        `json:"reporter_id" db:"reporter_id"`
+	// ReporterID is never sent to clients; staff see Reporter, a pseudonym
+	// that is stable per reporter within one case.
+	ReporterID          int        `json:"-" db:"reporter_id"`
+	Reporter            string     `json:"reporter,omitempty" db:"-"`
 	ReportedStudentLogin string     `json:"reported_student_login" db:"reported_student_login"`
 	ProjectName         string     `json:"project_name" db:"project_name"`
 	Reason              string     `json:"reason" db:"reason"`
 	Explanation         string     `json:"explanation" db:"explanation"`
+	// ExplanationHTML is the explanation's Markdown rendered for staff,
+	// with anything else escaped.
+	ExplanationHTML     string     `json:"explanation_html,omitempty" db:"-"`
 	Status              string     `json:"status" db:"status"`
 	CreatedAt           time.Time  `json:"created_at" db:"created_at"`
 	ReviewedAt          *time.Time `json:"reviewed_at,omitempty" db:"reviewed_at"`
@@ -51,11 +134,283 @@ type ReportReason struct {
 	Description string `json:"description" db:"description"`
 }
 
+// CreateReportRequest is a report as submitted. Its fields are normalized
+// and checked by the handler, which answers with a FieldError per problem.
 type CreateReportRequest struct {
-	ReportedStudentLogin string `json:"reported_student_login" binding:"required"`
-	ProjectName         string `json:"project_name" binding:"required"`
-	Reason              string `json:"reason" binding:"required"`
-	Explanation         string `json:"explanation" binding:"required"`
+	ReportedStudentLogin string `json:"reported_student_login"`
+	ProjectName         string `json:"project_name"`
+	Reason              string `json:"reason"`
+	// Explanation may use the Markdown subset of the markdown package.
+	Explanation         string `json:"explanation"`
+	// OnBehalfOf files the report for another student. Only API keys with
+	// the reports:create scope may set it.
+	OnBehalfOf string `json:"on_behalf_of"`
+}
+
+// FieldError is one reason a request was refused, for the field it names,
+// if any.
+// Code is stable for clients to match on; Message is for people.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ReportFilter narrows down the staff report listing. Empty fields match
+// everything; From and To are dates (2006-01-02) or RFC 3339 times.
+type ReportFilter struct {
+	Status        string `json:"status,omitempty" form:"status"`
+	Reason        string `json:"reason,omitempty" form:"reason"`
+	ProjectName   string `json:"project,omitempty" form:"project"`
+	ReportedLogin string `json:"reported_login,omitempty" form:"reported_login"`
+	CampusID      int    `json:"campus_id,omitempty" form:"campus_id"`
+	From          string `json:"from,omitempty" form:"from"`
+	To            string `json:"to,omitempty" form:"to"`
+	Query         string `json:"q,omitempty" form:"q"`
+	Sort          string `json:"sort,omitempty" form:"sort"`
+}
+
+// UserFilter narrows down the staff user listing. Nil fields match
+// everything.
+type UserFilter struct {
+	CampusID int   `form:"campus_id"`
+	Active   *bool `form:"active"`
+	Staff    *bool `form:"staff"`
+}
+
+// ProjectStatsFilter narrows down the most reported projects.
+type ProjectStatsFilter struct {
+	ProjectName   string `form:"project"`
+	ReportedLogin string `form:"reported_login"`
+	MinReports    int    `form:"min_reports"`
+}
+
+// Audit log actions.
+const (
+	AuditLogin            = "auth.login"
+	AuditLogout           = "auth.logout"
+	AuditSessionRevoke    = "auth.session_revoke"
+	AuditAPIKeyCreate     = "api_key.create"
+	AuditAPIKeyRevoke     = "api_key.revoke"
+	AuditReportOnBehalf   = "report.create_on_behalf"
+	AuditIdentityLink     = "auth.identity_link"
+	AuditIdentityUnlink   = "auth.identity_unlink"
+	Audit2FAEnable        = "auth.2fa_enable"
+	Audit2FADisable       = "auth.2fa_disable"
+	Audit2FAReset         = "auth.2fa_reset"
+	Audit2FARecoveryUsed  = "auth.2fa_recovery_used"
+	Audit2FARecoveryNew   = "auth.2fa_recovery_regenerate"
+	AuditRoleChange       = "user.role_change"
+	AuditReportList       = "report.list"
+	AuditReportView       = "report.view"
+	AuditReportReview     = "report.review"
+	AuditBulkAction       = "report.bulk_action"
+	AuditSyncStart        = "sync.start"
+	AuditDirectoryRefresh = "campus.directory_refresh"
+	AuditJobEnqueue       = "job.enqueue"
+	AuditJobCancel        = "job.cancel"
+	AuditJobRetry         = "job.retry"
+	AuditJobFinish        = "job.finish"
+	AuditExport           = "export"
+	AuditLogView          = "audit.view"
+	AuditAccessAlert      = "report.access_alert"
+	AuditAlertResolve     = "report.access_alert_resolve"
+	AuditRevealRequest    = "identity.reveal_request"
+	AuditRevealDecision   = "identity.reveal_decision"
+	AuditIdentityReveal   = "identity.reveal"
+	AuditDataExport       = "privacy.export"
+	AuditPseudonymize     = "privacy.pseudonymize"
+	AuditErase            = "privacy.erase"
+	AuditLegalHold        = "privacy.legal_hold"
+	AuditLegalHoldRelease = "privacy.legal_hold_release"
+)
+
+// AuditEntry is one record of the append-only audit log. Hash covers the
+// entry and PrevHash, chaining every entry to all entries before it.
+type AuditEntry struct {
+	ID         int             `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    *int            `json:"actor_id,omitempty"`
+	ActorLogin string          `json:"actor_login"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	IP         string          `json:"ip,omitempty"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+type AuditFilter struct {
+	ActorLogin string `form:"actor" json:"actor,omitempty"`
+	Action     string `form:"action" json:"action,omitempty"`
+	TargetType string `form:"target_type" json:"target_type,omitempty"`
+	TargetID   string `form:"target_id" json:"target_id,omitempty"`
+}
+
+// AuditVerification is the outcome of checking the audit log's hash chain.
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Checked  int    `json:"checked"`
+	BrokenAt int    `json:"broken_at,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+	LastHash string `json:"last_hash,omitempty"`
+}
+
+// Report access types recorded in report_access_log.
+const (
+	AccessList   = "list"
+	AccessDetail = "detail"
+	AccessExport = "export"
+)
+
+// ReportAccess records one staff member reading one report.
+type ReportAccess struct {
+	ID         int       `json:"id"`
+	ReportID   int       `json:"report_id"`
+	UserID     int       `json:"user_id"`
+	Login      string    `json:"login"`
+	AccessType string    `json:"access_type"`
+	IP         string    `json:"ip,omitempty"`
+	AccessedAt time.Time `json:"accessed_at"`
+}
+
+// ReportViewer sums up one staff member's accesses to a report.
+type ReportViewer struct {
+	UserID        int       `json:"user_id"`
+	Login         string    `json:"login"`
+	DisplayName   string    `json:"display_name"`
+	AccessCount   int       `json:"access_count"`
+	AccessTypes   []string  `json:"access_types"`
+	FirstAccessed time.Time `json:"first_accessed_at"`
+	LastAccessed  time.Time `json:"last_accessed_at"`
+}
+
+// AccessAlert is raised when one staff account reads an unusual number of
+// reports within the alert window.
+type AccessAlert struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	Login       string     `json:"login"`
+	ReportCount int        `json:"report_count"`
+	WindowStart time.Time  `json:"window_start"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy  *int       `json:"resolved_by,omitempty"`
+}
+
+// Identity reveal request statuses.
+const (
+	RevealPending  = "pending"
+	RevealApproved = "approved"
+	RevealDenied   = "denied"
+)
+
+// RevealRequest asks to see who submitted a report. Reveals need a
+// justification and, when configured, the approval of a second admin.
+type RevealRequest struct {
+	ID            int        `json:"id"`
+	ReportID      int        `json:"report_id"`
+	RequestedBy   int        `json:"requested_by"`
+	RequesterName string     `json:"requested_by_login"`
+	Justification string     `json:"justification"`
+	Status        string     `json:"status"`
+	DecidedBy     *int       `json:"decided_by,omitempty"`
+	DecisionNote  string     `json:"decision_note,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+}
+
+type RevealIdentityRequest struct {
+	Justification string `json:"justification" binding:"required,min=20,max=2000"`
+}
+
+type RevealDecisionRequest struct {
+	Note string `json:"note" binding:"max=2000"`
+}
+
+// RevealedReporter is the identity behind a reporter pseudonym.
+type RevealedReporter struct {
+	Pseudonym   string `json:"pseudonym"`
+	UserID      int    `json:"user_id"`
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
+}
+
+// LegalHold keeps the reports of a case from being erased while it is open.
+// A hold covers the reports about Login, or only those on ProjectName when
+// it is set, and the people who filed them.
+type LegalHold struct {
+	ID          int        `json:"id"`
+	Login       string     `json:"login"`
+	ProjectName string     `json:"project_name,omitempty"`
+	Reason      string     `json:"reason"`
+	CreatedBy   int        `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ReleasedBy  *int       `json:"released_by,omitempty"`
+	ReleasedAt  *time.Time `json:"released_at,omitempty"`
+}
+
+type CreateLegalHoldRequest struct {
+	Login       string `json:"login" binding:"required"`
+	ProjectName string `json:"project_name"`
+	Reason      string `json:"reason" binding:"required,max=2000"`
+}
+
+// ErasureRequest confirms pseudonymizing or erasing a user. Confirm has to
+// repeat the login.
+type ErasureRequest struct {
+	Reason  string `json:"reason" binding:"required,max=2000"`
+	Confirm string `json:"confirm" binding:"required"`
+}
+
+// Erasure modes. Pseudonymizing replaces the user's identity with a
+// pseudonym and keeps their reports; erasing deletes the user and every
+// report filed by or about them.
+const (
+	ErasurePseudonymize = "pseudonymize"
+	ErasureErase        = "erase"
+)
+
+// ErasureResult sums up what a pseudonymization or erasure changed.
+type ErasureResult struct {
+	Mode                 string `json:"mode"`
+	UserID               int    `json:"user_id"`
+	Pseudonym            string `json:"pseudonym,omitempty"`
+	ReportsFiledDeleted  int    `json:"reports_filed_deleted"`
+	ReportsAboutDeleted  int    `json:"reports_about_deleted"`
+	ReportsPseudonymized int    `json:"reports_pseudonymized"`
+	SessionsDeleted      int    `json:"sessions_deleted"`
+}
+
+// DataSubjectExport is everything stored about one user, for access
+// requests. Reports about the user never name who filed them.
+type DataSubjectExport struct {
+	ExportedAt    time.Time            `json:"exported_at"`
+	User          User                 `json:"user"`
+	ReportsFiled  []Report             `json:"reports_filed"`
+	ReportsAbout  []Report             `json:"reports_about"`
+	ReportStats   *UserReportStats     `json:"report_stats,omitempty"`
+	Notifications []StaffNotification  `json:"notifications"`
+	Sessions      []Session            `json:"sessions"`
+	FilterPresets []ReportFilterPreset `json:"filter_presets"`
+	LegalHolds    []LegalHold          `json:"legal_holds"`
+	Identities    []UserIdentity       `json:"identities"`
+}
+
+// PageRequest asks for one page of a cursor-paginated listing. Cursor is
+// the next_cursor of the previous page, empty for the first.
+type PageRequest struct {
+	Limit  int
+	Cursor string
+}
+
+type ReportFilterPreset struct {
+	ID        int          `json:"id" db:"id"`
+	Name      string       `json:"name" db:"name"`
+	Filter    ReportFilter `json:"filter" db:"filter"`
+	CreatedAt time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at" db:"updated_at"`
 }
 
 type ReviewReportRequest struct {
@@ -72,14 +427,153 @@ type StudentSearchResult struct {
 	Login       string `json:"login"`
 	DisplayName string `json:"display_name"`
 	Email       string `json:"email"`
+	CampusID    int    `json:"campus_id,omitempty"`
+	IsActive    bool   `json:"is_active"`
 	Projects    []string `json:"projects,omitempty"`
 }
 
+// UserSearch describes a user search. Zero values leave a filter off.
+type UserSearch struct {
+	Query    string `form:"q"`
+	CampusID int    `form:"campus_id"`
+	Active   *bool  `form:"active"`
+}
+
 type Auth42User struct {
-	ID          int    `json:"id"`
-	Login       string `json:"login"`
-	Email       string `json:"email"`
-	DisplayName string `json:"displayname"`
+	ID          int       `json:"id"`
+	Login       string    `json:"login"`
+	Email       string    `json:"email"`
+	DisplayName string    `json:"displayname"`
+	Staff       bool      `json:"staff?"`
+	Active      *bool     `json:"active?"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// CampusUsers is only filled in by /v2/me.
+	CampusUsers []struct {
+		CampusID  int  `json:"campus_id"`
+		IsPrimary bool `json:"is_primary"`
+	} `json:"campus_users,omitempty"`
+}
+
+// Campus is an entry of the campus directory. It decodes straight from
+// intra's /v2/campus and all_campuses.json.
+type Campus struct {
+	ID           int        `json:"id" db:"id"`
+	Name         string     `json:"name" db:"name"`
+	City         string     `json:"city" db:"city"`
+	Country      string     `json:"country" db:"country"`
+	TimeZone     string     `json:"time_zone" db:"time_zone"`
+	Active       bool       `json:"active" db:"active"`
+	Public       bool       `json:"public" db:"public"`
+	UsersCount   int        `json:"users_count" db:"users_count"`
+	LastSyncedAt *time.Time `json:"last_synced_at,omitempty"`
+}
+
+// CampusSyncState is the bookkeeping kept per campus between syncs.
+type CampusSyncState struct {
+	CampusID       int        `json:"campus_id" db:"campus_id"`
+	LastFullSyncAt *time.Time `json:"last_full_sync_at,omitempty" db:"last_full_sync_at"`
+	LastSyncedAt   *time.Time `json:"last_synced_at,omitempty" db:"last_synced_at"`
+}
+
+// SyncSummary reports what a campus sync changed.
+type SyncSummary struct {
+	CampusID    int       `json:"campus_id"`
+	Mode        string    `json:"mode"`
+	Fetched     int       `json:"fetched"`
+	Created     int       `json:"created"`
+	Updated     int       `json:"updated"`
+	Unchanged   int       `json:"unchanged"`
+	Deactivated int       `json:"deactivated"`
+	Skipped     int       `json:"skipped,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+}
+
+// Retention policy actions.
+const (
+	RetentionDelete    = "delete"
+	RetentionAnonymize = "anonymize"
+)
+
+// RetentionPolicy removes or anonymizes the records of one entity with one
+// status once they are older than After, such as "12m" or "5y". Status "*"
+// matches every status.
+type RetentionPolicy struct {
+	Entity string `json:"entity"`
+	Status string `json:"status"`
+	Action string `json:"action"`
+	After  string `json:"after"`
+}
+
+// RetentionOutcome is what applying, or dry-running, one retention policy
+// did. IDs lists at most the first 100 matching records; Held counts those
+// kept because a legal hold covers them.
+type RetentionOutcome struct {
+	Policy  string    `json:"policy"`
+	Cutoff  time.Time `json:"cutoff"`
+	Matched int       `json:"matched"`
+	Applied int       `json:"applied"`
+	Held    int       `json:"held,omitempty"`
+	IDs     []int     `json:"ids,omitempty"`
+}
+
+// API key scopes.
+const (
+	ScopeStatsRead     = "stats:read"
+	ScopeReportsCreate = "reports:create"
+	ScopeSyncRun       = "sync:run"
+)
+
+// APIKey lets a service call the API as the user who owns it, limited to
+// its scopes and to RateLimit requests per minute. Only a hash of the key is
+// stored; Prefix, its first characters, identifies it in listings.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	UserID     int        `json:"user_id"`
+	Login      string     `json:"login"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  int        `json:"rate_limit"`
+	CreatedBy  int        `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreateAPIKeyRequest issues a key acting as Login, or as the issuing admin
+// when Login is empty. ExpiresInDays defaults to 90 and RateLimit to 60
+// requests per minute.
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Login         string   `json:"login"`
+	Scopes        []string `json:"scopes" binding:"required,min=1,dive,oneof=stats:read reports:create sync:run"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"min=0,max=365"`
+	RateLimit     int      `json:"rate_limit" binding:"min=0,max=6000"`
+}
+
+type Job struct {
+	ID              int             `json:"id" db:"id"`
+	Kind            string          `json:"kind" db:"kind"`
+	Params          json.RawMessage `json:"params" db:"params"`
+	LockKey         string          `json:"lock_key" db:"lock_key"`
+	Status          string          `json:"status" db:"status"`
+	Progress        json.RawMessage `json:"progress,omitempty" db:"progress"`
+	Result          json.RawMessage `json:"result,omitempty" db:"result"`
+	Error           string          `json:"error,omitempty" db:"error"`
+	RequestedBy     string          `json:"requested_by" db:"requested_by"`
+	CancelRequested bool            `json:"cancel_requested" db:"cancel_requested"`
+	CreatedAt       time.Time       `json:"created_at" db:"created_at"`
+	StartedAt       *time.Time      `json:"started_at,omitempty" db:"started_at"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty" db:"finished_at"`
+}
+
+type EnqueueJobRequest struct {
+	Kind   string          `json:"kind" binding:"required"`
+	Params json.RawMessage `json:"params"`
 }
 
 type ProjectStats struct {
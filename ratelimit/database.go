@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"whistleblower/database"
+)
+
+// DatabaseStore keeps buckets in the rate_limit_buckets table, so every
+// instance using the database shares them.
+type DatabaseStore struct {
+	db *database.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewDatabaseStore(db *database.DB) *DatabaseStore {
+	return &DatabaseStore{db: db}
+}
+
+// Take takes a token from the bucket key under policy p.
+func (s *DatabaseStore) Take(key string, p Policy, now time.Time) (Result, error) {
+	s.sweep(now)
+
+	allowed, tokens, err := s.db.TakeRateLimitToken(key, p.capacity(), p.perSecond(), now)
+	if err != nil {
+		return Result{}, err
+	}
+	return result(p, allowed, tokens), nil
+}
+
+// sweep drops refilled buckets, at most once per sweepInterval per
+// instance.
+func (s *DatabaseStore) sweep(now time.Time) {
+	s.mu.Lock()
+	due := now.Sub(s.lastSweep) >= sweepInterval
+	if due {
+		s.lastSweep = now
+	}
+	s.mu.Unlock()
+
+	if due {
+		if _, err := s.db.DeleteFullRateLimitBuckets(now); err != nil {
+			log.Printf("Failed to delete full rate limit buckets: %v", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often stores drop buckets that have refilled.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps buckets in the process. Each instance then enforces
+// its limits on its own.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	fullAt  time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+// Take takes a token from the bucket key under policy p.
+func (s *MemoryStore) Take(key string, p Policy, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for k, b := range s.buckets {
+			if !now.Before(b.fullAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b := s.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: p.capacity(), updated: now}
+		s.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = min(p.capacity(), b.tokens+elapsed.Seconds()*p.perSecond())
+		b.updated = now
+	}
+
+	if b.tokens < 1 {
+		return result(p, false, b.tokens), nil
+	}
+	b.tokens--
+	b.fullAt = now.Add(seconds((p.capacity() - b.tokens) / p.perSecond()))
+	return result(p, true, b.tokens), nil
+}
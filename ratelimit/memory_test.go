@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	// Two tokens a second, bursts of four.
+	burst := Policy{Limit: 2, Period: time.Second, Burst: 4}
+	// One token a minute; the bucket holds Limit tokens.
+	slow := Policy{Limit: 1, Period: time.Minute}
+
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	ms := time.Millisecond
+
+	// The steps run in order against one store.
+	tests := []struct {
+		name       string
+		key        string
+		policy     Policy
+		at         time.Duration
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{"first request", "a", burst, 0, true, 3, 500 * ms, 0},
+		{"burst", "a", burst, 0, true, 2, time.Second, 0},
+		{"burst", "a", burst, 0, true, 1, 1500 * ms, 0},
+		{"last of the burst", "a", burst, 0, true, 0, 2 * time.Second, 0},
+		{"burst exhausted", "a", burst, 0, false, 0, 2 * time.Second, 500 * ms},
+		{"other key", "b", burst, 0, true, 3, 500 * ms, 0},
+		{"half a token", "a", burst, 250 * ms, false, 0, 1750 * ms, 250 * ms},
+		{"refilled one token", "a", burst, 500 * ms, true, 0, 2 * time.Second, 0},
+		{"refill stops at the burst", "a", burst, 10 * time.Second, true, 3, 500 * ms, 0},
+		{"no burst", "c", slow, 0, true, 0, time.Minute, 0},
+		{"no burst, exhausted", "c", slow, 0, false, 0, time.Minute, time.Minute},
+		{"no burst, half refilled", "c", slow, 30 * time.Second, false, 0, 30 * time.Second, 30 * time.Second},
+	}
+
+	s := NewMemoryStore()
+	for _, tt := range tests {
+		got, err := s.Take(tt.key, tt.policy, start.Add(tt.at))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got.Allowed != tt.allowed || got.Remaining != tt.remaining || got.Limit != int(tt.policy.capacity()) {
+			t.Errorf("%s: got allowed %v, remaining %d, limit %d, want %v, %d, %d",
+				tt.name, got.Allowed, got.Remaining, got.Limit, tt.allowed, tt.remaining, int(tt.policy.capacity()))
+		}
+		if !near(got.Reset, tt.reset) || !near(got.RetryAfter, tt.retryAfter) {
+			t.Errorf("%s: got reset %v, retry after %v, want %v, %v",
+				tt.name, got.Reset, got.RetryAfter, tt.reset, tt.retryAfter)
+		}
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	p := Policy{Limit: 1, Period: time.Second}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	s := NewMemoryStore()
+	s.Take("a", p, start)
+	s.Take("b", p, start.Add(sweepInterval))
+	if len(s.buckets) != 1 {
+		t.Fatalf("after the sweep: %d buckets, want only the one just used", len(s.buckets))
+	}
+	if _, ok := s.buckets["b"]; !ok {
+		t.Error("the sweep dropped a bucket that is not full")
+	}
+}
+
+// near reports whether got is within a millisecond of want; bucket levels
+// are floats.
+func near(got, want time.Duration) bool {
+	d := got - want
+	return d > -time.Millisecond && d < time.Millisecond
+}
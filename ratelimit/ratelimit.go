@@ -0,0 +1,106 @@
+// Package ratelimit throttles clients with token buckets. Buckets live in
+// memory, or in the database when several instances must share them.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy allows Limit requests per Period on average, with bursts of up to
+// Burst requests. A zero Burst means Limit.
+type Policy struct {
+	Limit  int
+	Period time.Duration
+	Burst  int
+}
+
+// capacity is how many tokens a full bucket holds.
+func (p Policy) capacity() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Limit)
+}
+
+// perSecond is how many tokens a bucket gains a second.
+func (p Policy) perSecond() float64 {
+	return float64(p.Limit) / p.Period.Seconds()
+}
+
+// String formats the policy the way ParsePolicy reads it.
+func (p Policy) String() string {
+	s := strconv.Itoa(p.Limit) + "/" + p.Period.String()
+	if p.Burst > 0 {
+		s += ",burst=" + strconv.Itoa(p.Burst)
+	}
+	return s
+}
+
+// ParsePolicy reads a policy like "30/1m" or "30/1m,burst=10".
+func ParsePolicy(s string) (Policy, error) {
+	var p Policy
+	rate, burst, hasBurst := strings.Cut(strings.TrimSpace(s), ",")
+	limit, period, ok := strings.Cut(rate, "/")
+	if !ok {
+		return p, fmt.Errorf("policy %q is not LIMIT/PERIOD", s)
+	}
+
+	var err error
+	if p.Limit, err = strconv.Atoi(strings.TrimSpace(limit)); err != nil || p.Limit <= 0 {
+		return p, fmt.Errorf("invalid limit in policy %q", s)
+	}
+	if p.Period, err = time.ParseDuration(strings.TrimSpace(period)); err != nil || p.Period <= 0 {
+		return p, fmt.Errorf("invalid period in policy %q", s)
+	}
+	if hasBurst {
+		value, found := strings.CutPrefix(strings.TrimSpace(burst), "burst=")
+		if p.Burst, err = strconv.Atoi(value); !found || err != nil || p.Burst <= 0 {
+			return p, fmt.Errorf("invalid burst in policy %q", s)
+		}
+	}
+	return p, nil
+}
+
+// Result is the outcome of taking a token, with what the RateLimit response
+// headers report.
+type Result struct {
+	Allowed bool
+	// Limit is the size of the bucket.
+	Limit int
+	// Remaining is how many requests can be made right away.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, when this
+	// one was not.
+	RetryAfter time.Duration
+}
+
+// Store keeps the token buckets.
+type Store interface {
+	// Take takes a token from the bucket key under policy p.
+	Take(key string, p Policy, now time.Time) (Result, error)
+}
+
+// result builds the Result for a bucket left with tokens.
+func result(p Policy, allowed bool, tokens float64) Result {
+	rate := p.perSecond()
+	r := Result{
+		Allowed:   allowed,
+		Limit:     int(p.capacity()),
+		Remaining: max(0, int(math.Floor(tokens))),
+		Reset:     seconds((p.capacity() - tokens) / rate),
+	}
+	if !allowed {
+		r.RetryAfter = seconds((1 - tokens) / rate)
+	}
+	return r
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(max(0, s) * float64(time.Second))
+}
@@ -12,7 +12,7 @@ if [ $# -eq 0 ]; then
     echo "  $0 apregitz 0      # Remove admin from apregitz"
     echo ""
     echo "Current users:"
-    docker-compose exec whistleblower sqlite3 /app/data/whistleblower.db "SELECT login, display_name, is_staff FROM users;"
+    docker-compose exec whistleblower sqlite3 /app/data/whistleblower.db "SELECT login, display_name, is_staff, role FROM users;"
     exit 1
 fi
 
@@ -21,11 +21,16 @@ IS_ADMIN=${2:-1}
 
 echo "Setting admin status for '$USERNAME' to $IS_ADMIN..."
 
-# Update the user in the database
-docker-compose exec whistleblower sqlite3 /app/data/whistleblower.db "UPDATE users SET is_staff = $IS_ADMIN WHERE login = '$USERNAME';"
+# Change the role through the binary so the change lands in the audit log
+if [ "$IS_ADMIN" = "1" ]; then
+    ROLE=staff
+else
+    ROLE=student
+fi
+docker-compose exec whistleblower ./whistleblower set-role "$USERNAME" "$ROLE" "set_admin.sh"
 
 # Check if the update was successful
-RESULT=$(docker-compose exec whistleblower sqlite3 /app/data/whistleblower.db "SELECT login, display_name, is_staff FROM users WHERE login = '$USERNAME';")
+RESULT=$(docker-compose exec whistleblower sqlite3 /app/data/whistleblower.db "SELECT login, display_name, is_staff, role FROM users WHERE login = '$USERNAME';")
 
 if [ -n "$RESULT" ]; then
     echo "Success! User status updated:"
@@ -10,23 +10,27 @@ sleep 3
 
 echo "✅ Server started (PID: $SERVER_PID)"
 
-# Create a test user cookie to simulate login
-echo "🍪 Creating test cookies..."
-TEST_COOKIES="-b user_login=testuser"
+# Authenticate with an API key that has the sync:run scope
+if [ -z "$API_KEY" ]; then
+    echo "❌ Set API_KEY to a key with the sync:run scope (POST /api/staff/api-keys)"
+    kill $SERVER_PID 2>/dev/null
+    exit 1
+fi
+TEST_AUTH="Authorization: Bearer $API_KEY"
 
 echo ""
 echo "🏫 Testing Campus 1 (Paris) - Small batch..."
-RESPONSE_1=$(curl -s $TEST_COOKIES -X POST "http://localhost:8080/api/sync-users?campus_id=1")
+RESPONSE_1=$(curl -s -H "$TEST_AUTH" -X POST "http://localhost:8080/api/sync-users?campus_id=1")
 echo "Paris response: $RESPONSE_1"
 
 echo ""
 echo "🏫 Testing Campus 51 (Berlin)..."
-RESPONSE_51=$(curl -s $TEST_COOKIES -X POST "http://localhost:8080/api/sync-users?campus_id=51")
+RESPONSE_51=$(curl -s -H "$TEST_AUTH" -X POST "http://localhost:8080/api/sync-users?campus_id=51")
 echo "Berlin response: $RESPONSE_51"
 
 echo ""
 echo "🏫 Testing Campus 44 (Wolfsburg)..."
-RESPONSE_44=$(curl -s $TEST_COOKIES -X POST "http://localhost:8080/api/sync-users?campus_id=44")
+RESPONSE_44=$(curl -s -H "$TEST_AUTH" -X POST "http://localhost:8080/api/sync-users?campus_id=44")
 echo "Wolfsburg response: $RESPONSE_44"
 
 echo ""
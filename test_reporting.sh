@@ -3,16 +3,22 @@
 echo "🧪 Testing Report Submission"
 echo "============================"
 
-# Start server
-./whistleblower > test.log 2>&1 &
+# Start server against the built-in fake 42 intra (no real credentials needed)
+FAKE_INTRA=true ./whistleblower > test.log 2>&1 &
 SERVER_PID=$!
 sleep 3
 
 echo "✅ Server started"
 
+# Log in through the fake intra OAuth flow as fixture user jdoe
+COOKIES=$(mktemp)
+AUTHORIZE_URL=$(curl -s -c "$COOKIES" -b "$COOKIES" -o /dev/null -w "%{redirect_url}" http://localhost:8080/login)
+CALLBACK_URL=$(curl -s -o /dev/null -w "%{redirect_url}" "$AUTHORIZE_URL&login=jdoe")
+curl -s -c "$COOKIES" -b "$COOKIES" -o /dev/null "$CALLBACK_URL"
+
 # Create test report data
 REPORT_DATA='{
-    "reported_student_login": "testuser", 
+    "reported_student_login": "asmith",
     "project_name": "libft",
     "reason": "plagiarism",
     "explanation": "Test report explanation - this is just a test"
@@ -20,7 +26,7 @@ REPORT_DATA='{
 
 echo ""
 echo "📝 Testing report submission with cookies..."
-RESPONSE=$(curl -s -b "user_login=testuser" -X POST "http://localhost:8080/api/reports" \
+RESPONSE=$(curl -s -b "$COOKIES" -X POST "http://localhost:8080/api/reports" \
     -H "Content-Type: application/json" \
     -d "$REPORT_DATA")
 
@@ -49,7 +55,7 @@ fi
 
 # Clean up
 kill $SERVER_PID 2>/dev/null
-rm -f test.log
+rm -f test.log "$COOKIES"
 
 echo ""
 echo "💡 Summary:"
@@ -3,8 +3,8 @@
 echo "🔄 Testing User Sync Functionality"
 echo "================================"
 
-# Start server in background
-./whistleblower > server.log 2>&1 &
+# Start server in background against the built-in fake 42 intra
+FAKE_INTRA=true ./whistleblower > server.log 2>&1 &
 SERVER_PID=$!
 sleep 3
 
@@ -29,9 +29,9 @@ else
     echo "❌ Admin panel failed"
 fi
 
-# Test sync endpoint (will fail without proper auth, but should return error message)
+# Test sync endpoint without a session
 echo "🔗 Testing sync endpoint..."
-SYNC_RESPONSE=$(curl -s -X POST http://localhost:8080/api/staff/sync-users?campus_id=1)
+SYNC_RESPONSE=$(curl -s -X POST http://localhost:8080/api/sync-users?campus_id=1)
 echo "Response: $SYNC_RESPONSE"
 
 if echo "$SYNC_RESPONSE" | grep -q "Not authenticated\|Staff access required"; then
@@ -40,6 +40,25 @@ else
     echo "❌ Sync endpoint security issue"
 fi
 
+# Log in through the fake intra as fixture staff user bpedago and sync
+echo "🔗 Testing sync against fake intra..."
+COOKIES=$(mktemp)
+AUTHORIZE_URL=$(curl -s -c "$COOKIES" -b "$COOKIES" -o /dev/null -w "%{redirect_url}" http://localhost:8080/login)
+CALLBACK_URL=$(curl -s -o /dev/null -w "%{redirect_url}" "$AUTHORIZE_URL&login=bpedago")
+curl -s -c "$COOKIES" -b "$COOKIES" -o /dev/null "$CALLBACK_URL"
+SYNC_RESPONSE=$(curl -s -b "$COOKIES" -X POST http://localhost:8080/api/sync-users?campus_id=1)
+echo "Response: $SYNC_RESPONSE"
+JOB_ID=$(echo "$SYNC_RESPONSE" | sed -n 's/.*"job_id":\([0-9]*\).*/\1/p')
+if [ -n "$JOB_ID" ]; then
+    for i in 1 2 3 4 5 6 7 8 9 10; do
+        JOB_RESPONSE=$(curl -s -b "$COOKIES" http://localhost:8080/api/jobs/$JOB_ID)
+        echo "$JOB_RESPONSE" | grep -q '"status":"\(succeeded\|failed\|cancelled\)"' && break
+        sleep 1
+    done
+    echo "Job: $JOB_RESPONSE"
+fi
+rm -f "$COOKIES"
+
 # Check database
 echo "🗄️ Checking database..."
 USER_COUNT=$(sqlite3 whistleblower.db "SELECT COUNT(*) FROM users;")